@@ -0,0 +1,348 @@
+package main
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/csv"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+    "github.com/op/go-logging"
+    "golang.org/x/crypto/bcrypt"
+)
+
+const AUTH_ROLE_ADMIN = "admin"
+const AUTH_ROLE_USER = "user"
+
+const AUTH_SESSION_COOKIE = "bsbigmap_session"
+const AUTH_SESSION_DURATION = time.Hour * 24 * 7
+
+// User is authenticated caller of web interface or api
+type User struct {
+    Name string
+    Role string
+}
+
+func (u *User) Admin() bool {
+    return u.Role == AUTH_ROLE_ADMIN
+}
+
+// CanAccess checks if user can see and manage requests and batches of owner
+func (u *User) CanAccess(owner string) bool {
+    return u.Admin() || u.Name == owner
+}
+
+// requestUser returns user authenticated by HandlerAuth (nil if there is none)
+func requestUser(r *http.Request) *User {
+    user, _ := r.Context().Value("user").(*User)
+    return user
+}
+
+type localUser struct {
+    User
+    passwordHash string
+}
+
+// AuthConfig holds authentication settings given by command line options
+type AuthConfig struct {
+    UsersFile string
+    SessionSecret string
+    // users authenticated by OIDC which have admin role (verified email or
+    // subject, without prefix)
+    Admins []string
+    OIDC OIDCConfig
+}
+
+// Auth authenticates users by local accounts (password or api token) or by
+// OIDC provider. Authentication is disabled if neither is configured
+type Auth struct {
+    log *logging.Logger
+    users map[string]*localUser
+    // sha256 of token -> user name
+    tokens map[string]string
+    admins []string
+    secret []byte
+    oidc *OIDCProvider
+    // compared when user doesn't exist, so unknown and known users take
+    // the same time to check
+    dummyHash []byte
+}
+
+// constructor
+func NewAuth(log *logging.Logger, config AuthConfig) (*Auth, error) {
+
+    a := &Auth{
+        log: log,
+        users: make(map[string]*localUser),
+        tokens: make(map[string]string),
+        admins: config.Admins,
+    }
+
+    if len(config.UsersFile) > 0 {
+        if err := a.readUsers(config.UsersFile); err != nil {
+            return nil, err
+        }
+        hash, err := bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+        if err != nil {
+            return nil, err
+        }
+        a.dummyHash = hash
+    }
+
+    if len(config.OIDC.Issuer) > 0 {
+        a.oidc = NewOIDCProvider(config.OIDC)
+    }
+
+    if len(config.SessionSecret) > 0 {
+        a.secret = []byte(config.SessionSecret)
+    } else {
+        a.secret = make([]byte, 32)
+        if _, err := rand.Read(a.secret); err != nil {
+            return nil, err
+        }
+        if a.Enabled() {
+            log.Warningf("Session secret is not set, users have to log in again after restart")
+        }
+    }
+
+    return a, nil
+}
+
+// readUsers reads users file with records: name, bcrypt hash of password,
+// role (admin or user) and optionally sha256 hashes of api tokens
+func (a *Auth) readUsers(fileName string) error {
+
+    f, err := os.Open(fileName)
+    if err != nil {
+        return fmt.Errorf("Cannot open users file %s: %s", fileName, err)
+    }
+    defer f.Close()
+
+    reader := csv.NewReader(f)
+    reader.FieldsPerRecord = -1
+    reader.Comment = '#'
+
+    for {
+        record, err := reader.Read()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return fmt.Errorf("Cannot parse users file %s: %s", fileName, err)
+        }
+        if len(record) < 3 {
+            return fmt.Errorf("Incomplete user record in %s: %s", fileName, strings.Join(record, ","))
+        }
+
+        role := strings.TrimSpace(record[2])
+        if role != AUTH_ROLE_ADMIN && role != AUTH_ROLE_USER {
+            return fmt.Errorf("Unknown role of user %s: %s", record[0], role)
+        }
+
+        user := &localUser{User{strings.TrimSpace(record[0]), role}, strings.TrimSpace(record[1])}
+        if strings.HasPrefix(user.Name, OIDC_USER_PREFIX) {
+            return fmt.Errorf("Name of user %s cannot start with %s", user.Name, OIDC_USER_PREFIX)
+        }
+        a.users[user.Name] = user
+
+        for _, token := range record[3:] {
+            if token = strings.ToLower(strings.TrimSpace(token)); len(token) > 0 {
+                a.tokens[token] = user.Name
+            }
+        }
+    }
+
+    return nil
+}
+
+// Enabled returns false if there is no way to authenticate, web interface
+// is open to everyone in that case
+func (a *Auth) Enabled() bool {
+    return len(a.users) > 0 || a.oidc != nil
+}
+
+// Login checks password of local user
+func (a *Auth) Login(name, password string) (*User, error) {
+    hash := a.dummyHash
+    user, exists := a.users[name]
+    if exists {
+        hash = []byte(user.passwordHash)
+    }
+    if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil || !exists {
+        return nil, fmt.Errorf("Invalid user name or password")
+    }
+    return &user.User, nil
+}
+
+// HashToken returns hash of api token stored in users file
+func HashToken(token string) string {
+    hash := sha256.Sum256([]byte(token))
+    return hex.EncodeToString(hash[:])
+}
+
+// NewToken generates random api token
+func NewToken() (string, error) {
+    token := make([]byte, 24)
+    if _, err := rand.Read(token); err != nil {
+        return "", err
+    }
+    return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+func (a *Auth) tokenUser(token string) *User {
+    name, exists := a.tokens[HashToken(token)]
+    if !exists {
+        return nil
+    }
+    return a.currentUser(name)
+}
+
+// currentUser returns user of given name with current role, nil is
+// returned if user doesn't exist any more
+func (a *Auth) currentUser(name string) *User {
+    if strings.HasPrefix(name, OIDC_USER_PREFIX) {
+        if a.oidc == nil {
+            return nil
+        }
+        return &User{name, a.oidcRole(name)}
+    }
+    user, exists := a.users[name]
+    if !exists {
+        return nil
+    }
+    return &user.User
+}
+
+// sign appends signature to value, so it can be given to client and
+// verified when it comes back
+func (a *Auth) sign(value string) string {
+    return signValue(a.secret, value)
+}
+
+// verify returns signed value if signature is valid
+func (a *Auth) verify(signed string) (string, bool) {
+    return verifyValue(a.secret, signed)
+}
+
+// signValue appends HMAC-SHA256 of value to value
+func signValue(secret []byte, value string) string {
+    h := hmac.New(sha256.New, secret)
+    h.Write([]byte(value))
+    return value + "." + base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// verifyValue returns value signed by signValue if signature is valid
+func verifyValue(secret []byte, signed string) (string, bool) {
+    i := strings.LastIndex(signed, ".")
+    if i < 0 {
+        return "", false
+    }
+    value := signed[:i]
+    return value, hmac.Equal([]byte(signValue(secret, value)), []byte(signed))
+}
+
+// setSession sets cookie of logged in user, cookie holds only name of user,
+// role is looked up on every request
+func (a *Auth) setSession(w http.ResponseWriter, r *http.Request, user *User) {
+    expires := time.Now().Add(AUTH_SESSION_DURATION)
+    value := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s\n%d", user.Name, expires.Unix())))
+    http.SetCookie(w, &http.Cookie{
+        Name: AUTH_SESSION_COOKIE,
+        Value: a.sign(value),
+        Path: "/",
+        Expires: expires,
+        HttpOnly: true,
+        Secure: r.TLS != nil,
+        SameSite: http.SameSiteLaxMode,
+    })
+}
+
+func (a *Auth) clearSession(w http.ResponseWriter) {
+    http.SetCookie(w, &http.Cookie{Name: AUTH_SESSION_COOKIE, Value: "", Path: "/", MaxAge: -1})
+}
+
+func (a *Auth) sessionUser(r *http.Request) *User {
+    cookie, err := r.Cookie(AUTH_SESSION_COOKIE)
+    if err != nil {
+        return nil
+    }
+    value, ok := a.verify(cookie.Value)
+    if !ok {
+        return nil
+    }
+    decoded, err := base64.RawURLEncoding.DecodeString(value)
+    if err != nil {
+        return nil
+    }
+    parts := strings.Split(string(decoded), "\n")
+    if len(parts) != 2 {
+        return nil
+    }
+    expires, err := strconv.ParseInt(parts[1], 10, 64)
+    if err != nil || expires < time.Now().Unix() {
+        return nil
+    }
+    return a.currentUser(parts[0])
+}
+
+// Authenticate returns user of api token (Authorization: Bearer <token>)
+// or of session cookie, nil is returned for anonymous request
+func (a *Auth) Authenticate(r *http.Request) *User {
+    if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+        return a.tokenUser(strings.TrimPrefix(auth, "Bearer "))
+    }
+    return a.sessionUser(r)
+}
+
+// oidcRole returns role of user authenticated by OIDC provider
+func (a *Auth) oidcRole(name string) string {
+    if containsString(a.admins, strings.TrimPrefix(name, OIDC_USER_PREFIX)) {
+        return AUTH_ROLE_ADMIN
+    }
+    return AUTH_ROLE_USER
+}
+
+// HandlerAuth passes only authenticated requests to handler, user is
+// available in request context (see requestUser). Browsers are redirected
+// to login page, api clients get 401
+type HandlerAuth struct {
+    log *logging.Logger
+    auth *Auth
+    handler http.Handler
+    adminOnly bool
+}
+
+func (h *HandlerAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+    // without authentication everybody is admin
+    user := &User{Role: AUTH_ROLE_ADMIN}
+
+    if h.auth.Enabled() {
+        user = h.auth.Authenticate(r)
+        if user == nil {
+            if r.Method == http.MethodGet && len(r.Header.Get("Authorization")) == 0 && strings.Contains(r.Header.Get("Accept"), "text/html") {
+                http.Redirect(w, r, loginUrl(r.URL.RequestURI()), http.StatusFound)
+                return
+            }
+            w.Header().Set("WWW-Authenticate", "Bearer")
+            WriteErrorResponse(w, http.StatusUnauthorized, fmt.Errorf("Authentication required"))
+            return
+        }
+    }
+
+    if h.adminOnly && !user.Admin() {
+        WriteErrorResponse(w, http.StatusForbidden, fmt.Errorf("Only admins are allowed"))
+        return
+    }
+
+    ctx := context.WithValue(r.Context(), "user", user)
+    h.handler.ServeHTTP(w, r.WithContext(ctx))
+}
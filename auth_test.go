@@ -0,0 +1,323 @@
+package main
+
+import (
+    "crypto"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "io/ioutil"
+    "math/big"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+    "github.com/op/go-logging"
+    "golang.org/x/crypto/bcrypt"
+)
+
+// newTestAuth creates auth with users alice (admin), bob (user with api
+// token "bob-token") and dave (user)
+func newTestAuth(t *testing.T, oidc OIDCConfig) (*Auth, func()) {
+    dir, err := ioutil.TempDir("", "auth")
+    Ok(t, err)
+
+    alice, err := bcrypt.GenerateFromPassword([]byte("alice-pwd"), bcrypt.MinCost)
+    Ok(t, err)
+    bob, err := bcrypt.GenerateFromPassword([]byte("bob-pwd"), bcrypt.MinCost)
+    Ok(t, err)
+
+    users := "# name,password,role,tokens\n" +
+        "alice," + string(alice) + ",admin\n" +
+        "bob," + string(bob) + ",user," + HashToken("bob-token") + "\n" +
+        "dave," + string(bob) + ",user\n"
+    fileName := filepath.Join(dir, "users.csv")
+    Ok(t, ioutil.WriteFile(fileName, []byte(users), 0600))
+
+    auth, err := NewAuth(logging.MustGetLogger("test"), AuthConfig{UsersFile: fileName, SessionSecret: "secret", Admins: []string{"carol@example.com"}, OIDC: oidc})
+    Ok(t, err)
+
+    return auth, func() { os.RemoveAll(dir) }
+}
+
+func TestAuthLocalUsers(t *testing.T) {
+    auth, cleanup := newTestAuth(t, OIDCConfig{})
+    defer cleanup()
+
+    Equals(t, true, auth.Enabled())
+
+    user, err := auth.Login("alice", "alice-pwd")
+    Ok(t, err)
+    Equals(t, &User{"alice", AUTH_ROLE_ADMIN}, user)
+
+    _, err = auth.Login("alice", "bob-pwd")
+    Equals(t, true, err != nil)
+    _, err = auth.Login("nobody", "alice-pwd")
+    Equals(t, true, err != nil)
+
+    // api token
+    r := httptest.NewRequest(http.MethodGet, "/queue", nil)
+    r.Header.Set("Authorization", "Bearer bob-token")
+    Equals(t, &User{"bob", AUTH_ROLE_USER}, auth.Authenticate(r))
+    r.Header.Set("Authorization", "Bearer wrong")
+    Equals(t, true, auth.Authenticate(r) == nil)
+
+    // session cookie
+    w := httptest.NewRecorder()
+    auth.setSession(w, r, &User{"bob", AUTH_ROLE_USER})
+    cookie := w.Result().Cookies()[0]
+
+    r = httptest.NewRequest(http.MethodGet, "/queue", nil)
+    r.AddCookie(cookie)
+    Equals(t, &User{"bob", AUTH_ROLE_USER}, auth.Authenticate(r))
+
+    // role is taken from users, not from cookie
+    auth.users["bob"].Role = AUTH_ROLE_ADMIN
+    Equals(t, &User{"bob", AUTH_ROLE_ADMIN}, auth.Authenticate(r))
+    auth.users["bob"].Role = AUTH_ROLE_USER
+
+    // session of removed user is rejected
+    w = httptest.NewRecorder()
+    auth.setSession(w, r, &User{"eve", AUTH_ROLE_ADMIN})
+    r = httptest.NewRequest(http.MethodGet, "/queue", nil)
+    r.AddCookie(w.Result().Cookies()[0])
+    Equals(t, true, auth.Authenticate(r) == nil)
+
+    // session of OIDC user is rejected without OIDC provider
+    w = httptest.NewRecorder()
+    auth.setSession(w, r, &User{OIDC_USER_PREFIX + "carol@example.com", AUTH_ROLE_USER})
+    r = httptest.NewRequest(http.MethodGet, "/queue", nil)
+    r.AddCookie(w.Result().Cookies()[0])
+    Equals(t, true, auth.Authenticate(r) == nil)
+
+    // cookie with changed name is rejected
+    value, ok := auth.verify(cookie.Value)
+    Equals(t, true, ok)
+    decoded, _ := base64.RawURLEncoding.DecodeString(value)
+    tampered := strings.Replace(string(decoded), "bob", "alice", 1)
+    cookie.Value = base64.RawURLEncoding.EncodeToString([]byte(tampered)) + cookie.Value[len(value):]
+    r = httptest.NewRequest(http.MethodGet, "/queue", nil)
+    r.AddCookie(cookie)
+    Equals(t, true, auth.Authenticate(r) == nil)
+}
+
+func TestOIDCUserName(t *testing.T) {
+    Equals(t, "oidc:123", oidcUserName(map[string]interface{}{"sub": "123", "preferred_username": "alice", "email": "alice@example.com"}))
+    Equals(t, "oidc:123", oidcUserName(map[string]interface{}{"sub": "123", "email": "alice@example.com", "email_verified": false}))
+    Equals(t, "oidc:alice@example.com", oidcUserName(map[string]interface{}{"sub": "123", "email": "alice@example.com", "email_verified": true}))
+    Equals(t, "", oidcUserName(map[string]interface{}{"preferred_username": "alice"}))
+}
+
+func TestHandlerAuth(t *testing.T) {
+    auth, cleanup := newTestAuth(t, OIDCConfig{})
+    defer cleanup()
+
+    log := logging.MustGetLogger("test")
+    var seen *User
+    handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        seen = requestUser(r)
+    })
+
+    // api client without token
+    w := httptest.NewRecorder()
+    (&HandlerAuth{log, auth, handler, false}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/queue", nil))
+    Equals(t, http.StatusUnauthorized, w.Code)
+
+    // browser is sent to login page
+    w = httptest.NewRecorder()
+    r := httptest.NewRequest(http.MethodGet, "/queue?request=x", nil)
+    r.Header.Set("Accept", "text/html")
+    (&HandlerAuth{log, auth, handler, false}).ServeHTTP(w, r)
+    Equals(t, http.StatusFound, w.Code)
+    Equals(t, "/login?next=%2Fqueue%3Frequest%3Dx", w.Header().Get("Location"))
+
+    r = httptest.NewRequest(http.MethodGet, "/queue", nil)
+    r.Header.Set("Authorization", "Bearer bob-token")
+    w = httptest.NewRecorder()
+    (&HandlerAuth{log, auth, handler, false}).ServeHTTP(w, r)
+    Equals(t, http.StatusOK, w.Code)
+    Equals(t, "bob", seen.Name)
+
+    w = httptest.NewRecorder()
+    (&HandlerAuth{log, auth, handler, true}).ServeHTTP(w, r)
+    Equals(t, http.StatusForbidden, w.Code)
+
+    // without users everybody is admin
+    open, err := NewAuth(log, AuthConfig{})
+    Ok(t, err)
+    w = httptest.NewRecorder()
+    (&HandlerAuth{log, open, handler, true}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/queue", nil))
+    Equals(t, http.StatusOK, w.Code)
+    Equals(t, true, seen.Admin())
+}
+
+func TestLocalPath(t *testing.T) {
+    Equals(t, "/queue?request=1", localPath("/queue?request=1"))
+    Equals(t, "/", localPath("https://evil.example.com/"))
+    Equals(t, "/", localPath("//evil.example.com/"))
+    Equals(t, "/", localPath("/\\evil.example.com/"))
+}
+
+// newTestOIDCProvider runs mock OIDC provider issuing id tokens for given
+// user, nonce is taken from authorization request
+func newTestOIDCProvider(t *testing.T, user string) *httptest.Server {
+    key, err := rsa.GenerateKey(rand.Reader, 2048)
+    Ok(t, err)
+
+    var server *httptest.Server
+    codes := make(map[string]string)
+
+    mux := http.NewServeMux()
+    mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+        json.NewEncoder(w).Encode(map[string]string{
+            "issuer": server.URL,
+            "authorization_endpoint": server.URL + "/authorize",
+            "token_endpoint": server.URL + "/token",
+            "jwks_uri": server.URL + "/keys",
+        })
+    })
+    mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+        json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+            "kty": "RSA",
+            "kid": "k1",
+            "n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+            "e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+        }}})
+    })
+    mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+        codes["code-1"] = r.URL.Query().Get("nonce")
+        http.Redirect(w, r, r.URL.Query().Get("redirect_uri") + "?code=code-1&state=" + url.QueryEscape(r.URL.Query().Get("state")), http.StatusFound)
+    })
+    mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+        id, secret, _ := r.BasicAuth()
+        nonce, exists := codes[r.FormValue("code")]
+        if id != "client" || secret != "client-secret" || !exists {
+            http.Error(w, "invalid_grant", http.StatusBadRequest)
+            return
+        }
+        header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1"})
+        claims, _ := json.Marshal(map[string]interface{}{
+            "iss": server.URL,
+            "aud": "client",
+            "sub": "123",
+            "preferred_username": "alice",
+            "email": user,
+            "email_verified": true,
+            "nonce": nonce,
+            "exp": time.Now().Add(time.Minute).Unix(),
+        })
+        signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+        hash := sha256.Sum256([]byte(signed))
+        signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+        json.NewEncoder(w).Encode(map[string]string{"id_token": signed + "." + base64.RawURLEncoding.EncodeToString(signature)})
+    })
+
+    server = httptest.NewServer(mux)
+    return server
+}
+
+func TestOIDCLogin(t *testing.T) {
+    provider := newTestOIDCProvider(t, "carol@example.com")
+    defer provider.Close()
+
+    auth, cleanup := newTestAuth(t, OIDCConfig{Issuer: provider.URL, ClientId: "client", ClientSecret: "client-secret"})
+    defer cleanup()
+
+    log := logging.MustGetLogger("test")
+    login := &HandlerLogin{log, auth, "http://bigmap.example.com"}
+
+    // login page of provider
+    w := httptest.NewRecorder()
+    login.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/auth/oidc?next=/queue", nil))
+    Equals(t, http.StatusFound, w.Code)
+    Equals(t, true, strings.HasPrefix(w.Header().Get("Location"), provider.URL + "/authorize?"))
+    stateCookie := w.Result().Cookies()[0]
+
+    // provider redirects back with code
+    client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+    resp, err := client.Get(w.Header().Get("Location"))
+    Ok(t, err)
+    resp.Body.Close()
+    callback, err := url.Parse(resp.Header.Get("Location"))
+    Ok(t, err)
+    Equals(t, "/auth/callback", callback.Path)
+
+    // callback without state cookie fails
+    w = httptest.NewRecorder()
+    login.ServeHTTP(w, httptest.NewRequest(http.MethodGet, callback.RequestURI(), nil))
+    Equals(t, http.StatusUnauthorized, w.Code)
+
+    w = httptest.NewRecorder()
+    r := httptest.NewRequest(http.MethodGet, callback.RequestURI(), nil)
+    r.AddCookie(stateCookie)
+    login.ServeHTTP(w, r)
+    Equals(t, http.StatusSeeOther, w.Code)
+    Equals(t, "/queue", w.Header().Get("Location"))
+
+    var session *http.Cookie
+    for _, c := range w.Result().Cookies() {
+        if c.Name == AUTH_SESSION_COOKIE {
+            session = c
+        }
+    }
+    r = httptest.NewRequest(http.MethodGet, "/queue", nil)
+    r.AddCookie(session)
+    Equals(t, &User{"oidc:carol@example.com", AUTH_ROLE_ADMIN}, auth.Authenticate(r))
+}
+
+func TestQueueOwner(t *testing.T) {
+    q, cleanup := newTestQueue(t, 0)
+    defer cleanup()
+
+    p := Provider{Name: "test", MinZoom: 0, MaxZoom: 5, Scale: 4, Url: "http://localhost/{z}/{x}/{y}.png"}
+    ip := InputParams{Zoom: 1, XMin: 0, YMin: 0, XMax: 1, YMax: 1, Scale: 4, Provider: p}
+    ip.Normalize()
+
+    // same params of different owners are not deduplicated
+    r1, err := q.Enqueue(&ip, EnqueueOptions{Owner: "alice"})
+    Ok(t, err)
+    r2, err := q.Enqueue(&ip, EnqueueOptions{Owner: "bob"})
+    Ok(t, err)
+    Equals(t, true, r1.Id != r2.Id)
+    Equals(t, "bob", r2.Owner)
+
+    // request can be shared only by owner and admins
+    Ok(t, q.updateRequest(r2.Id, func(r *QueueRequest) error {
+        r.State = QUEUE_REQUEST_STATE_DONE
+        return nil
+    }))
+
+    log := logging.MustGetLogger("test")
+    auth, cleanupAuth := newTestAuth(t, OIDCConfig{})
+    defer cleanupAuth()
+    handler := &HandlerAuth{log, auth, &HandlerQueue{log, q}, false}
+
+    cases := []struct{
+        user User
+        status int
+    }{
+        {User{"bob", AUTH_ROLE_USER}, http.StatusSeeOther},
+        {User{"alice", AUTH_ROLE_ADMIN}, http.StatusSeeOther},
+        {User{"dave", AUTH_ROLE_USER}, http.StatusNotFound},
+    }
+    for _, c := range cases {
+        w := httptest.NewRecorder()
+        r := httptest.NewRequest(http.MethodPost, "/queue/share", strings.NewReader("request=" + r2.Id))
+        r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+        auth.setSession(w, r, &c.user)
+        r.AddCookie(w.Result().Cookies()[0])
+
+        w = httptest.NewRecorder()
+        handler.ServeHTTP(w, r)
+        Equals(t, c.status, w.Code)
+    }
+
+    r2, err = q.GetRequest(r2.Id)
+    Ok(t, err)
+    Equals(t, 2, len(r2.Shares))
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+    "archive/zip"
+    "bytes"
+    "encoding/csv"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const BATCH_FORMAT_JSON = "json"
+const BATCH_FORMAT_CSV = "csv"
+
+// max number of rows of one manifest
+const BATCH_MAX_ROWS = 1000
+
+var batchIdRegexp = regexp.MustCompile(`^[0-9a-zA-Z-]+$`)
+var batchNameRegexp = regexp.MustCompile(`[^0-9a-zA-Z._-]+`)
+
+// BatchRow is one line of batch manifest. Area is given either by bounding
+// box (minlon,minlat,maxlon,maxlat) or by tile range if bbox is empty
+type BatchRow struct {
+    Name string `json:"name"`
+    Provider string `json:"provider"`
+    Zoom int `json:"zoom"`
+    BBox string `json:"bbox"`
+    XMin int `json:"xmin"`
+    YMin int `json:"ymin"`
+    XMax int `json:"xmax"`
+    YMax int `json:"ymax"`
+    Scale int `json:"scale"`
+    Format string `json:"format"`
+    Priority string `json:"priority"`
+    Validity string `json:"validity"`
+}
+
+// Batch groups queue requests created from one manifest
+type Batch struct {
+    Id string
+    Created int64
+    // user who uploaded manifest
+    Owner string
+    Entries []BatchEntry
+}
+
+type BatchEntry struct {
+    Name string
+    RequestId string
+}
+
+// detectBatchFormat guesses manifest format from file name or content
+func detectBatchFormat(fileName string, content []byte) string {
+    switch strings.ToLower(filepath.Ext(fileName)) {
+    case ".json":
+        return BATCH_FORMAT_JSON
+    case ".csv":
+        return BATCH_FORMAT_CSV
+    }
+    trimmed := bytes.TrimSpace(content)
+    if len(trimmed) > 0 && (trimmed[0] == '[' || trimmed[0] == '{') {
+        return BATCH_FORMAT_JSON
+    }
+    return BATCH_FORMAT_CSV
+}
+
+// parseBatchManifest parses manifest in json (array of rows) or csv
+// (first line is header with column names matching json keys) format
+func parseBatchManifest(content []byte, format string) ([]BatchRow, error) {
+
+    var rows []BatchRow
+
+    if format == BATCH_FORMAT_JSON {
+        if err := json.Unmarshal(content, &rows); err != nil {
+            return nil, fmt.Errorf("Cannot parse json manifest: %s", err)
+        }
+    } else {
+        r := csv.NewReader(bytes.NewReader(content))
+        r.Comment = '#'
+        header, err := r.Read()
+        if err != nil {
+            return nil, fmt.Errorf("Cannot read csv manifest header: %s", err)
+        }
+        for {
+            rec, err := r.Read()
+            if err == io.EOF {
+                break
+            }
+            if err != nil {
+                return nil, fmt.Errorf("Cannot parse csv manifest: %s", err)
+            }
+            if len(rows) == BATCH_MAX_ROWS {
+                return nil, fmt.Errorf("Manifest has more than %d rows", BATCH_MAX_ROWS)
+            }
+            row, err := parseBatchCsvRecord(header, rec)
+            if err != nil {
+                return nil, err
+            }
+            rows = append(rows, row)
+        }
+    }
+
+    if len(rows) == 0 {
+        return nil, fmt.Errorf("Manifest is empty")
+    }
+    if len(rows) > BATCH_MAX_ROWS {
+        return nil, fmt.Errorf("Manifest has more than %d rows", BATCH_MAX_ROWS)
+    }
+
+    return rows, nil
+}
+
+func parseBatchCsvRecord(header, rec []string) (BatchRow, error) {
+    var err error
+    row := BatchRow{}
+
+    for i, column := range header {
+        value := strings.TrimSpace(rec[i])
+        if len(value) == 0 {
+            continue
+        }
+        switch strings.ToLower(strings.TrimSpace(column)) {
+        case "name":
+            row.Name = value
+        case "provider":
+            row.Provider = value
+        case "bbox":
+            row.BBox = value
+        case "format":
+            row.Format = value
+        case "priority":
+            row.Priority = value
+        case "validity":
+            row.Validity = value
+        case "zoom":
+            row.Zoom, err = strconv.Atoi(value)
+        case "xmin":
+            row.XMin, err = strconv.Atoi(value)
+        case "ymin":
+            row.YMin, err = strconv.Atoi(value)
+        case "xmax":
+            row.XMax, err = strconv.Atoi(value)
+        case "ymax":
+            row.YMax, err = strconv.Atoi(value)
+        case "scale":
+            row.Scale, err = strconv.Atoi(value)
+        default:
+            return row, fmt.Errorf("Unknown manifest column: %s", column)
+        }
+        if err != nil {
+            return row, fmt.Errorf("Cannot parse %s column: %s", column, err)
+        }
+    }
+
+    return row, nil
+}
+
+// InputParams converts manifest row to normalized input params
+func (row *BatchRow) InputParams(providers *Providers) (InputParams, error) {
+
+    p, exists := providers.Get(row.Provider)
+    if !exists {
+        return InputParams{}, fmt.Errorf("Unknown provider: %s", row.Provider)
+    }
+
+    var ip InputParams
+    if len(row.BBox) > 0 {
+        bbox, err := parseBBox(row.BBox)
+        if err != nil {
+            return ip, err
+        }
+        if ip, err = bboxToInputParams(p, row.Zoom, bbox); err != nil {
+            return ip, err
+        }
+    } else {
+        ip = InputParams{Zoom: row.Zoom, XMin: row.XMin, YMin: row.YMin, XMax: row.XMax, YMax: row.YMax, Scale: p.Scale, Provider: p}
+    }
+
+    if row.Scale != 0 {
+        ip.Scale = row.Scale
+    }
+    ip.Format = row.Format
+    ip.Normalize()
+
+    return ip, ip.validate()
+}
+
+// Options returns enqueue options of row, priority and validity of row
+// override given options. Priority is limited by options.MaxPriority
+func (row *BatchRow) Options(options EnqueueOptions) (EnqueueOptions, error) {
+    if len(row.Priority) > 0 {
+        priority, err := ParsePriorityStrict(row.Priority)
+        if err != nil {
+            return options, err
+        }
+        options.Priority = IntMin(priority, options.MaxPriority)
+    }
+    if len(row.Validity) > 0 {
+        validity, err := ParseValidity(row.Validity)
+        if err != nil {
+            return options, err
+        }
+        options.Validity = validity
+    }
+    return options, nil
+}
+
+// BatchInputParams converts all manifest rows, whole batch is refused
+// if any of rows is invalid (including its priority and validity)
+func BatchInputParams(rows []BatchRow, providers *Providers) ([]InputParams, error) {
+    var ips []InputParams
+    for i := range rows {
+        ip, err := rows[i].InputParams(providers)
+        if err == nil {
+            _, err = rows[i].Options(EnqueueOptions{})
+        }
+        if err != nil {
+            return nil, fmt.Errorf("Manifest row %d: %s", i + 1, err)
+        }
+        ips = append(ips, ip)
+    }
+    return ips, nil
+}
+
+func (q *Queue) batchFileName(id string) string {
+    return filepath.Join(q.dir, QUEUE_BATCH_DIR, GetJsonFileName(id))
+}
+
+// EnqueueBatch enqueues all rows of manifest and stores batch record. Options
+// of all rows are resolved first, so invalid row doesn't leave requests of
+// previous rows enqueued
+func (q *Queue) EnqueueBatch(rows []BatchRow, ips []InputParams, options EnqueueOptions) (*Batch, error) {
+
+    batch := Batch{Id: UniqueId(), Created: time.Now().Unix(), Owner: options.Owner}
+
+    var rowOptions []EnqueueOptions
+    for i := range ips {
+        o, err := rows[i].Options(options)
+        if err != nil {
+            return nil, fmt.Errorf("Manifest row %d: %s", i + 1, err)
+        }
+        rowOptions = append(rowOptions, o)
+    }
+
+    for i := range ips {
+        request, err := q.Enqueue(&ips[i], rowOptions[i])
+        if err != nil {
+            return nil, err
+        }
+
+        // name of file in zip archive
+        name := rows[i].Name
+        if len(name) == 0 {
+            name = request.Id
+        }
+        name = fmt.Sprintf("%03d-%s", i + 1, batchNameRegexp.ReplaceAllString(name, "_"))
+
+        batch.Entries = append(batch.Entries, BatchEntry{name, request.Id})
+    }
+
+    batchJson, err := json.MarshalIndent(batch, "", " ")
+    if err != nil {
+        return nil, err
+    }
+    if err = ioutil.WriteFile(q.batchFileName(batch.Id), batchJson, 0644); err != nil {
+        return nil, err
+    }
+
+    q.log.Infof("New batch %s with %d requests", batch.Id, len(batch.Entries))
+
+    return &batch, nil
+}
+
+// GetBatch returns batch of given id or nil if it doesn't exist
+func (q *Queue) GetBatch(id string) (*Batch, error) {
+
+    if !batchIdRegexp.MatchString(id) {
+        return nil, nil
+    }
+
+    batchJson, err := ioutil.ReadFile(q.batchFileName(id))
+    if os.IsNotExist(err) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    batch := Batch{}
+    if err = json.Unmarshal(batchJson, &batch); err != nil {
+        return nil, err
+    }
+
+    return &batch, nil
+}
+
+// removeExpiredBatches removes batch records older than queue validity,
+// requests of batch are removed by monitor in the same way as other requests
+func (q *Queue) removeExpiredBatches() {
+
+    files, err := ioutil.ReadDir(filepath.Join(q.dir, QUEUE_BATCH_DIR))
+    if err != nil {
+        q.log.Errorf("Cannot read content of batch directory: %s", err)
+        return
+    }
+
+    for _, file := range files {
+        if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
+            continue
+        }
+        if time.Since(file.ModTime()) > q.config.Validity {
+            q.log.Debugf("Remove batch %s", file.Name())
+            if err := os.Remove(filepath.Join(q.dir, QUEUE_BATCH_DIR, file.Name())); err != nil {
+                q.log.Warningf("Remove batch file %s failed: %s", file.Name(), err)
+            }
+        }
+    }
+}
+
+// BatchRequests returns requests of batch in manifest order, requests
+// that no longer exist are returned as nil
+func (q *Queue) BatchRequests(batch *Batch) ([]*QueueRequest, error) {
+
+    var result []*QueueRequest
+    for _, e := range batch.Entries {
+        r, err := q.store.Get(e.RequestId)
+        if err != nil {
+            return nil, err
+        }
+        result = append(result, r)
+    }
+
+    return result, nil
+}
+
+// writeBatchZip writes images of all done requests of batch to zip archive
+func (q *Queue) writeBatchZip(w io.Writer, batch *Batch, requests []*QueueRequest) error {
+
+    zw := zip.NewWriter(w)
+
+    for i, e := range batch.Entries {
+        r := requests[i]
+        if r == nil || r.State != QUEUE_REQUEST_STATE_DONE {
+            continue
+        }
+
+        f, err := q.results.Open(q.resultName(r))
+        if err != nil {
+            return err
+        }
+
+        // images are already compressed, store them as they are
+        zf, err := zw.CreateHeader(&zip.FileHeader{Name: e.Name + filepath.Ext(q.resultName(r)), Method: zip.Store})
+        if err == nil {
+            _, err = io.Copy(zf, f)
+        }
+        f.Close()
+        if err != nil {
+            return err
+        }
+    }
+
+    return zw.Close()
+}
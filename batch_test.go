@@ -0,0 +1,108 @@
+package main
+
+import (
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestParseBatchManifestCsv(t *testing.T) {
+    content := []byte("name,provider,zoom,bbox,format\n" +
+        "# comment\n" +
+        "section 1,osm,14,\"14.2,49.9,14.7,50.2\",jpeg\n" +
+        "section 2,osm,12,\"14.2,49.9,14.7,50.2\",\n")
+
+    Equals(t, BATCH_FORMAT_CSV, detectBatchFormat("manifest.csv", content))
+
+    rows, err := parseBatchManifest(content, BATCH_FORMAT_CSV)
+    Ok(t, err)
+    Equals(t, 2, len(rows))
+    Equals(t, BatchRow{Name: "section 1", Provider: "osm", Zoom: 14, BBox: "14.2,49.9,14.7,50.2", Format: "jpeg"}, rows[0])
+
+    providers := NewProviders(map[string]Provider{"osm": Provider{Name: "osm", MinZoom: 0, MaxZoom: 13, Scale: 256}})
+    ips, err := BatchInputParams(rows, providers)
+    Ok(t, err)
+    // zoom is clamped to provider limit, bbox is covered at clamped zoom
+    Equals(t, 13, ips[0].Zoom)
+    Equals(t, [4]int{4419, 2771, 4430, 2781}, [4]int{ips[0].XMin, ips[0].YMin, ips[0].XMax, ips[0].YMax})
+    Equals(t, IMAGE_FORMAT_JPEG, ips[0].Format)
+    Equals(t, IMAGE_FORMAT_PNG, ips[1].Format)
+    Equals(t, 12, ips[1].Zoom)
+    Equals(t, [4]int{2209, 1385, 2215, 1390}, [4]int{ips[1].XMin, ips[1].YMin, ips[1].XMax, ips[1].YMax})
+
+    // bbox outside of Web Mercator is refused
+    rows[1].BBox = "14.2,49.9,14.7,89"
+    _, err = BatchInputParams(rows, providers)
+    Equals(t, true, err != nil)
+
+    // scale is limited by scale of provider
+    rows[1].BBox = "14.2,49.9,14.7,50.2"
+    for _, scale := range []int{-1, 1025} {
+        rows[1].Scale = scale
+        _, err = BatchInputParams(rows, providers)
+        Equals(t, true, err != nil)
+    }
+    rows[1].Scale = 1024
+    _, err = BatchInputParams(rows, providers)
+    Ok(t, err)
+}
+
+func TestParseBatchManifestJson(t *testing.T) {
+    content := []byte(` [{"provider": "osm", "zoom": 3, "xmin": 1, "ymin": 2, "xmax": 3, "ymax": 4}]`)
+
+    Equals(t, BATCH_FORMAT_JSON, detectBatchFormat("", content))
+
+    rows, err := parseBatchManifest(content, BATCH_FORMAT_JSON)
+    Ok(t, err)
+    Equals(t, []BatchRow{BatchRow{Provider: "osm", Zoom: 3, XMin: 1, YMin: 2, XMax: 3, YMax: 4}}, rows)
+
+    _, err = BatchInputParams(rows, NewProviders(map[string]Provider{}))
+    Equals(t, true, err != nil)
+}
+
+func TestParseBatchManifestLimit(t *testing.T) {
+    content := "provider,zoom,xmin,ymin,xmax,ymax\n" + strings.Repeat("osm,3,1,2,3,4\n", BATCH_MAX_ROWS)
+    rows, err := parseBatchManifest([]byte(content), BATCH_FORMAT_CSV)
+    Ok(t, err)
+    Equals(t, BATCH_MAX_ROWS, len(rows))
+
+    _, err = parseBatchManifest([]byte(content + "osm,3,1,2,3,4\n"), BATCH_FORMAT_CSV)
+    Equals(t, true, err != nil)
+
+    _, err = parseBatchManifest([]byte("[" + strings.Repeat(`{"provider": "osm"},`, BATCH_MAX_ROWS) + `{"provider": "osm"}]`), BATCH_FORMAT_JSON)
+    Equals(t, true, err != nil)
+}
+
+func TestEnqueueBatchInvalidRow(t *testing.T) {
+    q, cleanup := newTestQueue(t, 0)
+    defer cleanup()
+
+    p := Provider{Name: "test", MinZoom: 0, MaxZoom: 5, Scale: 4, Url: "http://localhost/{z}/{x}/{y}.png"}
+    providers := NewProviders(map[string]Provider{"test": p})
+    rows := []BatchRow{
+        BatchRow{Provider: "test", Zoom: 1, XMax: 1, YMax: 1, Priority: "high", Validity: "2d"},
+        BatchRow{Provider: "test", Zoom: 2, XMax: 1, YMax: 1, Validity: "soon"},
+    }
+
+    // invalid validity refuses whole batch before anything is enqueued
+    _, err := BatchInputParams(rows, providers)
+    Equals(t, true, err != nil)
+    ips, err := BatchInputParams(rows[:1], providers)
+    Ok(t, err)
+    _, err = q.EnqueueBatch(rows, append(ips, ips[0]), EnqueueOptions{MaxPriority: QUEUE_PRIORITY_NORMAL})
+    Equals(t, true, err != nil)
+    requests, err := q.store.List()
+    Ok(t, err)
+    Equals(t, 0, len(requests))
+
+    // unknown priority is refused
+    rows[1] = BatchRow{Provider: "test", Zoom: 2, XMax: 1, YMax: 1, Priority: "urgent"}
+    _, err = BatchInputParams(rows, providers)
+    Equals(t, true, err != nil)
+
+    // priority of row is limited by max priority
+    options, err := rows[0].Options(EnqueueOptions{MaxPriority: QUEUE_PRIORITY_NORMAL})
+    Ok(t, err)
+    Equals(t, QUEUE_PRIORITY_NORMAL, options.Priority)
+    Equals(t, time.Hour * 48, options.Validity)
+}
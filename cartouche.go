@@ -0,0 +1,245 @@
+package main
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "html"
+    "image"
+    "image/color"
+    "math"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// units of scale bar
+const CARTOUCHE_METRIC = "metric"
+const CARTOUCHE_IMPERIAL = "imperial"
+
+// max length of title
+const CARTOUCHE_TITLE_MAX = 200
+
+// sizes of cartouche texts in points, they are scaled to pixels by
+// resolution
+const CARTOUCHE_TITLE_POINTS = 12.0
+const CARTOUCHE_TEXT_POINTS = 7.0
+
+// max length of scale bar in inches
+const CARTOUCHE_SCALE_INCHES = 1.25
+
+// format of creation date
+const CARTOUCHE_DATE_FORMAT = "2006-01-02"
+
+// equatorial circumference used by Web Mercator
+const MERCATOR_CIRCUMFERENCE = 2 * math.Pi * 6378137
+
+const METERS_PER_FOOT = 0.3048
+const METERS_PER_MILE = 1609.344
+
+var htmlTag = regexp.MustCompile(`<[^>]*>`)
+
+// Cartouche is box drawn into bottom left corner of map with title, scale
+// bar, north arrow, attribution of tile provider and date of creation.
+// Date is taken when image is rendered, so it isn't part of job key and
+// identical requests of different days share image
+type Cartouche struct {
+    Title string
+    // units of scale bar (metric or imperial)
+    Units string
+    // attribution of provider (plain text)
+    Attribution string
+    // resolution of output, size of cartouche is scaled by it
+    Dpi int
+}
+
+// ParseCartouche creates cartouche for map of given provider, options are
+// given as strings
+func ParseCartouche(title, units, dpi string, provider Provider) (*Cartouche, error) {
+    c := &Cartouche{
+        Title: strings.TrimSpace(title),
+        Units: units,
+        Attribution: stripHtml(provider.Attribution),
+    }
+
+    if len(c.Title) > CARTOUCHE_TITLE_MAX {
+        return nil, fmt.Errorf("Title is longer than %d characters", CARTOUCHE_TITLE_MAX)
+    }
+    if c.Units == "" {
+        c.Units = CARTOUCHE_METRIC
+    }
+    if c.Units != CARTOUCHE_METRIC && c.Units != CARTOUCHE_IMPERIAL {
+        return nil, fmt.Errorf("Unknown units: %s", units)
+    }
+
+    var err error
+    if c.Dpi, err = parseDpi(dpi); err != nil {
+        return nil, err
+    }
+    return c, nil
+}
+
+// Hash returns hash of cartouche, it is part of key of job
+func (c *Cartouche) Hash() string {
+    data, _ := json.Marshal(c)
+    hash := sha256.Sum256(data)
+    return hex.EncodeToString(hash[:])
+}
+
+// stripHtml returns plain text of html fragment
+func stripHtml(value string) string {
+    return strings.Join(strings.Fields(html.UnescapeString(htmlTag.ReplaceAllString(value, " "))), " ")
+}
+
+// niceLength returns the biggest 1, 2 or 5 times power of ten not exceeding
+// max
+func niceLength(max float64) float64 {
+    p := math.Pow(10, math.Floor(math.Log10(max)))
+    for _, m := range []float64{5, 2, 1} {
+        if m * p <= max {
+            return m * p
+        }
+    }
+    return p
+}
+
+// scaleBar returns length of scale bar in pixels and its label for given
+// ground resolution (meters per pixel) and max length in pixels
+func scaleBar(mpp, maxPixels float64, units string) (float64, string) {
+    unit, name := 1.0, "m"
+    if units == CARTOUCHE_IMPERIAL {
+        unit, name = METERS_PER_FOOT, "ft"
+        if maxPixels * mpp >= METERS_PER_MILE {
+            unit, name = METERS_PER_MILE, "mi"
+        }
+    } else if maxPixels * mpp >= 1000 {
+        unit, name = 1000, "km"
+    }
+
+    length := niceLength(maxPixels * mpp / unit)
+    return length * unit / mpp, strconv.FormatFloat(length, 'f', -1, 64) + " " + name
+}
+
+// wrapText splits text into lines not wider than width
+func wrapText(text string, width float64, measure func(string) float64) []string {
+    var lines []string
+    line := ""
+    for _, word := range strings.Fields(text) {
+        if len(line) > 0 && measure(line + " " + word) > width {
+            lines = append(lines, line)
+            line = word
+        } else if len(line) > 0 {
+            line += " " + word
+        } else {
+            line = word
+        }
+    }
+    if len(line) > 0 {
+        lines = append(lines, line)
+    }
+    return lines
+}
+
+// rectShape returns rectangle (orientation of shapes returned by
+// strokeShapes)
+func rectShape(x0, y0, x1, y1 float64) Shape {
+    return Shape{{x0, y1}, {x1, y1}, {x1, y0}, {x0, y0}}
+}
+
+// drawCartouche draws cartouche of request into bottom left corner of map
+func drawCartouche(img *image.RGBA, ip *InputParams) error {
+    c := ip.Cartouche
+    if c == nil {
+        return nil
+    }
+
+    scale := float64(c.Dpi) / 72
+    titleFace, err := labelFace(CARTOUCHE_TITLE_POINTS * scale)
+    if err != nil {
+        return err
+    }
+    defer titleFace.Close()
+    textFace, err := labelFace(CARTOUCHE_TEXT_POINTS * scale)
+    if err != nil {
+        return err
+    }
+    defer textFace.Close()
+
+    b := img.Bounds()
+    w, h := float64(b.Dx()), float64(b.Dy())
+    pad := 6 * scale
+    textSize := CARTOUCHE_TEXT_POINTS * scale
+    titleSize := CARTOUCHE_TITLE_POINTS * scale
+    maxWidth := math.Max(w - 4 * pad, 1)
+
+    // ground resolution at latitude of map center
+    center := unprojectPoint(w / 2, h / 2, ip)
+    mpp := MERCATOR_CIRCUMFERENCE * math.Cos(center[1] * math.Pi / 180) / float64(IntPow2(ip.Zoom) * ip.Scale)
+    barWidth, barLabel := scaleBar(mpp, math.Min(CARTOUCHE_SCALE_INCHES * float64(c.Dpi), w / 3), c.Units)
+    barHeight := 4 * scale
+    arrowWidth, arrowHeight := 10 * scale, 16 * scale
+    labelWidth := textWidth(textFace, barLabel)
+
+    titleLines := wrapText(c.Title, maxWidth, func(s string) float64 { return textWidth(titleFace, s) })
+    textLines := wrapText(c.Attribution, maxWidth, func(s string) float64 { return textWidth(textFace, s) })
+    textLines = append(textLines, "Created " + time.Now().Format(CARTOUCHE_DATE_FORMAT))
+
+    // size of box fits the widest row
+    scaleRow := barWidth + labelWidth / 2 + 2 * pad + arrowWidth
+    rowHeight := math.Max(barHeight + textSize * 1.4, arrowHeight + textSize * 1.2)
+    inner := scaleRow
+    for _, l := range titleLines {
+        inner = math.Max(inner, textWidth(titleFace, l))
+    }
+    for _, l := range textLines {
+        inner = math.Max(inner, textWidth(textFace, l))
+    }
+    boxWidth := inner + 2 * pad
+    boxHeight := 2 * pad + float64(len(titleLines)) * titleSize * 1.3 + rowHeight + pad + float64(len(textLines)) * textSize * 1.3
+
+    x0, y1 := float64(b.Min.X) + pad, float64(b.Max.Y) - pad
+    y0 := y1 - boxHeight
+    black := color.RGBA{0, 0, 0, 255}
+    white := color.RGBA{255, 255, 255, 255}
+
+    fillShapes(img, []Shape{rectShape(x0, y0, x0 + boxWidth, y1)}, withOpacity(white, 0.85))
+    fillShapes(img, strokeShapes([][2]float64{{x0, y0}, {x0 + boxWidth, y0}, {x0 + boxWidth, y1}, {x0, y1}, {x0, y0}}, math.Max(1, scale * 0.5)), black)
+
+    x, y := x0 + pad, y0 + pad
+    for _, l := range titleLines {
+        y += titleSize * 1.3
+        drawLabel(img, titleFace, x, y - titleSize * 0.3, l, black, nil)
+    }
+
+    // scale bar of four alternating segments, labelled below
+    by := y + pad / 2
+    fillShapes(img, []Shape{rectShape(x, by, x + barWidth, by + barHeight)}, black)
+    inset := math.Max(1, scale * 0.4)
+    for i := 1; i < 4; i += 2 {
+        sx := x + barWidth * float64(i) / 4
+        fillShapes(img, []Shape{rectShape(sx, by + inset, sx + barWidth / 4 - inset, by + barHeight - inset)}, white)
+    }
+    drawLabel(img, textFace, x, by + barHeight + textSize * 1.2, "0", black, nil)
+    drawLabel(img, textFace, x + barWidth - labelWidth / 2, by + barHeight + textSize * 1.2, barLabel, black, nil)
+
+    // north arrow, north is up in Web Mercator
+    ax := x0 + boxWidth - pad - arrowWidth / 2
+    ay := y + rowHeight
+    fillShapes(img, []Shape{{
+        {ax, ay - arrowHeight},
+        {ax - arrowWidth / 2, ay},
+        {ax, ay - arrowHeight * 0.3},
+        {ax + arrowWidth / 2, ay},
+    }}, black)
+    drawLabel(img, textFace, ax - textWidth(textFace, "N") / 2, ay - arrowHeight - textSize * 0.2, "N", black, nil)
+
+    y += rowHeight + pad
+    for _, l := range textLines {
+        y += textSize * 1.3
+        drawLabel(img, textFace, x, y - textSize * 0.3, l, black, nil)
+    }
+
+    return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+    "image"
+    "image/color"
+    "image/draw"
+    "math"
+    "strings"
+    "testing"
+)
+
+func TestParseCartouche(t *testing.T) {
+    provider := Provider{Attribution: `&copy; <a href="https://osm.org/copyright">OpenStreetMap</a>
+        contributors`}
+
+    c, err := ParseCartouche(" Trail ", "", "", provider)
+    Ok(t, err)
+    Equals(t, &Cartouche{"Trail", CARTOUCHE_METRIC, "© OpenStreetMap contributors", GRID_DPI}, c)
+
+    _, err = ParseCartouche("", "parsecs", "", provider)
+    Equals(t, true, err != nil)
+    _, err = ParseCartouche(strings.Repeat("x", CARTOUCHE_TITLE_MAX + 1), "", "", provider)
+    Equals(t, true, err != nil)
+    _, err = ParseCartouche("", "", "5000", provider)
+    Equals(t, true, err != nil)
+}
+
+func TestScaleBar(t *testing.T) {
+    Equals(t, 5.0, niceLength(7.3))
+    Equals(t, 200.0, niceLength(499))
+    Equals(t, 1.0, niceLength(1))
+
+    // 10 m per pixel, at most 300 pixels
+    length, label := scaleBar(10, 300, CARTOUCHE_METRIC)
+    Equals(t, 200.0, length)
+    Equals(t, "2 km", label)
+    length, label = scaleBar(0.5, 300, CARTOUCHE_METRIC)
+    Equals(t, 200.0, length)
+    Equals(t, "100 m", label)
+    length, label = scaleBar(10, 300, CARTOUCHE_IMPERIAL)
+    Equals(t, 160.9344, math.Round(length * 1e4) / 1e4)
+    Equals(t, "1 mi", label)
+    length, label = scaleBar(1, 300, CARTOUCHE_IMPERIAL)
+    Equals(t, 152.4, math.Round(length * 100) / 100)
+    Equals(t, "500 ft", label)
+}
+
+func TestDrawCartouche(t *testing.T) {
+    ip := InputParams{Zoom: 11, Scale: 256, XMin: 1100, XMax: 1103, YMin: 693, YMax: 695}
+    ip.Cartouche = &Cartouche{"Title", CARTOUCHE_METRIC, "© OpenStreetMap contributors", 72}
+    w, h := ip.ImageSize()
+    img := image.NewRGBA(image.Rect(0, 0, w, h))
+    draw.Draw(img, img.Bounds(), &image.Uniform{color.RGBA{0, 128, 0, 255}}, image.Point{}, draw.Src)
+
+    out, err := decorateImage(img, &ip)
+    Ok(t, err)
+    Equals(t, img.Bounds(), out.Bounds())
+
+    // box is in bottom left corner, map elsewhere is untouched
+    Equals(t, true, out.RGBAAt(20, h - 20).R > 200)
+    Equals(t, color.RGBA{0, 128, 0, 255}, out.RGBAAt(w - 20, h - 20))
+    Equals(t, color.RGBA{0, 128, 0, 255}, out.RGBAAt(20, 20))
+
+    // cartouche is part of job key
+    key := ip.Key()
+    ip.Cartouche.Title = "Other"
+    Equals(t, false, key == ip.Key())
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+    "fmt"
+    "io/ioutil"
+    "github.com/urfave/cli/v2"
+)
+
+func runBatch(c *cli.Context) error {
+
+    logger, err := newLogger(c)
+    if err != nil {
+        return err
+    }
+
+    if c.NArg() != 1 {
+        return fmt.Errorf("Exactly one manifest file is expected")
+    }
+
+    content, err := ioutil.ReadFile(c.Args().First())
+    if err != nil {
+        return err
+    }
+
+    rows, err := parseBatchManifest(content, detectBatchFormat(c.Args().First(), content))
+    if err != nil {
+        return err
+    }
+
+    providersMap, err := readProviders(c.String("providers"))
+    if err != nil {
+        logger.Errorf("Providers config error: %s", err)
+        return err
+    }
+
+    ips, err := BatchInputParams(rows, NewProviders(providersMap))
+    if err != nil {
+        return err
+    }
+
+    // queue is not started, requests are processed by server sharing
+    // the same queue directory (bolt store is locked by running server,
+    // use upload on queue page instead)
+    store, err := OpenJobStore(logger, c.String("queue-store"), c.String("queue-dir"))
+    if err != nil {
+        if c.String("queue-store") == JOB_STORE_BOLT {
+            return fmt.Errorf("%s (embedded database is used by single process only, upload manifest on queue page or use file store)", err)
+        }
+        return err
+    }
+    defer store.Close()
+
+    results, err := newResultStore(c)
+    if err != nil {
+        return err
+    }
+
+    config, err := newQueueConfig(c)
+    if err != nil {
+        return err
+    }
+
+    queue, err := NewQueue(logger, store, results, config)
+    if err != nil {
+        return err
+    }
+
+    validity, err := ParseValidity(c.String("validity"))
+    if err != nil {
+        return err
+    }
+
+    if len(c.String("callback")) > 0 {
+        if err := validateWebhookUrl(c.String("callback")); err != nil {
+            return err
+        }
+    }
+
+    priority, err := ParsePriorityStrict(c.String("priority"))
+    if err != nil {
+        return err
+    }
+
+    options := EnqueueOptions{Submitter: "cli", Priority: priority, MaxPriority: QUEUE_PRIORITY_HIGH, Validity: validity, Callback: c.String("callback")}
+
+    batch, err := queue.EnqueueBatch(rows, ips, options)
+    if err != nil {
+        return err
+    }
+
+    fmt.Printf("Batch %s enqueued (%d requests), status: /batch?id=%s\n", batch.Id, len(batch.Entries), batch.Id)
+
+    return nil
+}
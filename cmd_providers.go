@@ -0,0 +1,39 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "github.com/urfave/cli/v2"
+)
+
+func runProvidersCheck(c *cli.Context) error {
+
+    logger, err := newLogger(c)
+    if err != nil {
+        return err
+    }
+
+    providersMap, err := readProviders(c.String("providers"))
+    if err != nil {
+        logger.Errorf("Providers config error: %s", err)
+        return err
+    }
+
+    checks, err := checkProviders(NewFetchPolicy(logger, newFetchPolicyConfig(c)), NewProviders(providersMap), c.Args().Slice())
+    if err != nil {
+        return err
+    }
+
+    if err = writeProviderChecks(os.Stdout, checks, c.String("format")); err != nil {
+        return err
+    }
+
+    // non zero exit code allows usage of check in scripts
+    for _, check := range checks {
+        if !check.Ok() {
+            return fmt.Errorf("Provider %s failed the check", check.Provider)
+        }
+    }
+
+    return nil
+}
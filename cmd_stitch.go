@@ -0,0 +1,194 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "os/signal"
+    "strconv"
+    "strings"
+    "syscall"
+    "github.com/urfave/cli/v2"
+)
+
+const PROGRESS_BAR_WIDTH = 40
+
+// parseBBox parses "minlon,minlat,maxlon,maxlat"
+func parseBBox(value string) ([4]float64, error) {
+    var bbox [4]float64
+
+    parts := strings.Split(value, ",")
+    if len(parts) != 4 {
+        return bbox, fmt.Errorf("Bounding box must be in format minlon,minlat,maxlon,maxlat")
+    }
+
+    for i, part := range parts {
+        v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+        if err != nil {
+            return bbox, fmt.Errorf("Cannot parse bounding box: %s", err)
+        }
+        bbox[i] = v
+    }
+
+    if bbox[0] > bbox[2] || bbox[1] > bbox[3] {
+        return bbox, fmt.Errorf("Bounding box minimum is greater than maximum")
+    }
+
+    return bbox, nil
+}
+
+// bboxToInputParams computes tile range covering bounding box at given zoom,
+// zoom is clamped to limits of provider before bounding box is projected
+func bboxToInputParams(p Provider, zoom int, bbox [4]float64) (InputParams, error) {
+    if bbox[0] < -180 || bbox[2] > 180 {
+        return InputParams{}, fmt.Errorf("Longitude of bounding box must be between -180 and 180")
+    }
+    if bbox[1] < -MERCATOR_MAX_LAT || bbox[3] > MERCATOR_MAX_LAT {
+        return InputParams{}, fmt.Errorf("Latitude of bounding box must be between %.4f and %.4f", -MERCATOR_MAX_LAT, MERCATOR_MAX_LAT)
+    }
+
+    zoom = IntMax(IntMin(p.MaxZoom, zoom), p.MinZoom)
+    ip := InputParams{
+        Zoom: zoom,
+        XMin: LonToTileX(bbox[0], zoom),
+        YMin: LatToTileY(bbox[3], zoom),
+        XMax: LonToTileX(bbox[2], zoom),
+        YMax: LatToTileY(bbox[1], zoom),
+        Scale: p.Scale,
+        Provider: p,
+    }
+    ip.Normalize()
+    return ip, nil
+}
+
+// terminal progress bar, redrawn in place on each call
+func newProgressBar(w io.Writer) func(done, total int) {
+    return func(done, total int) {
+        filled := PROGRESS_BAR_WIDTH * done / total
+        fmt.Fprintf(w, "\r[%s%s] %3d%% %d/%d tiles",
+            strings.Repeat("=", filled), strings.Repeat(" ", PROGRESS_BAR_WIDTH - filled),
+            100 * done / total, done, total)
+        if done == total {
+            fmt.Fprintln(w)
+        }
+    }
+}
+
+func runStitch(c *cli.Context) error {
+
+    logger, err := newLogger(c)
+    if err != nil {
+        return err
+    }
+
+    providersMap, err := readProviders(c.String("providers"))
+    if err != nil {
+        logger.Errorf("Providers config error: %s", err)
+        return err
+    }
+
+    provider, exists := providersMap[c.String("provider")]
+    if !exists {
+        return fmt.Errorf("Unknown provider: %s", c.String("provider"))
+    }
+
+    bbox, err := parseBBox(c.String("bbox"))
+    if err != nil {
+        return err
+    }
+
+    ip, err := bboxToInputParams(provider, c.Int("zoom"), bbox)
+    if err != nil {
+        return err
+    }
+    if c.IsSet("scale") {
+        ip.Scale = c.Int("scale")
+    }
+    if err = validScale(provider, ip.Scale); err != nil {
+        return err
+    }
+    if strings.HasSuffix(strings.ToLower(c.String("out")), ".jpg") || strings.HasSuffix(strings.ToLower(c.String("out")), ".jpeg") {
+        ip.Format = IMAGE_FORMAT_JPEG
+    }
+
+    if len(c.String("gpx")) > 0 {
+        content, err := ioutil.ReadFile(c.String("gpx"))
+        if err != nil {
+            return fmt.Errorf("Cannot read GPX: %s", err)
+        }
+        if ip.Overlay, err = ParseOverlay(content); err != nil {
+            return err
+        }
+        err = ip.Overlay.SetStyle(c.String("track-color"),
+            strconv.FormatFloat(c.Float64("track-width"), 'f', -1, 64),
+            strconv.FormatFloat(c.Float64("track-opacity"), 'f', -1, 64))
+        if err != nil {
+            return err
+        }
+    }
+
+    ip.Grid, err = ParseGrid(c.String("graticule"), c.String("utm-grid"), c.Bool("grid-labels"), strconv.Itoa(c.Int("dpi")))
+    if err != nil {
+        return err
+    }
+    if ip.Grid != nil {
+        if err = ip.Grid.validate(&ip); err != nil {
+            return err
+        }
+    }
+
+    if c.Bool("cartouche") {
+        ip.Cartouche, err = ParseCartouche(c.String("title"), c.String("units"), strconv.Itoa(c.Int("dpi")), provider)
+        if err != nil {
+            return err
+        }
+    }
+
+    if err = ip.validate(); err != nil {
+        return err
+    }
+
+    fmt.Fprintf(os.Stderr, "Stitching %dx%d tiles of %s at zoom %d (x %d-%d, y %d-%d)\n",
+        ip.XMax - ip.XMin + 1, ip.YMax - ip.YMin + 1, provider.Name, ip.Zoom, ip.XMin, ip.XMax, ip.YMin, ip.YMax)
+
+    stitcher := NewStitcher(logger, NewFetchPolicy(logger, newFetchPolicyConfig(c)))
+    if !c.Bool("quiet") {
+        stitcher.progress = newProgressBar(os.Stderr)
+    }
+
+    // interrupted stitching doesn't leave partial image behind
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+    go func() {
+        <-signals
+        cancel()
+    }()
+
+    final, failures, err := stitcher.Stitch(ctx, &ip, nil)
+    if err != nil {
+        return fmt.Errorf("Stitching interrupted: %s", err)
+    }
+    for _, f := range failures {
+        fmt.Fprintf(os.Stderr, "Tile %d:%d failed: %s\n", f.X, f.Y, f.Reason)
+    }
+
+    if final, err = decorateImage(final, &ip); err != nil {
+        return err
+    }
+
+    if err = writeImage(c.String("out"), final, ip.Format); err != nil {
+        return err
+    }
+
+    fmt.Fprintf(os.Stderr, "Image %dx%d written to %s\n", final.Bounds().Dx(), final.Bounds().Dy(), c.String("out"))
+
+    if len(failures) > 0 {
+        return fmt.Errorf("%d of %d tiles failed", len(failures), ip.TilesCount())
+    }
+
+    return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "os"
+    "strings"
+    "github.com/urfave/cli/v2"
+    "golang.org/x/crypto/bcrypt"
+)
+
+// runHashPassword prints bcrypt hash of password read from stdin, so
+// password doesn't appear in shell history
+func runHashPassword(c *cli.Context) error {
+    password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+    if err != nil && len(password) == 0 {
+        return fmt.Errorf("Cannot read password: %s", err)
+    }
+    password = strings.TrimRight(password, "\r\n")
+    if len(password) == 0 {
+        return fmt.Errorf("Password is empty")
+    }
+
+    hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+    if err != nil {
+        return err
+    }
+    fmt.Println(string(hash))
+    return nil
+}
+
+// runNewToken prints new api token and its hash for users file
+func runNewToken(c *cli.Context) error {
+    token, err := NewToken()
+    if err != nil {
+        return err
+    }
+    fmt.Printf("token: %s\n", token)
+    fmt.Printf("hash:  %s\n", HashToken(token))
+    return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "os"
+    "os/signal"
+    "syscall"
+    "github.com/urfave/cli/v2"
+)
+
+func runWorker(c *cli.Context) error {
+
+    logger, err := newLogger(c)
+    if err != nil {
+        return err
+    }
+
+    name := c.String("name")
+    if len(name) == 0 {
+        host, _ := os.Hostname()
+        name = fmt.Sprintf("%s-%d", host, os.Getpid())
+    }
+
+    // queue directory is used for tiles and images of requests being processed
+    worker, err := NewRemoteWorker(logger, c.String("server"), c.String("worker-token"), name, c.String("queue-dir"), NewFetchPolicy(logger, newFetchPolicyConfig(c)), c.Duration("queue-monitor-interval"), c.Duration("heartbeat-interval"))
+    if err != nil {
+        return err
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    worker.Start(ctx, c.Int("queue-workers"))
+
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+    sig := <-signals
+    logger.Infof("Signal %s received, shutting down", sig)
+
+    // let running requests finish, release them after grace period
+    cancel()
+    worker.Shutdown(c.Duration("shutdown-grace-period"))
+
+    logger.Infof("Worker stopped")
+
+    return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+)
+
+// estimated size of one tile kept in scratch directory during processing
+const TILE_ESTIMATED_SIZE = 64 << 10
+
+// estimateRequestSize returns upper estimate of disk space needed for
+// processing of request - uncompressed image (png of noisy map can be
+// almost that big) plus fetched tiles kept until image is written
+func estimateRequestSize(ip *InputParams) int64 {
+    width, height := ip.OutputSize()
+    pixels := int64(width) * int64(height)
+    bytesPerPixel := int64(4)
+    if ip.Format == IMAGE_FORMAT_JPEG {
+        bytesPerPixel = 1
+    }
+    return pixels * bytesPerPixel + int64(ip.TilesCount()) * TILE_ESTIMATED_SIZE
+}
+
+// dirSize returns total size of files in directory (including subdirectories)
+func dirSize(dir string) (int64, error) {
+    var size int64
+    err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+        if err != nil {
+            // file removed while walking
+            if os.IsNotExist(err) {
+                return nil
+            }
+            return err
+        }
+        if !info.IsDir() {
+            size += info.Size()
+        }
+        return nil
+    })
+    return size, err
+}
+
+// fits checks if given amount of bytes fits into queue size limit and
+// free disk space, space reserved by requests being processed is counted
+func (q *Queue) fits(size int64) (bool, error) {
+    var reserved int64
+    for _, r := range q.reserved {
+        reserved += r
+    }
+
+    if q.config.MaxSize > 0 {
+        used, err := dirSize(q.dir)
+        if err != nil {
+            return false, err
+        }
+        if used + reserved + size > q.config.MaxSize {
+            return false, nil
+        }
+    }
+
+    free, err := freeSpace(q.dir)
+    if err != nil {
+        return false, err
+    }
+    // negative value means free space is unknown
+    if free >= 0 && free - reserved - size < q.config.MinFreeSpace {
+        return false, nil
+    }
+
+    return true, nil
+}
+
+// makeSpace evicts finished requests (oldest first, pinned are kept) until
+// given amount of bytes fits, must be called with space mutex locked
+func (q *Queue) makeSpace(size int64) error {
+
+    candidates, err := q.store.List()
+    if err != nil {
+        return err
+    }
+
+    for {
+        ok, err := q.fits(size)
+        if err != nil {
+            return fmt.Errorf("Cannot check free space: %s", err)
+        }
+        if ok {
+            return nil
+        }
+
+        // removing of results stored elsewhere doesn't free local disk
+        if _, local := q.results.(*LocalResultStore); !local {
+            return fmt.Errorf("Not enough disk space")
+        }
+
+        // next oldest request which can be evicted
+        var victim *QueueRequest
+        for len(candidates) > 0 && victim == nil {
+            r := candidates[0]
+            candidates = candidates[1:]
+            if r.State != QUEUE_REQUEST_STATE_NEW && !r.Pinned {
+                victim = r
+            }
+        }
+        if victim == nil {
+            return fmt.Errorf("Not enough disk space")
+        }
+
+        q.evict(victim.Id)
+    }
+}
+
+// evict removes finished request to free disk space, request is checked
+// again since it could be pinned in the meantime
+func (q *Queue) evict(id string) {
+    q.mutex.Lock()
+    defer q.mutex.Unlock()
+
+    request, err := q.store.Get(id)
+    if err != nil || request == nil || request.State == QUEUE_REQUEST_STATE_NEW || request.Pinned {
+        return
+    }
+
+    q.log.Infof("Evicting request %s to free disk space", id)
+    q.removeRequest(request)
+}
+
+// reserveSpace makes sure there is space for output of request before
+// it is processed, space stays reserved until request is released
+func (q *Queue) reserveSpace(request *QueueRequest) error {
+    q.spaceMutex.Lock()
+    defer q.spaceMutex.Unlock()
+
+    size := estimateRequestSize(&request.Params)
+
+    if q.config.MaxSize > 0 && size > q.config.MaxSize {
+        return fmt.Errorf("Request %s is too big, estimated size %d MB exceeds queue size limit %d MB", request.Id, size >> 20, q.config.MaxSize >> 20)
+    }
+
+    if err := q.makeSpace(size); err != nil {
+        return fmt.Errorf("Request %s doesn't fit, estimated size %d MB: %s", request.Id, size >> 20, err)
+    }
+
+    q.reserved[request.Id] = size
+
+    return nil
+}
+
+func (q *Queue) releaseSpace(request *QueueRequest) {
+    q.spaceMutex.Lock()
+    defer q.spaceMutex.Unlock()
+    delete(q.reserved, request.Id)
+}
+
+// enforceSizeLimit evicts old requests if queue exceeds size limit
+// (e.g. after limit was lowered) or disk is running out of space
+func (q *Queue) enforceSizeLimit() {
+    q.spaceMutex.Lock()
+    defer q.spaceMutex.Unlock()
+
+    if err := q.makeSpace(0); err != nil {
+        q.log.Warningf("Queue size limit exceeded: %s", err)
+    }
+}
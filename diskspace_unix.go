@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+    "syscall"
+)
+
+// freeSpace returns space available to unprivileged user on filesystem
+// containing given directory
+func freeSpace(dir string) (int64, error) {
+    var stat syscall.Statfs_t
+    if err := syscall.Statfs(dir, &stat); err != nil {
+        return 0, err
+    }
+    return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
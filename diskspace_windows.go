@@ -0,0 +1,9 @@
+//go:build windows
+// +build windows
+
+package main
+
+// freeSpace is not supported on windows, free space is not checked
+func freeSpace(dir string) (int64, error) {
+    return -1, nil
+}
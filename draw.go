@@ -0,0 +1,172 @@
+package main
+
+import (
+    "fmt"
+    "image"
+    "image/color"
+    "math"
+    "strconv"
+    "strings"
+    "sync"
+    "golang.org/x/image/font"
+    "golang.org/x/image/font/gofont/goregular"
+    "golang.org/x/image/font/opentype"
+    "golang.org/x/image/math/fixed"
+    "golang.org/x/image/vector"
+)
+
+// height of band of image rasterized at once, rasterizer needs buffer of
+// band size only, not of whole (possibly huge) image
+const DRAW_BAND_HEIGHT = 256
+
+// Shape is closed polygon in pixels of image, shapes of one drawing are
+// filled together, so overlapping shapes are not blended twice
+type Shape [][2]float64
+
+// fillShapes fills union of shapes by color, edges are anti-aliased. All
+// shapes must have the same orientation
+func fillShapes(img *image.RGBA, shapes []Shape, c color.Color) {
+    if len(shapes) == 0 {
+        return
+    }
+
+    // only rows touched by shapes are rasterized
+    minY, maxY := math.Inf(1), math.Inf(-1)
+    for _, s := range shapes {
+        for _, p := range s {
+            minY, maxY = math.Min(minY, p[1]), math.Max(maxY, p[1])
+        }
+    }
+
+    b := img.Bounds()
+    src := image.NewUniform(c)
+    top := IntMax(b.Min.Y, int(math.Floor(minY)))
+    bottom := IntMin(b.Max.Y, int(math.Ceil(maxY)))
+
+    for y := top; y < bottom; y += DRAW_BAND_HEIGHT {
+        band := image.Rect(b.Min.X, y, b.Max.X, IntMin(y + DRAW_BAND_HEIGHT, bottom))
+        r := vector.NewRasterizer(band.Dx(), band.Dy())
+        for _, s := range shapes {
+            r.MoveTo(float32(s[0][0] - float64(band.Min.X)), float32(s[0][1] - float64(band.Min.Y)))
+            for _, p := range s[1:] {
+                r.LineTo(float32(p[0] - float64(band.Min.X)), float32(p[1] - float64(band.Min.Y)))
+            }
+            r.ClosePath()
+        }
+        r.Draw(img, band, src, image.Point{})
+    }
+}
+
+// circleShape returns circle approximated by polygon (orientation of
+// shapes returned by strokeShapes)
+func circleShape(x, y, radius float64) Shape {
+    n := IntMax(12, int(radius * 2))
+    shape := make(Shape, n)
+    for i := 0; i < n; i++ {
+        a := -2 * math.Pi * float64(i) / float64(n)
+        shape[i] = [2]float64{x + radius * math.Cos(a), y + radius * math.Sin(a)}
+    }
+    return shape
+}
+
+// strokeShapes returns shapes of polyline of given width with round joins
+// and caps
+func strokeShapes(points [][2]float64, width float64) []Shape {
+    var shapes []Shape
+    hw := width / 2
+    for i := 0; i + 1 < len(points); i++ {
+        a, b := points[i], points[i + 1]
+        dx, dy := b[0] - a[0], b[1] - a[1]
+        l := math.Hypot(dx, dy)
+        if l == 0 {
+            continue
+        }
+        nx, ny := -dy / l * hw, dx / l * hw
+        shapes = append(shapes, Shape{
+            {a[0] + nx, a[1] + ny},
+            {b[0] + nx, b[1] + ny},
+            {b[0] - nx, b[1] - ny},
+            {a[0] - nx, a[1] - ny},
+        })
+    }
+    for _, p := range points {
+        shapes = append(shapes, circleShape(p[0], p[1], hw))
+    }
+    return shapes
+}
+
+// parseColor parses color in format #rrggbb or #rgb
+func parseColor(value string) (color.RGBA, error) {
+    hex := strings.TrimPrefix(value, "#")
+    if len(hex) == 3 {
+        hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+    }
+    if len(hex) != 6 {
+        return color.RGBA{}, fmt.Errorf("Invalid color %s (#rrggbb is expected)", value)
+    }
+    v, err := strconv.ParseUint(hex, 16, 32)
+    if err != nil {
+        return color.RGBA{}, fmt.Errorf("Invalid color %s (#rrggbb is expected)", value)
+    }
+    return color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 255}, nil
+}
+
+// withOpacity returns color with given opacity (0 - 1)
+func withOpacity(c color.RGBA, opacity float64) color.NRGBA {
+    return color.NRGBA{c.R, c.G, c.B, uint8(math.Round(math.Max(0, math.Min(1, opacity)) * 255))}
+}
+
+var labelFont struct {
+    once sync.Once
+    font *opentype.Font
+    err error
+}
+
+// labelFace returns face of built in font of given size in pixels
+func labelFace(size float64) (font.Face, error) {
+    labelFont.once.Do(func() {
+        labelFont.font, labelFont.err = opentype.Parse(goregular.TTF)
+    })
+    if labelFont.err != nil {
+        return nil, labelFont.err
+    }
+    return opentype.NewFace(labelFont.font, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingNone})
+}
+
+// textWidth returns width of text in pixels
+func textWidth(face font.Face, text string) float64 {
+    return float64(font.MeasureString(face, text)) / 64
+}
+
+// drawLabel draws text with baseline starting at x, y, text is outlined by
+// halo so it is readable on any map
+func drawLabel(img *image.RGBA, face font.Face, x, y float64, text string, c, halo color.Color) {
+    d := font.Drawer{Dst: img, Face: face}
+    dot := fixed.Point26_6{X: fixed.Int26_6(x * 64), Y: fixed.Int26_6(y * 64)}
+
+    if halo != nil {
+        d.Src = image.NewUniform(halo)
+        for _, o := range [][2]int{{-1, -1}, {0, -1}, {1, -1}, {-1, 0}, {1, 0}, {-1, 1}, {0, 1}, {1, 1}} {
+            d.Dot = dot.Add(fixed.P(o[0], o[1]))
+            d.DrawString(text)
+        }
+    }
+
+    d.Src = image.NewUniform(c)
+    d.Dot = dot
+    d.DrawString(text)
+}
+
+// decorateImage draws grids and cartouche of request onto stitched map,
+// grid labels may add margins around it
+func decorateImage(img *image.RGBA, ip *InputParams) (*image.RGBA, error) {
+    labels := drawGrid(img, ip)
+    if err := drawCartouche(img, ip); err != nil {
+        return nil, fmt.Errorf("Cannot draw cartouche: %s", err)
+    }
+    final, err := frameGrid(img, labels)
+    if err != nil {
+        return nil, fmt.Errorf("Cannot draw grid: %s", err)
+    }
+    return final, nil
+}
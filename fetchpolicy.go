@@ -0,0 +1,281 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "net/url"
+    "strings"
+    "sync"
+    "time"
+    "github.com/op/go-logging"
+)
+
+// default maximal size of fetched response (tile)
+const FETCH_MAX_SIZE = 10 << 20
+
+const FETCH_DIAL_TIMEOUT = time.Second * 10
+
+// kinds of policy violations (keys of counters)
+const FETCH_VIOLATION_SCHEME = "scheme"
+const FETCH_VIOLATION_HOST = "host"
+const FETCH_VIOLATION_ADDRESS = "address"
+const FETCH_VIOLATION_REDIRECTS = "redirects"
+const FETCH_VIOLATION_SIZE = "size"
+const FETCH_VIOLATION_CONTENT_TYPE = "content-type"
+
+// address ranges which are not reachable unless private addresses are
+// allowed (loopback, private networks, link-local, shared address space,
+// multicast, ...)
+var fetchBlockedNetworks = parseNetworks(
+    "0.0.0.0/8",
+    "10.0.0.0/8",
+    "100.64.0.0/10",
+    "127.0.0.0/8",
+    "169.254.0.0/16",
+    "172.16.0.0/12",
+    "192.0.0.0/24",
+    "192.168.0.0/16",
+    "198.18.0.0/15",
+    "224.0.0.0/4",
+    "240.0.0.0/4",
+    "::/128",
+    "::1/128",
+    "64:ff9b::/96",
+    "fc00::/7",
+    "fe80::/10",
+    "ff00::/8",
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+    var networks []*net.IPNet
+    for _, cidr := range cidrs {
+        _, network, err := net.ParseCIDR(cidr)
+        if err != nil {
+            panic(err)
+        }
+        networks = append(networks, network)
+    }
+    return networks
+}
+
+// blockedAddress checks if ip belongs to private or special network
+func blockedAddress(ip net.IP) bool {
+    if ip4 := ip.To4(); ip4 != nil {
+        ip = ip4
+    }
+    for _, network := range fetchBlockedNetworks {
+        if network.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+// FetchPolicyConfig holds outbound fetch settings given by command line options
+type FetchPolicyConfig struct {
+    // allowed hosts of tiles, "*.example.com" matches all subdomains (empty
+    // means any host)
+    Hosts []string
+    // allowed url schemes (empty means http and https)
+    Schemes []string
+    // allows fetching from private, loopback and link-local addresses
+    AllowPrivate bool
+    // maximal size of response in bytes (zero means default)
+    MaxSize int64
+    // maximal number of followed redirects
+    MaxRedirects int
+}
+
+// FetchPolicy guards requests to urls which are not under our control
+// (tiles, callbacks). Scheme and host are checked for every request
+// including redirects, addresses are checked after DNS resolution (when
+// connection is opened), so host name can't be rebound to internal address.
+// Violations are logged and counted
+type FetchPolicy struct {
+    log *logging.Logger
+    config FetchPolicyConfig
+
+    mutex sync.Mutex
+    violations map[string]int64
+}
+
+// constructor
+func NewFetchPolicy(log *logging.Logger, config FetchPolicyConfig) *FetchPolicy {
+    if len(config.Schemes) == 0 {
+        config.Schemes = []string{"http", "https"}
+    }
+    if config.MaxSize <= 0 {
+        config.MaxSize = FETCH_MAX_SIZE
+    }
+    return &FetchPolicy{log: log, config: config, violations: make(map[string]int64)}
+}
+
+// violation records and returns policy violation
+func (p *FetchPolicy) violation(kind string, format string, args ...interface{}) error {
+    err := fmt.Errorf("Fetch policy violation (%s): %s", kind, fmt.Sprintf(format, args...))
+    p.log.Warningf("%s", err)
+
+    p.mutex.Lock()
+    p.violations[kind]++
+    p.mutex.Unlock()
+
+    return err
+}
+
+// Violations returns number of violations of each kind
+func (p *FetchPolicy) Violations() map[string]int64 {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    violations := make(map[string]int64)
+    for kind, count := range p.violations {
+        violations[kind] = count
+    }
+    return violations
+}
+
+func (p *FetchPolicy) hostAllowed(host string) bool {
+    if len(p.config.Hosts) == 0 {
+        return true
+    }
+    host = strings.ToLower(host)
+    for _, allowed := range p.config.Hosts {
+        allowed = strings.ToLower(allowed)
+        if host == allowed || (strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:])) {
+            return true
+        }
+    }
+    return false
+}
+
+// checkUrl checks scheme and (unless checkHosts is false) host of url
+func (p *FetchPolicy) checkUrl(u *url.URL, checkHosts bool) error {
+    if !containsString(p.config.Schemes, strings.ToLower(u.Scheme)) {
+        return p.violation(FETCH_VIOLATION_SCHEME, "scheme of %s is not allowed", u.Redacted())
+    }
+    if checkHosts && !p.hostAllowed(u.Hostname()) {
+        return p.violation(FETCH_VIOLATION_HOST, "host %s is not allowed", u.Hostname())
+    }
+    return nil
+}
+
+// dial opens connection to resolved address which passed the policy
+func (p *FetchPolicy) dial(ctx context.Context, network, address string) (net.Conn, error) {
+    host, port, err := net.SplitHostPort(address)
+    if err != nil {
+        return nil, err
+    }
+
+    addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+    if err != nil {
+        return nil, err
+    }
+    if len(addrs) == 0 {
+        return nil, fmt.Errorf("No address of host %s", host)
+    }
+
+    // all addresses are checked, host must not resolve to internal
+    // address at all
+    if !p.config.AllowPrivate {
+        for _, addr := range addrs {
+            if blockedAddress(addr.IP) {
+                return nil, p.violation(FETCH_VIOLATION_ADDRESS, "host %s resolves to private address %s", host, addr.IP)
+            }
+        }
+    }
+
+    dialer := &net.Dialer{Timeout: FETCH_DIAL_TIMEOUT}
+    var conn net.Conn
+    for _, addr := range addrs {
+        conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(addr.IP.String(), port))
+        if err == nil {
+            return conn, nil
+        }
+    }
+    return nil, err
+}
+
+// policyTransport checks url of every request (including redirects)
+type policyTransport struct {
+    policy *FetchPolicy
+    checkHosts bool
+    base http.RoundTripper
+}
+
+func (t *policyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    if err := t.policy.checkUrl(req.URL, t.checkHosts); err != nil {
+        return nil, err
+    }
+    return t.base.RoundTrip(req)
+}
+
+func (p *FetchPolicy) client(checkHosts bool) *http.Client {
+    return &http.Client{
+        Transport: &policyTransport{p, checkHosts, &http.Transport{
+            // proxy from environment would bypass address checks
+            Proxy: nil,
+            DialContext: p.dial,
+            TLSHandshakeTimeout: FETCH_DIAL_TIMEOUT,
+            MaxIdleConnsPerHost: 4,
+            IdleConnTimeout: time.Minute,
+        }},
+        CheckRedirect: func(req *http.Request, via []*http.Request) error {
+            if len(via) > p.config.MaxRedirects {
+                return p.violation(FETCH_VIOLATION_REDIRECTS, "too many redirects of %s", via[0].URL.Redacted())
+            }
+            return nil
+        },
+    }
+}
+
+// Client returns http client for fetching of tiles
+func (p *FetchPolicy) Client() *http.Client {
+    return p.client(true)
+}
+
+// CallbackClient returns http client for callbacks given by users, hosts
+// of callbacks are arbitrary, but other rules apply
+func (p *FetchPolicy) CallbackClient() *http.Client {
+    return p.client(false)
+}
+
+// ReadBody reads response up to maximal allowed size
+func (p *FetchPolicy) ReadBody(res *http.Response) ([]byte, error) {
+    if res.ContentLength > p.config.MaxSize {
+        return nil, p.violation(FETCH_VIOLATION_SIZE, "response of %s has %d bytes", res.Request.URL.Redacted(), res.ContentLength)
+    }
+    data, err := ioutil.ReadAll(io.LimitReader(res.Body, p.config.MaxSize + 1))
+    if err != nil {
+        return nil, err
+    }
+    if int64(len(data)) > p.config.MaxSize {
+        return nil, p.violation(FETCH_VIOLATION_SIZE, "response of %s exceeds %d bytes", res.Request.URL.Redacted(), p.config.MaxSize)
+    }
+    return data, nil
+}
+
+// ReadImage reads response which must be image, content type is checked
+// before the body is read (missing content type is detected from data)
+func (p *FetchPolicy) ReadImage(res *http.Response) ([]byte, error) {
+    contentType := res.Header.Get("Content-Type")
+    if len(contentType) > 0 && !strings.HasPrefix(strings.ToLower(contentType), "image/") {
+        return nil, p.violation(FETCH_VIOLATION_CONTENT_TYPE, "%s is %s, not image", res.Request.URL.Redacted(), contentType)
+    }
+
+    data, err := p.ReadBody(res)
+    if err != nil {
+        return nil, err
+    }
+
+    if len(contentType) == 0 {
+        if detected := http.DetectContentType(data); !strings.HasPrefix(detected, "image/") {
+            return nil, p.violation(FETCH_VIOLATION_CONTENT_TYPE, "%s is %s, not image", res.Request.URL.Redacted(), detected)
+        }
+    }
+
+    return data, nil
+}
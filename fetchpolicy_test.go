@@ -0,0 +1,94 @@
+package main
+
+import (
+    "image"
+    "image/png"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strings"
+    "testing"
+    "github.com/op/go-logging"
+)
+
+// newTestFetchPolicy returns policy allowing test servers on loopback
+func newTestFetchPolicy() *FetchPolicy {
+    return NewFetchPolicy(logging.MustGetLogger("test"), FetchPolicyConfig{AllowPrivate: true, MaxRedirects: 3})
+}
+
+func TestBlockedAddress(t *testing.T) {
+    for _, ip := range []string{"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254", "100.64.0.1", "0.0.0.0", "::1", "fe80::1", "fd00::1", "::ffff:127.0.0.1"} {
+        Equals(t, true, blockedAddress(net.ParseIP(ip)))
+    }
+    for _, ip := range []string{"8.8.8.8", "195.113.1.1", "2001:4860:4860::8888"} {
+        Equals(t, false, blockedAddress(net.ParseIP(ip)))
+    }
+}
+
+func TestFetchPolicy(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch r.URL.Path {
+        case "/redirect":
+            http.Redirect(w, r, "/redirect", http.StatusFound)
+        case "/html":
+            w.Header().Set("Content-Type", "text/html")
+            w.Write([]byte("<html></html>"))
+        default:
+            png.Encode(w, image.NewRGBA(image.Rect(0, 0, 256, 256)))
+        }
+    }))
+    defer ts.Close()
+
+    log := logging.MustGetLogger("test")
+    u, err := url.Parse(ts.URL)
+    Ok(t, err)
+
+    // loopback is blocked after resolution of host name
+    policy := NewFetchPolicy(log, FetchPolicyConfig{})
+    _, err = policy.Client().Get("http://localhost:" + u.Port() + "/tile.png")
+    Equals(t, true, err != nil)
+    Equals(t, int64(1), policy.Violations()[FETCH_VIOLATION_ADDRESS])
+
+    // hosts and schemes
+    policy = NewFetchPolicy(log, FetchPolicyConfig{AllowPrivate: true, Hosts: []string{"*.example.com", "127.0.0.1"}})
+    Equals(t, true, policy.hostAllowed("a.tile.example.com"))
+    Equals(t, false, policy.hostAllowed("example.com.evil.org"))
+    _, err = policy.Client().Get("http://localhost:" + u.Port() + "/tile.png")
+    Equals(t, true, err != nil)
+    Equals(t, int64(1), policy.Violations()[FETCH_VIOLATION_HOST])
+    _, err = policy.Client().Get("ftp://127.0.0.1/tile.png")
+    Equals(t, true, err != nil)
+    Equals(t, int64(1), policy.Violations()[FETCH_VIOLATION_SCHEME])
+
+    // callbacks are not restricted by hosts
+    res, err := policy.CallbackClient().Get("http://localhost:" + u.Port() + "/tile.png")
+    Ok(t, err)
+    res.Body.Close()
+
+    res, err = policy.Client().Get(ts.URL + "/tile.png")
+    Ok(t, err)
+    data, err := policy.ReadImage(res)
+    res.Body.Close()
+    Ok(t, err)
+    Equals(t, true, len(data) > 0)
+
+    // redirects, content type and size
+    _, err = policy.Client().Get(ts.URL + "/redirect")
+    Equals(t, true, err != nil)
+    Equals(t, int64(1), policy.Violations()[FETCH_VIOLATION_REDIRECTS])
+
+    res, err = policy.Client().Get(ts.URL + "/html")
+    Ok(t, err)
+    _, err = policy.ReadImage(res)
+    res.Body.Close()
+    Equals(t, true, err != nil && strings.Contains(err.Error(), "not image"))
+
+    policy = NewFetchPolicy(log, FetchPolicyConfig{AllowPrivate: true, MaxSize: 10})
+    res, err = policy.Client().Get(ts.URL + "/tile.png")
+    Ok(t, err)
+    _, err = policy.ReadImage(res)
+    res.Body.Close()
+    Equals(t, true, err != nil)
+    Equals(t, int64(1), policy.Violations()[FETCH_VIOLATION_SIZE])
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "encoding/xml"
+    "fmt"
+    "image"
+    "image/color"
+    "io"
+    "math"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// maximal number of points of uploaded geometry
+const GEOMETRY_MAX_POINTS = 100000
+
+// latitude limit of Web Mercator projection (tiles are square)
+const MERCATOR_MAX_LAT = 85.0511287798
+
+// mask of image area outside of polygon
+const MASK_NONE = ""
+const MASK_TRANSPARENT = "transparent"
+const MASK_FADE = "fade"
+
+// opacity of white layer covering faded area
+const MASK_FADE_OPACITY = 0.6
+
+// LonLat is point of geometry (longitude and latitude in degrees)
+type LonLat [2]float64
+
+// Geometry is area of interest given by user (drawn polygon or uploaded
+// GeoJSON, GPX or KML file)
+type Geometry struct {
+    // polygon rings (outer and inner), inside of area is given by
+    // even-odd rule
+    Rings [][]LonLat
+    // line strings, tracks and routes
+    Lines [][]LonLat
+    // single points (waypoints)
+    Points []LonLat
+}
+
+// Count returns number of all points of geometry
+func (g *Geometry) Count() int {
+    count := len(g.Points)
+    for _, ring := range g.Rings {
+        count += len(ring)
+    }
+    for _, line := range g.Lines {
+        count += len(line)
+    }
+    return count
+}
+
+// Bounds returns bounding box of geometry (minlon, minlat, maxlon, maxlat)
+func (g *Geometry) Bounds() [4]float64 {
+    bbox := [4]float64{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+    add := func(points []LonLat) {
+        for _, p := range points {
+            bbox[0], bbox[1] = math.Min(bbox[0], p[0]), math.Min(bbox[1], p[1])
+            bbox[2], bbox[3] = math.Max(bbox[2], p[0]), math.Max(bbox[3], p[1])
+        }
+    }
+    for _, ring := range g.Rings {
+        add(ring)
+    }
+    for _, line := range g.Lines {
+        add(line)
+    }
+    add(g.Points)
+    return bbox
+}
+
+// Hash returns hash of geometry, it is part of key of job
+func (g *Geometry) Hash() string {
+    data, _ := json.Marshal(g)
+    hash := sha256.Sum256(data)
+    return hex.EncodeToString(hash[:])
+}
+
+// validate checks that geometry is not empty and its points are valid
+// coordinates, latitudes are clamped to limits of Web Mercator
+func (g *Geometry) validate() error {
+    count := g.Count()
+    if count == 0 {
+        return fmt.Errorf("Geometry has no points")
+    }
+    if count > GEOMETRY_MAX_POINTS {
+        return fmt.Errorf("Geometry has %d points, maximum is %d", count, GEOMETRY_MAX_POINTS)
+    }
+    for _, ring := range g.Rings {
+        if len(ring) < 3 {
+            return fmt.Errorf("Polygon must have at least 3 points")
+        }
+    }
+
+    check := func(points []LonLat) error {
+        for i, p := range points {
+            if math.IsNaN(p[0]) || math.IsNaN(p[1]) || p[0] < -180 || p[0] > 180 || p[1] < -90 || p[1] > 90 {
+                return fmt.Errorf("Invalid coordinates %g,%g", p[0], p[1])
+            }
+            points[i][1] = math.Max(-MERCATOR_MAX_LAT, math.Min(MERCATOR_MAX_LAT, p[1]))
+        }
+        return nil
+    }
+    for _, ring := range g.Rings {
+        if err := check(ring); err != nil {
+            return err
+        }
+    }
+    for _, line := range g.Lines {
+        if err := check(line); err != nil {
+            return err
+        }
+    }
+    return check(g.Points)
+}
+
+// ParseGeometry parses GeoJSON, GPX or KML document, format is detected
+// from content
+func ParseGeometry(data []byte) (*Geometry, error) {
+    var g *Geometry
+    var err error
+
+    trimmed := bytes.TrimSpace(data)
+    if len(trimmed) > 0 && trimmed[0] == '{' {
+        g, err = parseGeoJson(trimmed)
+    } else {
+        g, _, err = parseXmlGeometry(trimmed)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    if err = g.validate(); err != nil {
+        return nil, err
+    }
+    return g, nil
+}
+
+//////////////////////////////////// GEOJSON
+
+type geoJsonObject struct {
+    Type string
+    Coordinates json.RawMessage
+    Geometry *geoJsonObject
+    Geometries []geoJsonObject
+    Features []geoJsonObject
+}
+
+func parseGeoJson(data []byte) (*Geometry, error) {
+    var o geoJsonObject
+    if err := json.Unmarshal(data, &o); err != nil {
+        return nil, fmt.Errorf("Cannot parse GeoJSON: %s", err)
+    }
+    g := &Geometry{}
+    if err := g.addGeoJson(&o); err != nil {
+        return nil, fmt.Errorf("Cannot parse GeoJSON: %s", err)
+    }
+    return g, nil
+}
+
+func (g *Geometry) addGeoJson(o *geoJsonObject) error {
+    var err error
+
+    switch o.Type {
+    case "FeatureCollection":
+        for i := range o.Features {
+            if err = g.addGeoJson(&o.Features[i]); err != nil {
+                return err
+            }
+        }
+    case "Feature":
+        if o.Geometry != nil {
+            err = g.addGeoJson(o.Geometry)
+        }
+    case "GeometryCollection":
+        for i := range o.Geometries {
+            if err = g.addGeoJson(&o.Geometries[i]); err != nil {
+                return err
+            }
+        }
+    case "Point":
+        var p LonLat
+        if err = unmarshalPosition(o.Coordinates, &p); err == nil {
+            g.Points = append(g.Points, p)
+        }
+    case "MultiPoint":
+        var points []LonLat
+        if err = unmarshalPositions(o.Coordinates, &points); err == nil {
+            g.Points = append(g.Points, points...)
+        }
+    case "LineString":
+        var line []LonLat
+        if err = unmarshalPositions(o.Coordinates, &line); err == nil {
+            g.Lines = append(g.Lines, line)
+        }
+    case "MultiLineString":
+        var lines []json.RawMessage
+        if err = json.Unmarshal(o.Coordinates, &lines); err == nil {
+            for _, raw := range lines {
+                var line []LonLat
+                if err = unmarshalPositions(raw, &line); err != nil {
+                    return err
+                }
+                g.Lines = append(g.Lines, line)
+            }
+        }
+    case "Polygon":
+        err = g.addGeoJsonPolygon(o.Coordinates)
+    case "MultiPolygon":
+        var polygons []json.RawMessage
+        if err = json.Unmarshal(o.Coordinates, &polygons); err == nil {
+            for _, raw := range polygons {
+                if err = g.addGeoJsonPolygon(raw); err != nil {
+                    return err
+                }
+            }
+        }
+    default:
+        err = fmt.Errorf("unsupported type %q", o.Type)
+    }
+
+    return err
+}
+
+func (g *Geometry) addGeoJsonPolygon(data json.RawMessage) error {
+    var rings []json.RawMessage
+    if err := json.Unmarshal(data, &rings); err != nil {
+        return err
+    }
+    for _, raw := range rings {
+        var ring []LonLat
+        if err := unmarshalPositions(raw, &ring); err != nil {
+            return err
+        }
+        g.Rings = append(g.Rings, ring)
+    }
+    return nil
+}
+
+// unmarshalPosition parses position [lon, lat] or [lon, lat, alt]
+func unmarshalPosition(data json.RawMessage, p *LonLat) error {
+    var values []float64
+    if err := json.Unmarshal(data, &values); err != nil {
+        return err
+    }
+    if len(values) < 2 {
+        return fmt.Errorf("position must have at least 2 values")
+    }
+    *p = LonLat{values[0], values[1]}
+    return nil
+}
+
+func unmarshalPositions(data json.RawMessage, points *[]LonLat) error {
+    var positions []json.RawMessage
+    if err := json.Unmarshal(data, &positions); err != nil {
+        return err
+    }
+    for _, raw := range positions {
+        var p LonLat
+        if err := unmarshalPosition(raw, &p); err != nil {
+            return err
+        }
+        *points = append(*points, p)
+    }
+    return nil
+}
+
+//////////////////////////////////// GPX AND KML
+
+// parseXmlGeometry parses GPX (tracks, routes and waypoints) or KML
+// (polygons, line strings and points at any level of nesting). Names of
+// points (GPX waypoints or KML placemarks) are returned in the same order
+// as points of geometry
+func parseXmlGeometry(data []byte) (*Geometry, []string, error) {
+    g := &Geometry{}
+    decoder := xml.NewDecoder(bytes.NewReader(data))
+
+    var stack []string
+    var segment []LonLat
+    var names []string
+    // name of current KML placemark
+    placemark := ""
+    format := ""
+
+    // parent returns name of element enclosing current one at given depth
+    parent := func(depth int) string {
+        if len(stack) > depth {
+            return stack[len(stack) - 1 - depth]
+        }
+        return ""
+    }
+
+    for {
+        token, err := decoder.Token()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, nil, fmt.Errorf("Cannot parse XML: %s", err)
+        }
+
+        switch t := token.(type) {
+        case xml.StartElement:
+            name := t.Name.Local
+            if len(stack) == 0 {
+                format = name
+                if format != "gpx" && format != "kml" {
+                    return nil, nil, fmt.Errorf("Unsupported document %s (GeoJSON, GPX or KML is expected)", name)
+                }
+            }
+            stack = append(stack, name)
+
+            if format == "gpx" && (name == "trkpt" || name == "rtept" || name == "wpt") {
+                p, err := gpxPoint(t)
+                if err != nil {
+                    return nil, nil, err
+                }
+                if name == "wpt" {
+                    g.Points = append(g.Points, p)
+                    names = append(names, "")
+                } else {
+                    segment = append(segment, p)
+                }
+            }
+            if name == "Placemark" {
+                placemark = ""
+            }
+        case xml.EndElement:
+            name := t.Name.Local
+            if format == "gpx" && (name == "trkseg" || name == "rte") && len(segment) > 0 {
+                g.Lines = append(g.Lines, segment)
+                segment = nil
+            }
+            stack = stack[:len(stack) - 1]
+        case xml.CharData:
+            if parent(0) == "name" {
+                switch {
+                case format == "gpx" && parent(1) == "wpt" && len(names) > 0:
+                    names[len(names) - 1] += strings.TrimSpace(string(t))
+                case format == "kml" && parent(1) == "Placemark":
+                    placemark += strings.TrimSpace(string(t))
+                }
+                continue
+            }
+            if format != "kml" || parent(0) != "coordinates" {
+                continue
+            }
+            points, err := kmlCoordinates(string(t))
+            if err != nil {
+                return nil, nil, err
+            }
+            switch {
+            case parent(1) == "LinearRing":
+                g.Rings = append(g.Rings, points)
+            case parent(1) == "LineString":
+                g.Lines = append(g.Lines, points)
+            case parent(1) == "Point":
+                g.Points = append(g.Points, points...)
+                for range points {
+                    names = append(names, placemark)
+                }
+            }
+        }
+    }
+
+    if len(format) == 0 {
+        return nil, nil, fmt.Errorf("Unsupported document (GeoJSON, GPX or KML is expected)")
+    }
+
+    return g, names, nil
+}
+
+func gpxPoint(e xml.StartElement) (LonLat, error) {
+    var p LonLat
+    var hasLat, hasLon bool
+    for _, attr := range e.Attr {
+        var err error
+        switch attr.Name.Local {
+        case "lat":
+            p[1], err = strconv.ParseFloat(attr.Value, 64)
+            hasLat = true
+        case "lon":
+            p[0], err = strconv.ParseFloat(attr.Value, 64)
+            hasLon = true
+        }
+        if err != nil {
+            return p, fmt.Errorf("Cannot parse GPX point: %s", err)
+        }
+    }
+    if !hasLat || !hasLon {
+        return p, fmt.Errorf("GPX point without coordinates")
+    }
+    return p, nil
+}
+
+// kmlCoordinates parses list of "lon,lat[,alt]" tuples separated by spaces
+func kmlCoordinates(value string) ([]LonLat, error) {
+    var points []LonLat
+    for _, tuple := range strings.Fields(value) {
+        parts := strings.Split(tuple, ",")
+        if len(parts) < 2 {
+            return nil, fmt.Errorf("Invalid KML coordinates %q", tuple)
+        }
+        lon, err := strconv.ParseFloat(parts[0], 64)
+        if err != nil {
+            return nil, fmt.Errorf("Cannot parse KML coordinates: %s", err)
+        }
+        lat, err := strconv.ParseFloat(parts[1], 64)
+        if err != nil {
+            return nil, fmt.Errorf("Cannot parse KML coordinates: %s", err)
+        }
+        points = append(points, LonLat{lon, lat})
+    }
+    return points, nil
+}
+
+//////////////////////////////////// PROJECTION AND MASK
+
+// projectPoint returns position of point in pixels of stitched image
+// (Web Mercator, the same math as tile grid uses)
+func projectPoint(p LonLat, ip *InputParams) (float64, float64) {
+    size := float64(IntPow2(ip.Zoom) * ip.Scale)
+    latRad := p[1] * math.Pi / 180
+    x := (p[0] + 180) / 360 * size
+    y := (1 - math.Log(math.Tan(latRad) + 1 / math.Cos(latRad)) / math.Pi) / 2 * size
+    return x - float64(ip.XMin * ip.Scale), y - float64(ip.YMin * ip.Scale)
+}
+
+// applyMask hides (or fades) pixels of image outside of polygons of area.
+// Each row is filled between crossings of polygon edges (even-odd rule),
+// decision is made for center of pixel
+func applyMask(img *image.RGBA, ip *InputParams) {
+    if ip.Area == nil || len(ip.Area.Rings) == 0 || ip.Mask == MASK_NONE {
+        return
+    }
+
+    type edge struct{ x1, y1, x2, y2 float64 }
+    var edges []edge
+    for _, ring := range ip.Area.Rings {
+        for i := range ring {
+            x1, y1 := projectPoint(ring[i], ip)
+            x2, y2 := projectPoint(ring[(i + 1) % len(ring)], ip)
+            if y1 != y2 {
+                edges = append(edges, edge{x1, y1, x2, y2})
+            }
+        }
+    }
+
+    // jpeg has no alpha channel, transparent area is white there
+    outside := func(c color.RGBA) color.RGBA {
+        if ip.Mask == MASK_TRANSPARENT {
+            if ip.Format == IMAGE_FORMAT_JPEG {
+                return color.RGBA{255, 255, 255, 255}
+            }
+            return color.RGBA{}
+        }
+        fade := func(v uint8) uint8 {
+            return uint8(float64(v) * (1 - MASK_FADE_OPACITY) + 255 * MASK_FADE_OPACITY)
+        }
+        return color.RGBA{fade(c.R), fade(c.G), fade(c.B), 255}
+    }
+
+    b := img.Bounds()
+    var crossings []float64
+    for y := b.Min.Y; y < b.Max.Y; y++ {
+        yc := float64(y) + 0.5
+        crossings = crossings[:0]
+        for _, e := range edges {
+            if (e.y1 <= yc && yc < e.y2) || (e.y2 <= yc && yc < e.y1) {
+                crossings = append(crossings, e.x1 + (yc - e.y1) * (e.x2 - e.x1) / (e.y2 - e.y1))
+            }
+        }
+        sort.Float64s(crossings)
+
+        next := 0
+        inside := false
+        for x := b.Min.X; x < b.Max.X; x++ {
+            xc := float64(x) + 0.5
+            for next < len(crossings) && crossings[next] <= xc {
+                inside = !inside
+                next++
+            }
+            if !inside {
+                img.SetRGBA(x, y, outside(img.RGBAAt(x, y)))
+            }
+        }
+    }
+}
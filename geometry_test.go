@@ -0,0 +1,81 @@
+package main
+
+import (
+    "image"
+    "image/color"
+    "image/draw"
+    "testing"
+)
+
+func TestParseGeometry(t *testing.T) {
+    g, err := ParseGeometry([]byte(`{"type": "FeatureCollection", "features": [
+        {"type": "Feature", "geometry": {"type": "Polygon", "coordinates": [[[14.2, 49.9], [14.7, 49.9], [14.7, 50.2], [14.2, 49.9]]]}},
+        {"type": "Feature", "geometry": {"type": "LineString", "coordinates": [[14.1, 50.0, 300], [14.3, 50.3]]}},
+        {"type": "Feature", "geometry": null}]}`))
+    Ok(t, err)
+    Equals(t, 1, len(g.Rings))
+    Equals(t, [][]LonLat{{{14.1, 50.0}, {14.3, 50.3}}}, g.Lines)
+    Equals(t, [4]float64{14.1, 49.9, 14.7, 50.3}, g.Bounds())
+
+    g, err = ParseGeometry([]byte(`<?xml version="1.0"?>
+        <gpx version="1.1" xmlns="http://www.topografix.com/GPX/1/1">
+        <wpt lat="50.1" lon="14.4"><name>Start</name></wpt>
+        <trk><trkseg><trkpt lat="50.0" lon="14.2"/><trkpt lat="50.2" lon="14.5"/></trkseg></trk>
+        </gpx>`))
+    Ok(t, err)
+    Equals(t, []LonLat{{14.4, 50.1}}, g.Points)
+    Equals(t, [][]LonLat{{{14.2, 50.0}, {14.5, 50.2}}}, g.Lines)
+
+    g, err = ParseGeometry([]byte(`<kml xmlns="http://www.opengis.net/kml/2.2"><Document><Placemark><MultiGeometry>
+        <Polygon><outerBoundaryIs><LinearRing><coordinates>14.2,49.9,0 14.7,49.9,0 14.7,50.2,0 14.2,49.9,0</coordinates></LinearRing></outerBoundaryIs></Polygon>
+        <Point><coordinates>14.4,50.1</coordinates></Point>
+        </MultiGeometry></Placemark></Document></kml>`))
+    Ok(t, err)
+    Equals(t, [][]LonLat{{{14.2, 49.9}, {14.7, 49.9}, {14.7, 50.2}, {14.2, 49.9}}}, g.Rings)
+    Equals(t, []LonLat{{14.4, 50.1}}, g.Points)
+
+    // latitudes are clamped to limits of Web Mercator
+    g, err = ParseGeometry([]byte(`{"type": "Point", "coordinates": [0, 89]}`))
+    Ok(t, err)
+    Equals(t, MERCATOR_MAX_LAT, g.Points[0][1])
+
+    for _, invalid := range []string{
+        `{"type": "Point", "coordinates": [200, 0]}`,
+        `{"type": "Polygon", "coordinates": [[[0, 0], [1, 1]]]}`,
+        `{"type": "FeatureCollection", "features": []}`,
+        `{"type": "Circle"}`,
+        `<svg></svg>`,
+        `<gpx><trk><trkseg><trkpt lat="x" lon="1"/></trkseg></trk></gpx>`,
+        `<kml><wpt><name>x</name></wpt></kml>`,
+        `<gpx><Placemark><name>x</name></Placemark></gpx>`,
+        ``,
+    } {
+        _, err = ParseGeometry([]byte(invalid))
+        Equals(t, true, err != nil)
+    }
+}
+
+func TestApplyMask(t *testing.T) {
+    // whole world in 8x8 image, polygon covers western hemisphere
+    area := &Geometry{Rings: [][]LonLat{{{-180, -MERCATOR_MAX_LAT}, {0, -MERCATOR_MAX_LAT}, {0, MERCATOR_MAX_LAT}, {-180, MERCATOR_MAX_LAT}}}}
+    ip := InputParams{Zoom: 0, Scale: 8, Area: area, Mask: MASK_TRANSPARENT}
+
+    img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+    draw.Draw(img, img.Bounds(), &image.Uniform{color.RGBA{0, 0, 0, 255}}, image.Point{}, draw.Src)
+    applyMask(img, &ip)
+    Equals(t, color.RGBA{0, 0, 0, 255}, img.RGBAAt(3, 4))
+    Equals(t, color.RGBA{}, img.RGBAAt(4, 4))
+
+    ip.Mask = MASK_FADE
+    draw.Draw(img, img.Bounds(), &image.Uniform{color.RGBA{0, 0, 0, 255}}, image.Point{}, draw.Src)
+    applyMask(img, &ip)
+    Equals(t, color.RGBA{0, 0, 0, 255}, img.RGBAAt(0, 0))
+    Equals(t, color.RGBA{153, 153, 153, 255}, img.RGBAAt(7, 7))
+
+    // mask is part of job key
+    key := ip.Key()
+    ip.Mask = MASK_TRANSPARENT
+    Equals(t, false, key == ip.Key())
+    ip.Area = nil
+    Equals(t, (&InputParams{Zoom: 0, Scale: 8}).Key(), ip.Key())
+}
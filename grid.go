@@ -0,0 +1,504 @@
+package main
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "image"
+    "image/color"
+    "image/draw"
+    "math"
+    "strconv"
+    "golang.org/x/image/font"
+)
+
+// default resolution of output (used for size of labels)
+const GRID_DPI = 150
+
+// limits of resolution
+const GRID_DPI_MIN = 72
+const GRID_DPI_MAX = 1200
+
+// size of grid labels in points, it is scaled to pixels by resolution
+const GRID_LABEL_POINTS = 8.0
+
+// the widest label at sides of map, margins are sized to fit it so that
+// size of output is known before image is rendered (digits of label font
+// have the same width)
+const GRID_LABEL_WIDEST = "88°88'88\"N"
+
+// maximal number of grid lines in each direction
+const GRID_MAX_LINES = 500
+
+// number of points of each UTM line (UTM lines are not straight in Web
+// Mercator)
+const GRID_UTM_SAMPLES = 64
+
+// WGS84 ellipsoid and UTM constants
+const WGS84_A = 6378137.0
+const WGS84_F = 1 / 298.257223563
+const UTM_K0 = 0.9996
+const UTM_FALSE_EASTING = 500000.0
+const UTM_FALSE_NORTHING = 10000000.0
+
+// Grid describes reference grids drawn onto image
+type Grid struct {
+    // interval of lat/lon graticule in degrees (zero disables it)
+    Graticule float64
+    // interval of UTM/MGRS grid in kilometres (zero disables it)
+    Utm float64
+    // coordinates are labelled in margins added around map
+    Labels bool
+    // resolution of output, size of labels is scaled by it
+    Dpi int
+}
+
+// Hash returns hash of grid, it is part of key of job
+func (g *Grid) Hash() string {
+    data, _ := json.Marshal(g)
+    hash := sha256.Sum256(data)
+    return hex.EncodeToString(hash[:])
+}
+
+// Margins returns width of margins added at left and right side and height
+// of margins added at top and bottom of map (zero if there are no labels)
+func (g *Grid) Margins() (int, int) {
+    if g == nil || !g.Labels {
+        return 0, 0
+    }
+    size := GRID_LABEL_POINTS * float64(g.Dpi) / 72
+    face, err := labelFace(size)
+    if err != nil {
+        // font is embedded, it is parsed the same way when image is framed
+        return 0, 0
+    }
+    defer face.Close()
+    horizontal, vertical := labelMargins(face, size)
+    return int(horizontal), int(vertical)
+}
+
+// labelMargins returns margins fitting labels of given face and size
+func labelMargins(face font.Face, size float64) (float64, float64) {
+    pad := math.Ceil(size / 2)
+    vertical := math.Ceil(size + 2 * pad)
+    horizontal := math.Max(vertical, math.Ceil(textWidth(face, GRID_LABEL_WIDEST) + 2 * pad))
+    return horizontal, vertical
+}
+
+// ParseGrid parses grid options given as strings, nil is returned if no
+// grid is enabled
+func ParseGrid(graticule, utm string, labels bool, dpi string) (*Grid, error) {
+    g := &Grid{Labels: labels}
+
+    var err error
+    if len(graticule) > 0 {
+        if g.Graticule, err = strconv.ParseFloat(graticule, 64); err != nil || g.Graticule < 0 || g.Graticule > 90 {
+            return nil, fmt.Errorf("Graticule interval must be number of degrees between 0 and 90")
+        }
+    }
+    if len(utm) > 0 {
+        if g.Utm, err = strconv.ParseFloat(utm, 64); err != nil || g.Utm < 0 || g.Utm > 1000 {
+            return nil, fmt.Errorf("UTM grid interval must be number of kilometres between 0 and 1000")
+        }
+    }
+    if g.Dpi, err = parseDpi(dpi); err != nil {
+        return nil, err
+    }
+
+    if g.Graticule == 0 && g.Utm == 0 {
+        return nil, nil
+    }
+    return g, nil
+}
+
+// parseDpi parses resolution of output, default is used for empty value
+func parseDpi(value string) (int, error) {
+    if len(value) == 0 {
+        return GRID_DPI, nil
+    }
+    dpi, err := strconv.Atoi(value)
+    if err != nil || dpi < GRID_DPI_MIN || dpi > GRID_DPI_MAX {
+        return 0, fmt.Errorf("Resolution must be between %d and %d dpi", GRID_DPI_MIN, GRID_DPI_MAX)
+    }
+    return dpi, nil
+}
+
+// validate checks that grid doesn't produce too many lines for given map
+func (g *Grid) validate(ip *InputParams) error {
+    w, h := ip.ImageSize()
+    nw := unprojectPoint(0, 0, ip)
+    se := unprojectPoint(float64(w), float64(h), ip)
+
+    if g.Graticule > 0 && math.Max(se[0] - nw[0], nw[1] - se[1]) / g.Graticule > GRID_MAX_LINES {
+        return fmt.Errorf("Graticule interval is too small for this map")
+    }
+    if g.Utm > 0 {
+        zone := utmZone(ip)
+        e1, n1 := latLonToUtm(nw, zone)
+        e2, n2 := latLonToUtm(se, zone)
+        if math.Max(math.Abs(e2 - e1), math.Abs(n2 - n1)) / (g.Utm * 1000) > GRID_MAX_LINES {
+            return fmt.Errorf("UTM grid interval is too small for this map")
+        }
+    }
+    return nil
+}
+
+//////////////////////////////////// PROJECTIONS
+
+// unprojectPoint returns coordinates of pixel of stitched image (inverse
+// of projectPoint)
+func unprojectPoint(x, y float64, ip *InputParams) LonLat {
+    size := float64(IntPow2(ip.Zoom) * ip.Scale)
+    x, y = x + float64(ip.XMin * ip.Scale), y + float64(ip.YMin * ip.Scale)
+    lon := x / size * 360 - 180
+    lat := math.Atan(math.Sinh(math.Pi * (1 - 2 * y / size))) * 180 / math.Pi
+    return LonLat{lon, lat}
+}
+
+// utmZone returns UTM zone of map center, negative for southern hemisphere
+// (zone exceptions of Norway and Svalbard are ignored)
+func utmZone(ip *InputParams) int {
+    w, h := ip.ImageSize()
+    c := unprojectPoint(float64(w) / 2, float64(h) / 2, ip)
+    zone := IntMin(int((c[0] + 180) / 6) + 1, 60)
+    if c[1] < 0 {
+        return -zone
+    }
+    return zone
+}
+
+// latLonToUtm returns easting and northing of point in given UTM zone
+// (negative zone means southern hemisphere)
+func latLonToUtm(p LonLat, zone int) (float64, float64) {
+    e2 := WGS84_F * (2 - WGS84_F)
+    ep2 := e2 / (1 - e2)
+
+    lat := p[1] * math.Pi / 180
+    lon0 := float64((IntMax(zone, -zone) - 1) * 6 - 180 + 3) * math.Pi / 180
+    sin, cos, tan := math.Sin(lat), math.Cos(lat), math.Tan(lat)
+
+    n := WGS84_A / math.Sqrt(1 - e2 * sin * sin)
+    t := tan * tan
+    c := ep2 * cos * cos
+    a := cos * (p[0] * math.Pi / 180 - lon0)
+    m := meridianArc(lat, e2)
+
+    easting := UTM_K0 * n * (a + (1 - t + c) * math.Pow(a, 3) / 6 + (5 - 18 * t + t * t + 72 * c - 58 * ep2) * math.Pow(a, 5) / 120) + UTM_FALSE_EASTING
+    northing := UTM_K0 * (m + n * tan * (a * a / 2 + (5 - t + 9 * c + 4 * c * c) * math.Pow(a, 4) / 24 + (61 - 58 * t + t * t + 600 * c - 330 * ep2) * math.Pow(a, 6) / 720))
+    if zone < 0 {
+        northing += UTM_FALSE_NORTHING
+    }
+    return easting, northing
+}
+
+// utmToLatLon returns coordinates of point given by easting and northing
+// in UTM zone (negative zone means southern hemisphere)
+func utmToLatLon(easting, northing float64, zone int) LonLat {
+    e2 := WGS84_F * (2 - WGS84_F)
+    ep2 := e2 / (1 - e2)
+    e1 := (1 - math.Sqrt(1 - e2)) / (1 + math.Sqrt(1 - e2))
+
+    x := easting - UTM_FALSE_EASTING
+    y := northing
+    if zone < 0 {
+        y -= UTM_FALSE_NORTHING
+    }
+    lon0 := float64((IntMax(zone, -zone) - 1) * 6 - 180 + 3)
+
+    mu := y / UTM_K0 / (WGS84_A * (1 - e2 / 4 - 3 * e2 * e2 / 64 - 5 * math.Pow(e2, 3) / 256))
+    lat1 := mu + (3 * e1 / 2 - 27 * math.Pow(e1, 3) / 32) * math.Sin(2 * mu) +
+        (21 * e1 * e1 / 16 - 55 * math.Pow(e1, 4) / 32) * math.Sin(4 * mu) +
+        (151 * math.Pow(e1, 3) / 96) * math.Sin(6 * mu) +
+        (1097 * math.Pow(e1, 4) / 512) * math.Sin(8 * mu)
+
+    sin, cos, tan := math.Sin(lat1), math.Cos(lat1), math.Tan(lat1)
+    n1 := WGS84_A / math.Sqrt(1 - e2 * sin * sin)
+    t1 := tan * tan
+    c1 := ep2 * cos * cos
+    r1 := WGS84_A * (1 - e2) / math.Pow(1 - e2 * sin * sin, 1.5)
+    d := x / (n1 * UTM_K0)
+
+    lat := lat1 - (n1 * tan / r1) * (d * d / 2 - (5 + 3 * t1 + 10 * c1 - 4 * c1 * c1 - 9 * ep2) * math.Pow(d, 4) / 24 +
+        (61 + 90 * t1 + 298 * c1 + 45 * t1 * t1 - 252 * ep2 - 3 * c1 * c1) * math.Pow(d, 6) / 720)
+    lon := (d - (1 + 2 * t1 + c1) * math.Pow(d, 3) / 6 + (5 - 2 * c1 + 28 * t1 - 3 * c1 * c1 + 8 * ep2 + 24 * t1 * t1) * math.Pow(d, 5) / 120) / cos
+
+    return LonLat{lon0 + lon * 180 / math.Pi, lat * 180 / math.Pi}
+}
+
+// meridianArc returns distance from equator to latitude along meridian
+func meridianArc(lat, e2 float64) float64 {
+    e4, e6 := e2 * e2, e2 * e2 * e2
+    return WGS84_A * ((1 - e2 / 4 - 3 * e4 / 64 - 5 * e6 / 256) * lat -
+        (3 * e2 / 8 + 3 * e4 / 32 + 45 * e6 / 1024) * math.Sin(2 * lat) +
+        (15 * e4 / 256 + 45 * e6 / 1024) * math.Sin(4 * lat) -
+        (35 * e6 / 3072) * math.Sin(6 * lat))
+}
+
+// mgrsSquare returns designation of MGRS grid zone and 100 km square of
+// point, e.g. "33U VR"
+func mgrsSquare(p LonLat, zone int) string {
+    easting, northing := latLonToUtm(p, zone)
+    z := IntMax(zone, -zone)
+
+    bands := "CDEFGHJKLMNPQRSTUVWX"
+    band := bands[IntMax(0, IntMin(len(bands) - 1, int(math.Floor((p[1] + 80) / 8))))]
+
+    columns := []string{"STUVWXYZ", "ABCDEFGH", "JKLMNPQR"}[z % 3]
+    column := columns[IntMax(0, IntMin(7, int(easting / 100000) - 1))]
+
+    rows := "ABCDEFGHJKLMNPQRSTUV"
+    row := int(math.Floor(northing / 100000))
+    if z % 2 == 0 {
+        row += 5
+    }
+    return fmt.Sprintf("%d%c %c%c", z, band, column, rows[((row % 20) + 20) % 20])
+}
+
+//////////////////////////////////// DRAWING
+
+// gridLabel is label of grid line at edge of map
+type gridLabel struct {
+    // position along edge in pixels of map
+    Pos float64
+    Text string
+}
+
+// gridLabels are labels of grid lines along edges of map: top and left for
+// graticule, bottom and right for UTM
+type gridLabels struct {
+    Top, Left, Bottom, Right []gridLabel
+    // UTM zone and MGRS square of map center
+    Zone string
+    // pixels per point
+    Scale float64
+}
+
+// formatDegrees formats coordinate as degrees, minutes and seconds (only
+// parts needed for given interval are shown)
+func formatDegrees(value, interval float64, positive, negative string) string {
+    hemisphere := positive
+    if value < 0 {
+        hemisphere = negative
+    }
+    seconds := int(math.Round(math.Abs(value) * 3600))
+    d, m, s := seconds / 3600, seconds / 60 % 60, seconds % 60
+
+    step := int(math.Round(interval * 3600))
+    switch {
+    case step % 3600 == 0:
+        return fmt.Sprintf("%d°%s", d, hemisphere)
+    case step % 60 == 0:
+        return fmt.Sprintf("%d°%02d'%s", d, m, hemisphere)
+    }
+    return fmt.Sprintf("%d°%02d'%02d\"%s", d, m, s, hemisphere)
+}
+
+// crossing returns position where polyline crosses line x = value (or
+// y = value if vertical is false)
+func crossing(points [][2]float64, value float64, vertical bool) (float64, bool) {
+    a, b := 0, 1
+    if !vertical {
+        a, b = 1, 0
+    }
+    for i := 0; i + 1 < len(points); i++ {
+        p, q := points[i], points[i + 1]
+        if (p[a] <= value && value < q[a]) || (q[a] <= value && value < p[a]) {
+            return p[b] + (value - p[a]) * (q[b] - p[b]) / (q[a] - p[a]), true
+        }
+    }
+    return 0, false
+}
+
+// lineShape returns shape of polyline of given width without joins, it is
+// suitable for nearly straight lines only (joins of strokeShapes overlap
+// and thin lines would be dotted)
+func lineShape(points [][2]float64, width float64) Shape {
+    hw := width / 2
+    left := make(Shape, 0, len(points))
+    right := make(Shape, 0, len(points))
+    for i, p := range points {
+        a, b := points[IntMax(0, i - 1)], points[IntMin(len(points) - 1, i + 1)]
+        dx, dy := b[0] - a[0], b[1] - a[1]
+        l := math.Hypot(dx, dy)
+        if l == 0 {
+            continue
+        }
+        nx, ny := -dy / l * hw, dx / l * hw
+        left = append(left, [2]float64{p[0] + nx, p[1] + ny})
+        right = append(right, [2]float64{p[0] - nx, p[1] - ny})
+    }
+    for i := len(right) - 1; i >= 0; i-- {
+        left = append(left, right[i])
+    }
+    return left
+}
+
+// drawGrid draws grid lines of request onto map, labels are returned if
+// they are enabled (they are drawn into margins by frameGrid)
+func drawGrid(img *image.RGBA, ip *InputParams) *gridLabels {
+    g := ip.Grid
+    if g == nil {
+        return nil
+    }
+
+    scale := float64(g.Dpi) / 72
+    w, h := float64(img.Bounds().Dx()), float64(img.Bounds().Dy())
+    lineWidth := math.Max(1, scale * 0.5)
+
+    labels := &gridLabels{Scale: scale}
+
+    if g.Graticule > 0 {
+        nw := unprojectPoint(0, 0, ip)
+        se := unprojectPoint(w, h, ip)
+
+        var shapes []Shape
+        for lon := math.Ceil(nw[0] / g.Graticule) * g.Graticule; lon <= se[0]; lon += g.Graticule {
+            x, _ := projectPoint(LonLat{lon, 0}, ip)
+            shapes = append(shapes, lineShape([][2]float64{{x, 0}, {x, h}}, lineWidth))
+            labels.Top = append(labels.Top, gridLabel{x, formatDegrees(lon, g.Graticule, "E", "W")})
+        }
+        for lat := math.Ceil(se[1] / g.Graticule) * g.Graticule; lat <= nw[1]; lat += g.Graticule {
+            _, y := projectPoint(LonLat{0, lat}, ip)
+            shapes = append(shapes, lineShape([][2]float64{{0, y}, {w, y}}, lineWidth))
+            labels.Left = append(labels.Left, gridLabel{y, formatDegrees(lat, g.Graticule, "N", "S")})
+        }
+        fillShapes(img, shapes, color.NRGBA{0, 0, 0, 160})
+    }
+
+    if g.Utm > 0 {
+        zone := utmZone(ip)
+        interval := g.Utm * 1000
+
+        // extent of map in UTM coordinates
+        emin, nmin, emax, nmax := math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+        for _, c := range [][2]float64{{0, 0}, {w / 2, 0}, {w, 0}, {0, h / 2}, {w, h / 2}, {0, h}, {w / 2, h}, {w, h}} {
+            e, n := latLonToUtm(unprojectPoint(c[0], c[1], ip), zone)
+            emin, nmin, emax, nmax = math.Min(emin, e), math.Min(nmin, n), math.Max(emax, e), math.Max(nmax, n)
+        }
+
+        line := func(e0, n0, e1, n1 float64) [][2]float64 {
+            var points [][2]float64
+            for i := 0; i <= GRID_UTM_SAMPLES; i++ {
+                f := float64(i) / GRID_UTM_SAMPLES
+                x, y := projectPoint(utmToLatLon(e0 + (e1 - e0) * f, n0 + (n1 - n0) * f, zone), ip)
+                points = append(points, [2]float64{x, y})
+            }
+            return points
+        }
+
+        // labels are km in 100 km square (MGRS principal digits), unless
+        // interval is bigger
+        kmLabel := func(v float64) string {
+            km := int(math.Round(v / 1000))
+            if g.Utm < 100 {
+                km = km % 100
+                return fmt.Sprintf("%02d", km)
+            }
+            return strconv.Itoa(km)
+        }
+
+        var shapes []Shape
+        for e := math.Ceil(emin / interval) * interval; e <= emax; e += interval {
+            points := line(e, nmin, e, nmax)
+            shapes = append(shapes, lineShape(points, lineWidth))
+            if x, ok := crossing(points, h, false); ok && x >= 0 && x <= w {
+                labels.Bottom = append(labels.Bottom, gridLabel{x, kmLabel(e)})
+            }
+        }
+        for n := math.Ceil(nmin / interval) * interval; n <= nmax; n += interval {
+            points := line(emin, n, emax, n)
+            shapes = append(shapes, lineShape(points, lineWidth))
+            if y, ok := crossing(points, w, true); ok && y >= 0 && y <= h {
+                labels.Right = append(labels.Right, gridLabel{y, kmLabel(n)})
+            }
+        }
+        fillShapes(img, shapes, color.NRGBA{0, 0, 160, 160})
+
+        labels.Zone = "UTM " + mgrsSquare(unprojectPoint(w / 2, h / 2, ip), zone)
+    }
+
+    if !g.Labels {
+        return nil
+    }
+    return labels
+}
+
+// frameGrid places map into frame with margins and draws labels of grid
+// lines there, map is returned as is if there are no labels
+func frameGrid(img *image.RGBA, labels *gridLabels) (*image.RGBA, error) {
+    if labels == nil {
+        return img, nil
+    }
+
+    scale := labels.Scale
+    size := GRID_LABEL_POINTS * scale
+    face, err := labelFace(size)
+    if err != nil {
+        return nil, err
+    }
+    defer face.Close()
+
+    // margins fit the widest label
+    pad := math.Ceil(size / 2)
+    horizontal, vertical := labelMargins(face, size)
+
+    mx, my := int(horizontal), int(vertical)
+    b := img.Bounds()
+    framed := image.NewRGBA(image.Rect(0, 0, b.Dx() + 2 * mx, b.Dy() + 2 * my))
+    draw.Draw(framed, framed.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+    draw.Draw(framed, b.Sub(b.Min).Add(image.Point{mx, my}), img, b.Min, draw.Src)
+
+    w, h := float64(b.Dx()), float64(b.Dy())
+    black := color.RGBA{0, 0, 0, 255}
+
+    // neat line around map
+    fillShapes(framed, strokeShapes([][2]float64{
+        {horizontal, vertical}, {horizontal + w, vertical}, {horizontal + w, vertical + h}, {horizontal, vertical + h}, {horizontal, vertical},
+    }, math.Max(1, scale * 0.5)), black)
+
+    // labels along top and bottom are centered on lines, overlapping
+    // labels are skipped
+    drawRow := func(labels []gridLabel, baseline float64) {
+        last := math.Inf(-1)
+        for _, l := range labels {
+            tw := textWidth(face, l.Text)
+            x := horizontal + l.Pos - tw / 2
+            if x < last + pad || x < 0 || x + tw > float64(framed.Bounds().Dx()) {
+                continue
+            }
+            drawLabel(framed, face, x, baseline, l.Text, black, nil)
+            last = x + tw
+        }
+    }
+    drawRow(labels.Top, vertical - pad)
+    drawRow(labels.Bottom, vertical + h + pad + size * 0.8)
+
+    // labels along left and right sides are centered vertically on lines
+    drawColumn := func(labels []gridLabel, right bool) {
+        last := math.Inf(1)
+        for i := len(labels) - 1; i >= 0; i-- {
+            l := labels[i]
+            y := vertical + l.Pos + size * 0.35
+            if math.Abs(y - last) < size + pad / 2 {
+                continue
+            }
+            x := pad
+            if right {
+                x = horizontal + w + pad
+            } else {
+                x = horizontal - pad - textWidth(face, l.Text)
+            }
+            drawLabel(framed, face, x, y, l.Text, black, nil)
+            last = y
+        }
+    }
+    drawColumn(labels.Left, false)
+    drawColumn(labels.Right, true)
+
+    if len(labels.Zone) > 0 {
+        drawLabel(framed, face, pad, vertical + h + pad + size * 0.8, labels.Zone, black, nil)
+    }
+
+    return framed, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+    "image"
+    "image/color"
+    "image/draw"
+    "math"
+    "testing"
+)
+
+func TestUtm(t *testing.T) {
+    // central meridian of zone 33
+    e, n := latLonToUtm(LonLat{15, 50}, 33)
+    Equals(t, 500000.0, math.Round(e))
+    Equals(t, 5538631.0, math.Round(n))
+
+    // equator in southern hemisphere
+    e, n = latLonToUtm(LonLat{3, 0}, -31)
+    Equals(t, 500000.0, math.Round(e))
+    Equals(t, UTM_FALSE_NORTHING, math.Round(n))
+
+    // round trip away from central meridian
+    for _, p := range []LonLat{{14.42, 50.09}, {-73.98, 40.75}, {151.21, -33.87}} {
+        zone := int((p[0] + 180) / 6) + 1
+        if p[1] < 0 {
+            zone = -zone
+        }
+        e, n := latLonToUtm(p, zone)
+        q := utmToLatLon(e, n, zone)
+        Equals(t, true, math.Abs(p[0] - q[0]) < 1e-7 && math.Abs(p[1] - q[1]) < 1e-7)
+    }
+
+    Equals(t, "33U VR", mgrsSquare(LonLat{14.42, 50.09}, 33))
+    Equals(t, "18T WL", mgrsSquare(LonLat{-73.98, 40.75}, 18))
+}
+
+func TestParseGrid(t *testing.T) {
+    g, err := ParseGrid("", "", true, "")
+    Ok(t, err)
+    Equals(t, (*Grid)(nil), g)
+
+    g, err = ParseGrid("0.25", "1", true, "300")
+    Ok(t, err)
+    Equals(t, &Grid{Graticule: 0.25, Utm: 1, Labels: true, Dpi: 300}, g)
+
+    for _, values := range [][3]string{{"x", "", ""}, {"", "-1", ""}, {"1", "", "10"}} {
+        _, err = ParseGrid(values[0], values[1], false, values[2])
+        Equals(t, true, err != nil)
+    }
+
+    // too dense grid for whole world
+    ip := InputParams{Zoom: 0, Scale: 256}
+    g, _ = ParseGrid("0.1", "", false, "")
+    Equals(t, true, g.validate(&ip) != nil)
+    g, _ = ParseGrid("10", "", false, "")
+    Ok(t, g.validate(&ip))
+
+    Equals(t, "50°N", formatDegrees(50, 1, "N", "S"))
+    Equals(t, "14°15'W", formatDegrees(-14.25, 0.25, "E", "W"))
+    Equals(t, "0°00'30\"E", formatDegrees(1.0 / 120, 1.0 / 120, "E", "W"))
+}
+
+func TestDrawGrid(t *testing.T) {
+    // whole world in 512x512 image, graticule of 90 degrees
+    ip := InputParams{Zoom: 0, Scale: 512, Grid: &Grid{Graticule: 90, Dpi: 72}}
+    img := image.NewRGBA(image.Rect(0, 0, 512, 512))
+    draw.Draw(img, img.Bounds(), &image.Uniform{color.RGBA{255, 255, 255, 255}}, image.Point{}, draw.Src)
+
+    out, err := decorateImage(img, &ip)
+    Ok(t, err)
+    Equals(t, img.Bounds(), out.Bounds())
+    // meridians -90, 0, 90 and equator
+    for _, x := range []int{128, 256, 384} {
+        Equals(t, true, out.RGBAAt(x, 100).R < 200)
+    }
+    Equals(t, true, out.RGBAAt(100, 256).R < 200)
+    Equals(t, color.RGBA{255, 255, 255, 255}, out.RGBAAt(200, 100))
+
+    // labels add margins, size of labels scales with dpi
+    w, h := ip.OutputSize()
+    Equals(t, []int{512, 512}, []int{w, h})
+    ip.Grid.Labels = true
+    out72, err := decorateImage(img, &ip)
+    Ok(t, err)
+    w, h = ip.OutputSize()
+    Equals(t, []int{w, h}, []int{out72.Bounds().Dx(), out72.Bounds().Dy()})
+    ip.Grid.Dpi = 300
+    out300, err := decorateImage(img, &ip)
+    Ok(t, err)
+    w, h = ip.OutputSize()
+    Equals(t, []int{w, h}, []int{out300.Bounds().Dx(), out300.Bounds().Dy()})
+    Equals(t, true, out72.Bounds().Dx() > 512 && out72.Bounds().Dy() > 512)
+    Equals(t, true, out300.Bounds().Dy() > out72.Bounds().Dy())
+
+    // label of meridian 0 is in top margin above it
+    my := (out72.Bounds().Dy() - 512) / 2
+    mx := (out72.Bounds().Dx() - 512) / 2
+    dark := 0
+    for x := mx + 246; x < mx + 266; x++ {
+        for y := 0; y < my; y++ {
+            if out72.RGBAAt(x, y).R < 128 {
+                dark++
+            }
+        }
+    }
+    Equals(t, true, dark > 5)
+
+    // grid is part of job key
+    key := ip.Key()
+    ip.Grid.Utm = 100
+    Equals(t, false, key == ip.Key())
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strings"
+    "github.com/op/go-logging"
+)
+
+type HandlerProvidersCheck struct {
+    log *logging.Logger
+    providers *Providers
+    policy *FetchPolicy
+}
+
+func (h *HandlerProvidersCheck) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    var err error
+
+    h.log.Debugf("Processing request, path: %s", r.URL.Path)
+
+    // check http method, GET is required
+    if r.Method != http.MethodGet {
+        WriteErrorResponse(w, http.StatusMethodNotAllowed, fmt.Errorf("Only GET method is allowed"))
+        return
+    }
+
+    // optional comma separated list of providers to be checked
+    var names []string
+    if provider := r.URL.Query().Get("provider"); len(provider) > 0 {
+        names = strings.Split(provider, ",")
+    }
+
+    format := r.URL.Query().Get("format")
+    if format != "table" {
+        format = "json"
+    }
+
+    checks, err := checkProviders(h.policy, h.providers, names)
+    if err != nil {
+        WriteErrorResponse(w, http.StatusBadRequest, err)
+        return
+    }
+
+    if format == "json" {
+        w.Header().Set("Content-Type", "application/json")
+    } else {
+        w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+    }
+    if err = writeProviderChecks(w, checks, format); err != nil {
+        h.log.Errorf("Writing providers check failed: %s", err)
+    }
+}
+
+// HandlerFetchViolations reports counters of fetch policy violations (json)
+type HandlerFetchViolations struct {
+    log *logging.Logger
+    policy *FetchPolicy
+}
+
+func (h *HandlerFetchViolations) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+    h.log.Debugf("Processing request, path: %s", r.URL.Path)
+
+    if r.Method != http.MethodGet {
+        WriteErrorResponse(w, http.StatusMethodNotAllowed, fmt.Errorf("Only GET method is allowed"))
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(h.policy.Violations())
+}
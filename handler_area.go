@@ -0,0 +1,160 @@
+package main
+
+import (
+    "fmt"
+    "html/template"
+    "io/ioutil"
+    "net/http"
+    "strconv"
+    "github.com/op/go-logging"
+)
+
+// max size of uploaded area (GeoJSON, GPX or KML)
+const AREA_MAX_SIZE = 10 << 20
+
+// max number of tiles covering area (64x64 tiles)
+const AREA_MAX_TILES = 4096
+
+// HandlerArea enqueues request covering area of interest. Area is either
+// uploaded as file "file" or drawn on home page and sent as GeoJSON in
+// field "geometry". Tile range covering area at chosen zoom is computed
+// by server
+type HandlerArea struct {
+    log *logging.Logger
+    providers *Providers
+    queue *Queue
+}
+
+func (h *HandlerArea) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+    h.log.Debugf("Processing request, path: %s", r.URL.Path)
+
+    if r.Method != http.MethodPost {
+        WriteErrorResponse(w, http.StatusMethodNotAllowed, fmt.Errorf("Only POST method is allowed"))
+        return
+    }
+
+    r.Body = http.MaxBytesReader(w, r.Body, AREA_MAX_SIZE)
+
+    // zoom is checked before area is parsed
+    provider, zoom, err := h.providerZoom(r)
+    if err != nil {
+        WriteErrorResponse(w, http.StatusBadRequest, err)
+        return
+    }
+
+    area, err := h.readArea(r)
+    if err != nil {
+        WriteErrorResponse(w, http.StatusBadRequest, err)
+        return
+    }
+
+    ip, err := h.inputParams(r, provider, zoom, area)
+    if err != nil {
+        WriteErrorResponse(w, http.StatusBadRequest, err)
+        return
+    }
+
+    options, err := enqueueOptions(r, h.queue.config.MaxClientPriority)
+    if err != nil {
+        WriteErrorResponse(w, http.StatusBadRequest, err)
+        return
+    }
+
+    request, err := h.queue.Enqueue(ip, options)
+    if err != nil {
+        e := fmt.Errorf("Cannot enqueue: %s", err)
+        h.log.Error(err)
+        WriteErrorResponse(w, 500, e)
+        return
+    }
+
+    tmpl := template.Must(template.ParseFiles("html/base.html", "html/stitcher.html"))
+
+    w.Header().Set("Content-Type", "text/html; charset=utf-8")
+    err = tmpl.Execute(w, request)
+    if err != nil {
+        w.Write([]byte(fmt.Sprintf("Rendering error: %s", err)))
+    }
+}
+
+// readArea parses uploaded file or drawn polygon
+func (h *HandlerArea) readArea(r *http.Request) (*Geometry, error) {
+    var content []byte
+
+    file, _, err := r.FormFile("file")
+    if err == nil {
+        defer file.Close()
+        if content, err = ioutil.ReadAll(file); err != nil {
+            return nil, fmt.Errorf("Cannot read area: %s", err)
+        }
+    } else if err != http.ErrMissingFile && err != http.ErrNotMultipart {
+        return nil, fmt.Errorf("Cannot read area: %s", err)
+    }
+
+    if len(content) == 0 {
+        content = []byte(r.FormValue("geometry"))
+    }
+    if len(content) == 0 {
+        return nil, fmt.Errorf("Upload file or draw polygon")
+    }
+
+    return ParseGeometry(content)
+}
+
+// providerZoom returns chosen provider and zoom, zoom must be in range
+// supported by provider
+func (h *HandlerArea) providerZoom(r *http.Request) (Provider, int, error) {
+    var provider Provider
+    var exists bool
+    if name := r.FormValue("provider"); len(name) > 0 {
+        provider, exists = h.providers.Get(name)
+    } else {
+        provider, exists = h.providers.Default()
+    }
+    if !exists {
+        return provider, 0, fmt.Errorf("Unknown provider: %s", r.FormValue("provider"))
+    }
+
+    zoom, err := strconv.Atoi(r.FormValue("zoom"))
+    if err != nil {
+        return provider, 0, fmt.Errorf("Cannot parse zoom: %s", err)
+    }
+    if zoom < provider.MinZoom || zoom > provider.MaxZoom {
+        return provider, 0, fmt.Errorf("Zoom %d is out of range %d-%d of provider %s", zoom, provider.MinZoom, provider.MaxZoom, provider.Name)
+    }
+
+    return provider, zoom, nil
+}
+
+// inputParams computes tile range covering area, area must not cover more
+// than AREA_MAX_TILES tiles
+func (h *HandlerArea) inputParams(r *http.Request, provider Provider, zoom int, area *Geometry) (*InputParams, error) {
+    mask := r.FormValue("mask")
+    if mask != MASK_NONE && mask != MASK_TRANSPARENT && mask != MASK_FADE {
+        return nil, fmt.Errorf("Unknown mask: %s", mask)
+    }
+    if mask != MASK_NONE && len(area.Rings) == 0 {
+        return nil, fmt.Errorf("Only polygons can be masked, area has none")
+    }
+
+    ip, err := bboxToInputParams(provider, zoom, area.Bounds())
+    if err != nil {
+        return nil, err
+    }
+    ip.Area = area
+    ip.Mask = mask
+    ip.Format = r.FormValue("format")
+    ip.Normalize()
+
+    if ip.TilesCount() > AREA_MAX_TILES {
+        return nil, fmt.Errorf("Area covers %d tiles at zoom %d, limit is %d tiles (choose lower zoom)", ip.TilesCount(), ip.Zoom, AREA_MAX_TILES)
+    }
+    if err = ip.validate(); err != nil {
+        return nil, err
+    }
+
+    h.log.Debugf("Area params: zoom %d, x %d-%d, y %d-%d, mask %q", ip.Zoom, ip.XMin, ip.XMax, ip.YMin, ip.YMax, ip.Mask)
+
+    return &ip, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+    "bytes"
+    "mime/multipart"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strings"
+    "testing"
+    "github.com/op/go-logging"
+)
+
+func TestHandlerArea(t *testing.T) {
+    q, cleanup := newTestQueue(t, 0)
+    defer cleanup()
+
+    log := logging.MustGetLogger("test")
+    providers := NewProviders(map[string]Provider{"a": Provider{Name: "a", MinZoom: 0, MaxZoom: 18, Scale: 256}})
+    handler := &HandlerArea{log, providers, q}
+
+    // drawn polygon
+    form := url.Values{}
+    form.Set("geometry", `{"type": "Polygon", "coordinates": [[[14.2, 49.9], [14.7, 49.9], [14.7, 50.2], [14.2, 49.9]]]}`)
+    form.Set("zoom", "10")
+    form.Set("mask", MASK_FADE)
+    r := httptest.NewRequest(http.MethodPost, "/area", strings.NewReader(form.Encode()))
+    r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    w := httptest.NewRecorder()
+    handler.ServeHTTP(w, r)
+    Equals(t, http.StatusOK, w.Code)
+
+    requests, err := q.store.List()
+    Ok(t, err)
+    Equals(t, 1, len(requests))
+    ip := requests[0].Params
+    Equals(t, []int{10, 552, 346, 553, 347}, []int{ip.Zoom, ip.XMin, ip.YMin, ip.XMax, ip.YMax})
+    Equals(t, MASK_FADE, ip.Mask)
+    Equals(t, 1, len(ip.Area.Rings))
+
+    // uploaded track cannot be masked
+    var body bytes.Buffer
+    mw := multipart.NewWriter(&body)
+    fw, _ := mw.CreateFormFile("file", "trail.gpx")
+    fw.Write([]byte(`<gpx><trk><trkseg><trkpt lat="50.0" lon="14.2"/><trkpt lat="50.2" lon="14.5"/></trkseg></trk></gpx>`))
+    mw.WriteField("zoom", "12")
+    mw.WriteField("mask", MASK_TRANSPARENT)
+    mw.Close()
+    r = httptest.NewRequest(http.MethodPost, "/area", &body)
+    r.Header.Set("Content-Type", mw.FormDataContentType())
+    w = httptest.NewRecorder()
+    handler.ServeHTTP(w, r)
+    Equals(t, http.StatusBadRequest, w.Code)
+
+    // nothing to enqueue
+    r = httptest.NewRequest(http.MethodPost, "/area", strings.NewReader("zoom=10"))
+    r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    w = httptest.NewRecorder()
+    handler.ServeHTTP(w, r)
+    Equals(t, http.StatusBadRequest, w.Code)
+
+    // zoom out of range of provider and area covering too many tiles
+    for _, zoom := range []string{"2000000000", "-1", "19", "18"} {
+        form.Set("zoom", zoom)
+        r = httptest.NewRequest(http.MethodPost, "/area", strings.NewReader(form.Encode()))
+        r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+        w = httptest.NewRecorder()
+        handler.ServeHTTP(w, r)
+        Equals(t, http.StatusBadRequest, w.Code)
+    }
+
+    requests, err = q.store.List()
+    Ok(t, err)
+    Equals(t, 1, len(requests))
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+    "fmt"
+    "html/template"
+    "io/ioutil"
+    "net/http"
+    "github.com/op/go-logging"
+)
+
+// max size of uploaded manifest
+const BATCH_MANIFEST_MAX_SIZE = 1 << 20
+
+type tplBatchEntry struct {
+    Name string
+    QueueRequest *QueueRequest
+}
+
+type tplBatch struct {
+    Batch *Batch
+    Entries []tplBatchEntry
+    Finished bool
+}
+
+type HandlerBatch struct {
+    log *logging.Logger
+    providers *Providers
+    queue *Queue
+}
+
+func (h *HandlerBatch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+    h.log.Debugf("Processing request, path: %s", r.URL.Path)
+
+    if r.URL.Path == "/batch" && r.Method == http.MethodPost {
+        h.upload(w, r)
+        return
+    }
+
+    // check http method, GET is required
+    if r.Method != http.MethodGet {
+        WriteErrorResponse(w, http.StatusMethodNotAllowed, fmt.Errorf("Only GET and POST methods are allowed"))
+        return
+    }
+
+    batch, err := h.queue.GetBatch(r.URL.Query().Get("id"))
+    if err != nil {
+        WriteErrorResponse(w, http.StatusInternalServerError, fmt.Errorf("Fetching batch failed: %s", err))
+        return
+    }
+    if user := requestUser(r); batch != nil && user != nil && !user.CanAccess(batch.Owner) {
+        batch = nil
+    }
+    if batch == nil {
+        WriteErrorResponse(w, http.StatusNotFound, fmt.Errorf("Batch not found"))
+        return
+    }
+
+    requests, err := h.queue.BatchRequests(batch)
+    if err != nil {
+        WriteErrorResponse(w, http.StatusInternalServerError, fmt.Errorf("Fetching batch requests failed: %s", err))
+        return
+    }
+
+    data := tplBatch{Batch: batch, Finished: true}
+    for i, e := range batch.Entries {
+        data.Entries = append(data.Entries, tplBatchEntry{e.Name, requests[i]})
+        if requests[i] != nil && requests[i].State == QUEUE_REQUEST_STATE_NEW {
+            data.Finished = false
+        }
+    }
+
+    switch r.URL.Path {
+    case "/batch":
+        tmpl := template.Must(template.ParseFiles("html/base.html", "html/batch.html"))
+        w.Header().Set("Content-Type", "text/html; charset=utf-8")
+        if err = tmpl.Execute(w, data); err != nil {
+            w.Write([]byte(fmt.Sprintf("Rendering error: %s", err)))
+        }
+    case "/batch/zip":
+        if !data.Finished {
+            WriteErrorResponse(w, http.StatusConflict, fmt.Errorf("Batch is not finished yet"))
+            return
+        }
+        w.Header().Set("Content-Type", "application/zip")
+        w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"batch-%s.zip\"", batch.Id))
+        if err = h.queue.writeBatchZip(w, batch, requests); err != nil {
+            h.log.Errorf("Writing zip of batch %s failed: %s", batch.Id, err)
+        }
+    default:
+        WriteErrorResponse(w, http.StatusNotFound, fmt.Errorf("Only /batch and /batch/zip paths are supported"))
+    }
+}
+
+// upload enqueues manifest sent as multipart form file "manifest"
+func (h *HandlerBatch) upload(w http.ResponseWriter, r *http.Request) {
+
+    r.Body = http.MaxBytesReader(w, r.Body, BATCH_MANIFEST_MAX_SIZE)
+
+    file, header, err := r.FormFile("manifest")
+    if err != nil {
+        WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("Cannot read manifest: %s", err))
+        return
+    }
+    defer file.Close()
+
+    content, err := ioutil.ReadAll(file)
+    if err != nil {
+        WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("Cannot read manifest: %s", err))
+        return
+    }
+
+    rows, err := parseBatchManifest(content, detectBatchFormat(header.Filename, content))
+    if err != nil {
+        WriteErrorResponse(w, http.StatusBadRequest, err)
+        return
+    }
+
+    ips, err := BatchInputParams(rows, h.providers)
+    if err != nil {
+        WriteErrorResponse(w, http.StatusBadRequest, err)
+        return
+    }
+
+    options, err := enqueueOptions(r, h.queue.config.MaxClientPriority)
+    if err != nil {
+        WriteErrorResponse(w, http.StatusBadRequest, err)
+        return
+    }
+
+    batch, err := h.queue.EnqueueBatch(rows, ips, options)
+    if err != nil {
+        h.log.Error(err)
+        WriteErrorResponse(w, http.StatusInternalServerError, fmt.Errorf("Cannot enqueue batch: %s", err))
+        return
+    }
+
+    http.Redirect(w, r, "/batch?id=" + batch.Id, http.StatusSeeOther)
+}
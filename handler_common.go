@@ -1,7 +1,10 @@
 package main
 
 import (
+    "crypto/sha256"
+    "encoding/hex"
     "fmt"
+    "net"
     "net/http"
     "net/url"
     "strconv"
@@ -15,6 +18,157 @@ type InputParams struct {
     YMax int
     Scale int
     Provider Provider
+    Format string
+    // area of interest (optional), image area outside of its polygons is
+    // masked unless mask is empty
+    Area *Geometry
+    Mask string
+    // GPX drawn onto image (optional)
+    Overlay *Overlay
+    // graticule and UTM grid drawn onto image (optional)
+    Grid *Grid
+    // title, scale bar and attribution drawn onto image (optional)
+    Cartouche *Cartouche
+}
+
+// Normalize fits zoom and tile range into limits given by provider
+// and zoom level (tiles 0 .. 2^zoom - 1 in both directions)
+func (ip *InputParams) Normalize() {
+    ip.Zoom = IntMax(IntMin(ip.Provider.MaxZoom, ip.Zoom), ip.Provider.MinZoom)
+    zoom2 := IntPow2(ip.Zoom)
+
+    ip.XMin = IntMax(0, ip.XMin)
+    ip.YMin = IntMax(0, ip.YMin)
+    ip.XMax = IntMin(zoom2 - 1, ip.XMax)
+    ip.YMax = IntMin(zoom2 - 1, ip.YMax)
+
+    if ip.XMax < ip.XMin { ip.XMax = ip.XMin }
+    if ip.YMax < ip.YMin { ip.YMax = ip.YMin }
+
+    if ip.Format != IMAGE_FORMAT_JPEG {
+        ip.Format = IMAGE_FORMAT_PNG
+    }
+
+    // only polygons can be masked
+    if (ip.Mask != MASK_TRANSPARENT && ip.Mask != MASK_FADE) || ip.Area == nil || len(ip.Area.Rings) == 0 {
+        ip.Mask = MASK_NONE
+    }
+}
+
+// TilesCount returns number of tiles covered by params
+func (ip *InputParams) TilesCount() int {
+    return (ip.XMax - ip.XMin + 1) * (ip.YMax - ip.YMin + 1)
+}
+
+// ImageSize returns size of stitched image in pixels
+func (ip *InputParams) ImageSize() (int, int) {
+    return (ip.XMax - ip.XMin + 1) * ip.Scale, (ip.YMax - ip.YMin + 1) * ip.Scale
+}
+
+// OutputSize returns size of generated image in pixels, stitched image
+// with margins of grid labels
+func (ip *InputParams) OutputSize() (int, int) {
+    width, height := ip.ImageSize()
+    mx, my := ip.Grid.Margins()
+    return width + 2 * mx, height + 2 * my
+}
+
+// validScale checks scale requested for provider, tiles can be upscaled
+// at most by the same factor as fetched tiles are accepted
+func validScale(p Provider, scale int) error {
+    if limit := p.Scale * TILE_MAX_SCALE_FACTOR; scale < 1 || scale > limit {
+        return fmt.Errorf("Scale must be between 1 and %d", limit)
+    }
+    return nil
+}
+
+// validate checks scale and size of generated image, so image too big to
+// be allocated is refused before any tile is fetched
+func (ip *InputParams) validate() error {
+    if err := validScale(ip.Provider, ip.Scale); err != nil {
+        return err
+    }
+    width, height := ip.OutputSize()
+    if int64(width) * int64(height) > IMAGE_MAX_PIXELS {
+        return fmt.Errorf("Image size %dx%d exceeds limit of %d pixels (choose lower zoom or scale)", width, height, IMAGE_MAX_PIXELS)
+    }
+    return nil
+}
+
+// Key returns canonical key of job - hash of all params which affect
+// generated image. Provider attributes not affecting tiles (attribution,
+// subdomains, zoom limits) are not part of the key
+func (ip *InputParams) Key() string {
+    canonical := fmt.Sprintf("%s\n%s\n%d\n%d,%d,%d,%d\n%d\n%d\n%s",
+        ip.Provider.Name,
+        ip.Provider.Url,
+        ip.Zoom,
+        ip.XMin, ip.YMin, ip.XMax, ip.YMax,
+        ip.Provider.Scale,
+        ip.Scale,
+        ip.Format)
+    // keys of requests without area are the same as before areas existed
+    if ip.Area != nil {
+        canonical += fmt.Sprintf("\n%s\n%s", ip.Area.Hash(), ip.Mask)
+    }
+    if ip.Overlay != nil {
+        canonical += fmt.Sprintf("\noverlay %s", ip.Overlay.Hash())
+    }
+    if ip.Grid != nil {
+        canonical += fmt.Sprintf("\ngrid %s", ip.Grid.Hash())
+    }
+    if ip.Cartouche != nil {
+        canonical += fmt.Sprintf("\ncartouche %s", ip.Cartouche.Hash())
+    }
+    hash := sha256.Sum256([]byte(canonical))
+    return hex.EncodeToString(hash[:])
+}
+
+// clientAddress returns ip address of client (without port)
+func clientAddress(r *http.Request) string {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return host
+}
+
+// enqueueOptions returns attributes of request to be enqueued, priority
+// chosen by client is limited by maxPriority. Authenticated admins can
+// choose any priority, other users can't raise it above normal
+func enqueueOptions(r *http.Request, maxPriority int) (EnqueueOptions, error) {
+    user := requestUser(r)
+    if user != nil && len(user.Name) > 0 {
+        if user.Admin() {
+            maxPriority = QUEUE_PRIORITY_HIGH
+        } else {
+            maxPriority = IntMin(maxPriority, QUEUE_PRIORITY_NORMAL)
+        }
+    }
+
+    validity, err := ParseValidity(r.FormValue("validity"))
+    if err != nil {
+        return EnqueueOptions{}, err
+    }
+    callback := r.FormValue("callback")
+    if len(callback) > 0 {
+        if err := validateWebhookUrl(callback); err != nil {
+            return EnqueueOptions{}, err
+        }
+    }
+    options := EnqueueOptions{
+        Submitter: clientAddress(r),
+        Priority: IntMin(ParsePriority(r.FormValue("priority")), maxPriority),
+        MaxPriority: maxPriority,
+        Validity: validity,
+        Callback: callback,
+    }
+    // authenticated users are scheduled fairly even if they share address
+    if user != nil && len(user.Name) > 0 {
+        options.Submitter = user.Name
+        options.Owner = user.Name
+    }
+    return options, nil
 }
 
 func WriteErrorResponse(w http.ResponseWriter, status int, err error) {
@@ -50,6 +204,7 @@ func getMapUrl(base url.URL, zoom, xmin, ymin, xmax, ymax int, provider string,
     q.Set("ymin", strconv.Itoa(ymin))
     q.Set("xmax", strconv.Itoa(xmax))
     q.Set("ymax", strconv.Itoa(ymax))
+    q.Set("provider", provider)
     base.RawQuery = q.Encode()
 
     return base.String()
@@ -62,6 +217,7 @@ func getStitcherUrl(base url.URL, ip *InputParams) string {
     q.Set("ymin", strconv.Itoa(ip.YMin))
     q.Set("xmax", strconv.Itoa(ip.XMax))
     q.Set("ymax", strconv.Itoa(ip.YMax))
+    q.Set("provider", ip.Provider.Name)
     base.RawQuery = q.Encode()
     base.Path = "stitcher"
 
@@ -0,0 +1,45 @@
+package main
+
+import (
+    "net/http"
+    "strings"
+    "github.com/op/go-logging"
+)
+
+// HandlerDownload serves generated images for signed download links
+// (/download/<token>/<image name>), see Links
+type HandlerDownload struct {
+    log *logging.Logger
+    queue *Queue
+}
+
+func (h *HandlerDownload) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+    parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/download/"), "/")
+    if len(parts) != 2 {
+        http.NotFound(w, r)
+        return
+    }
+
+    request, err := h.queue.Download(parts[0])
+    if err != nil {
+        h.log.Debugf("Download rejected: %s", err)
+        http.NotFound(w, r)
+        return
+    }
+
+    // name in link is for browsers, it must match the request anyway
+    name := h.queue.resultName(request)
+    if parts[1] != name {
+        http.NotFound(w, r)
+        return
+    }
+
+    h.log.Debugf("Serving result %s", name)
+
+    // links must not leak from caches or to other sites
+    w.Header().Set("Cache-Control", "private")
+    w.Header().Set("Referrer-Policy", "no-referrer")
+
+    h.queue.results.Serve(w, r, name)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+    "crypto/subtle"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strings"
+    "github.com/op/go-logging"
+)
+
+// extra space for multipart encoding of uploaded image
+const JOBS_UPLOAD_OVERHEAD = 1 << 20
+
+// HandlerJobs is api used by worker processes (see RemoteWorker) to claim
+// requests, extend their leases and upload results. All calls are POST
+// requests authorized by shared token (Authorization: Bearer <token>)
+type HandlerJobs struct {
+    log *logging.Logger
+    queue *Queue
+    token string
+}
+
+func (h *HandlerJobs) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+    if r.Method != http.MethodPost {
+        WriteErrorResponse(w, http.StatusMethodNotAllowed, fmt.Errorf("Only POST method is allowed"))
+        return
+    }
+
+    // api is disabled if there is no token
+    token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+    if len(h.token) == 0 || subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) != 1 {
+        WriteErrorResponse(w, http.StatusUnauthorized, fmt.Errorf("Invalid worker token"))
+        return
+    }
+
+    switch r.URL.Path {
+    case "/api/jobs/claim":
+        h.claim(w, r)
+    case "/api/jobs/heartbeat":
+        h.update(w, r, h.queue.Heartbeat)
+    case "/api/jobs/release":
+        h.update(w, r, h.queue.Release)
+    case "/api/jobs/complete":
+        h.complete(w, r)
+    default:
+        http.NotFound(w, r)
+    }
+}
+
+// claim returns claimed request as json, or no content if queue is empty
+func (h *HandlerJobs) claim(w http.ResponseWriter, r *http.Request) {
+
+    worker := r.FormValue("worker")
+    if len(worker) == 0 {
+        WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("Missing worker name"))
+        return
+    }
+
+    request, err := h.queue.Claim(worker)
+    if err != nil {
+        WriteErrorResponse(w, 500, err)
+        return
+    }
+    if request == nil {
+        w.WriteHeader(http.StatusNoContent)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(request)
+}
+
+// update applies lease operation, lost lease is reported as conflict
+func (h *HandlerJobs) update(w http.ResponseWriter, r *http.Request, operation func(id, worker string) error) {
+    if err := operation(r.FormValue("request"), r.FormValue("worker")); err != nil {
+        WriteErrorResponse(w, http.StatusConflict, err)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// complete stores result uploaded as multipart form: fields request,
+// worker, error (empty for success) and failed_tiles (json) must precede
+// file image (present for success only)
+func (h *HandlerJobs) complete(w http.ResponseWriter, r *http.Request) {
+
+    mr, err := r.MultipartReader()
+    if err != nil {
+        WriteErrorResponse(w, http.StatusBadRequest, err)
+        return
+    }
+
+    fields := make(map[string]string)
+    var imageFile string
+    var request *QueueRequest
+
+    for {
+        part, err := mr.NextPart()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            WriteErrorResponse(w, http.StatusBadRequest, err)
+            return
+        }
+
+        if part.FormName() != "image" {
+            value, err := ioutil.ReadAll(io.LimitReader(part, JOBS_UPLOAD_OVERHEAD))
+            if err != nil {
+                WriteErrorResponse(w, http.StatusBadRequest, err)
+                return
+            }
+            fields[part.FormName()] = string(value)
+            continue
+        }
+
+        request, err = h.queue.GetRequest(fields["request"])
+        if err != nil {
+            WriteErrorResponse(w, 500, err)
+            return
+        }
+        if request == nil {
+            WriteErrorResponse(w, http.StatusNotFound, fmt.Errorf("Request %s not found", fields["request"]))
+            return
+        }
+        if err = checkLease(request, fields["worker"]); err != nil {
+            WriteErrorResponse(w, http.StatusConflict, err)
+            return
+        }
+
+        // image can't be bigger than its estimated size
+        imageFile = filepath.Join(h.queue.scratchDir(request), h.queue.resultName(request))
+        err = receiveFile(imageFile, io.LimitReader(part, estimateRequestSize(&request.Params) + 1), estimateRequestSize(&request.Params))
+        if err != nil {
+            h.queue.removeScratch(request)
+            WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("Cannot receive image of request %s: %s", request.Id, err))
+            return
+        }
+    }
+
+    var failures []TileFailure
+    if len(fields["failed_tiles"]) > 0 {
+        if err := json.Unmarshal([]byte(fields["failed_tiles"]), &failures); err != nil {
+            WriteErrorResponse(w, http.StatusBadRequest, err)
+            return
+        }
+    }
+
+    if len(fields["error"]) == 0 && len(imageFile) == 0 {
+        WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("Missing image"))
+        return
+    }
+
+    err = h.queue.Complete(fields["request"], fields["worker"], imageFile, failures, fields["error"])
+    if request != nil {
+        h.queue.removeScratch(request)
+    }
+    if err != nil {
+        WriteErrorResponse(w, http.StatusConflict, err)
+        return
+    }
+
+    h.log.Infof("Request %s completed by worker %s", fields["request"], fields["worker"])
+
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// receiveFile writes content to file, content longer than limit is rejected
+func receiveFile(fileName string, content io.Reader, limit int64) error {
+
+    if err := os.MkdirAll(filepath.Dir(fileName), os.ModePerm); err != nil {
+        return err
+    }
+
+    f, err := os.Create(fileName)
+    if err != nil {
+        return err
+    }
+
+    n, err := io.Copy(f, content)
+    if closeErr := f.Close(); err == nil {
+        err = closeErr
+    }
+    if err == nil && n > limit {
+        err = fmt.Errorf("File exceeds %d bytes", limit)
+    }
+    if err != nil {
+        os.Remove(fileName)
+    }
+
+    return err
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+    "encoding/base64"
+    "fmt"
+    "html/template"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+    "github.com/op/go-logging"
+)
+
+// cookie keeping state of OIDC login (state, nonce and page to return to)
+const AUTH_OIDC_COOKIE = "bsbigmap_oidc"
+const AUTH_OIDC_LOGIN_DURATION = time.Minute * 10
+
+type tplLogin struct {
+    Next string
+    Error string
+    Local bool
+    OIDC bool
+}
+
+// HandlerLogin handles login form, logout and OIDC login
+// (/login, /logout, /auth/oidc and /auth/callback)
+type HandlerLogin struct {
+    log *logging.Logger
+    auth *Auth
+    // base of OIDC redirect url, derived from request if empty
+    publicUrl string
+}
+
+// localPath returns next page if it is path on this server, so login
+// cannot be used for redirecting to other sites
+func localPath(next string) string {
+    if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+        return "/"
+    }
+    return next
+}
+
+func (h *HandlerLogin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+    h.log.Debugf("Processing request, path: %s", r.URL.Path)
+
+    switch r.URL.Path {
+    case "/login":
+        if r.Method == http.MethodPost {
+            h.login(w, r)
+            return
+        }
+        h.render(w, localPath(r.URL.Query().Get("next")), "")
+    case "/logout":
+        h.auth.clearSession(w)
+        http.Redirect(w, r, "/login", http.StatusSeeOther)
+    case "/auth/oidc":
+        h.oidcLogin(w, r)
+    case "/auth/callback":
+        h.oidcCallback(w, r)
+    default:
+        WriteErrorResponse(w, http.StatusNotFound, fmt.Errorf("Unknown path %s", r.URL.Path))
+    }
+}
+
+func (h *HandlerLogin) render(w http.ResponseWriter, next, message string) {
+    tmpl := template.Must(template.ParseFiles("html/base.html", "html/login.html"))
+
+    w.Header().Set("Content-Type", "text/html; charset=utf-8")
+    if len(message) > 0 {
+        w.WriteHeader(http.StatusUnauthorized)
+    }
+    err := tmpl.Execute(w, tplLogin{next, message, len(h.auth.users) > 0, h.auth.oidc != nil})
+    if err != nil {
+        w.Write([]byte(fmt.Sprintf("Rendering error: %s", err)))
+    }
+}
+
+// login checks credentials of local user sent by login form
+func (h *HandlerLogin) login(w http.ResponseWriter, r *http.Request) {
+    next := localPath(r.FormValue("next"))
+
+    user, err := h.auth.Login(r.FormValue("name"), r.FormValue("password"))
+    if err != nil {
+        h.log.Warningf("Failed login of user %s from %s", r.FormValue("name"), clientAddress(r))
+        h.render(w, next, err.Error())
+        return
+    }
+
+    h.log.Infof("User %s logged in", user.Name)
+    h.auth.setSession(w, r, user)
+    http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// redirectUrl is url where OIDC provider returns user after login
+func (h *HandlerLogin) redirectUrl(r *http.Request) string {
+    if len(h.publicUrl) > 0 {
+        return strings.TrimSuffix(h.publicUrl, "/") + "/auth/callback"
+    }
+    scheme := "http"
+    if r.TLS != nil {
+        scheme = "https"
+    }
+    return scheme + "://" + r.Host + "/auth/callback"
+}
+
+// oidcLogin redirects user to login page of OIDC provider
+func (h *HandlerLogin) oidcLogin(w http.ResponseWriter, r *http.Request) {
+    if h.auth.oidc == nil {
+        WriteErrorResponse(w, http.StatusNotFound, fmt.Errorf("OIDC login is not configured"))
+        return
+    }
+
+    state, err := NewToken()
+    if err != nil {
+        WriteErrorResponse(w, http.StatusInternalServerError, err)
+        return
+    }
+    nonce, err := NewToken()
+    if err != nil {
+        WriteErrorResponse(w, http.StatusInternalServerError, err)
+        return
+    }
+
+    authUrl, err := h.auth.oidc.AuthUrl(h.redirectUrl(r), state, nonce)
+    if err != nil {
+        h.log.Errorf("%s", err)
+        WriteErrorResponse(w, http.StatusBadGateway, fmt.Errorf("OIDC provider is not available"))
+        return
+    }
+
+    value := base64.RawURLEncoding.EncodeToString([]byte(state + "\n" + nonce + "\n" + localPath(r.URL.Query().Get("next"))))
+    http.SetCookie(w, &http.Cookie{
+        Name: AUTH_OIDC_COOKIE,
+        Value: h.auth.sign(value),
+        Path: "/auth/",
+        MaxAge: int(AUTH_OIDC_LOGIN_DURATION.Seconds()),
+        HttpOnly: true,
+        Secure: r.TLS != nil,
+        SameSite: http.SameSiteLaxMode,
+    })
+
+    http.Redirect(w, r, authUrl, http.StatusFound)
+}
+
+// oidcCallback finishes OIDC login, code given by provider is exchanged
+// for id token identifying user
+func (h *HandlerLogin) oidcCallback(w http.ResponseWriter, r *http.Request) {
+    if h.auth.oidc == nil {
+        WriteErrorResponse(w, http.StatusNotFound, fmt.Errorf("OIDC login is not configured"))
+        return
+    }
+
+    fail := func(err error) {
+        h.log.Warningf("OIDC login failed: %s", err)
+        h.render(w, "/", "Login failed")
+    }
+
+    if e := r.URL.Query().Get("error"); len(e) > 0 {
+        fail(fmt.Errorf("provider returned %s", e))
+        return
+    }
+
+    cookie, err := r.Cookie(AUTH_OIDC_COOKIE)
+    if err != nil {
+        fail(fmt.Errorf("missing state cookie"))
+        return
+    }
+    http.SetCookie(w, &http.Cookie{Name: AUTH_OIDC_COOKIE, Value: "", Path: "/auth/", MaxAge: -1})
+
+    value, ok := h.auth.verify(cookie.Value)
+    if !ok {
+        fail(fmt.Errorf("invalid state cookie"))
+        return
+    }
+    decoded, err := base64.RawURLEncoding.DecodeString(value)
+    if err != nil {
+        fail(fmt.Errorf("invalid state cookie"))
+        return
+    }
+    parts := strings.SplitN(string(decoded), "\n", 3)
+    if len(parts) != 3 || parts[0] != r.URL.Query().Get("state") {
+        fail(fmt.Errorf("state doesn't match"))
+        return
+    }
+
+    idToken, err := h.auth.oidc.Exchange(r.URL.Query().Get("code"), h.redirectUrl(r))
+    if err != nil {
+        fail(err)
+        return
+    }
+    claims, err := h.auth.oidc.Verify(idToken, parts[1])
+    if err != nil {
+        fail(err)
+        return
+    }
+    name := oidcUserName(claims)
+    if len(name) == 0 {
+        fail(fmt.Errorf("id token doesn't identify user"))
+        return
+    }
+
+    user := &User{name, h.auth.oidcRole(name)}
+    h.log.Infof("User %s logged in by OIDC", user.Name)
+    h.auth.setSession(w, r, user)
+    http.Redirect(w, r, localPath(parts[2]), http.StatusSeeOther)
+}
+
+// loginUrl returns url of login page which returns user to given page
+func loginUrl(next string) string {
+    return "/login?next=" + url.QueryEscape(next)
+}
@@ -1,12 +1,17 @@
 package main
 
 import (
+    "encoding/json"
     "fmt"
     "html/template"
     "net/http"
+    "net/url"
     "github.com/op/go-logging"
 )
 
+// number of tiles rendered around selected range on map page
+const MAP_VIEW_MARGIN = 2
+
 type MapParams struct {
     UrlExpandRight string
     UrlExpandLeft string
@@ -28,6 +33,7 @@ type MapParams struct {
     UrlZoomOutHalf string
     UrlZoomOutKeep string
 
+    UrlCurrent string
     UrlGeneratePng string
 
     WidthTiles int
@@ -36,86 +42,76 @@ type MapParams struct {
     HeightPx int
 }
 
+// MapView is range of tiles rendered around selected range, position of
+// tiles is relative to top left corner of view
+type MapView struct {
+    XMin int
+    YMin int
+    XMax int
+    YMax int
+    Tiles []Tile
+}
+
 type HtmlImage struct {
     Url string
     Style template.CSS
 }
 
+// ProviderChoice is item of provider dropdown, thumbnail is tile in the
+// middle of current area
+type ProviderChoice struct {
+    Name string
+    Thumbnail string
+    Selected bool
+}
+
 type HtmlMap struct {
     InputParams InputParams
     MapParams MapParams
+    View MapView
     Images []HtmlImage
+    Selection template.CSS
+    ValidityChoices []ValidityChoice
+    ProviderChoices []ProviderChoice
 }
 
-type HandlerMap struct {
-    log *logging.Logger
-    providers map[string]Provider
-}
-
-func (h *HandlerMap) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-    var err error
-
-    h.log.Debugf("Processing request, path: %s", r.URL.Path)
-
-    // check http method, GET is required
-    if r.Method != http.MethodGet {
-        WriteErrorResponse(w, http.StatusMethodNotAllowed, fmt.Errorf("Only GET method is allowed"))
-        return
+// providerChoices returns all providers with thumbnails of given area
+func providerChoices(providers *Providers, ip *InputParams) []ProviderChoice {
+    var choices []ProviderChoice
+    all := providers.All()
+    for _, name := range providers.Names() {
+        p, exists := all[name]
+        if !exists {
+            continue
+        }
+
+        // middle tile at the closest zoom provider supports
+        zoom := IntMax(IntMin(p.MaxZoom, ip.Zoom), p.MinZoom)
+        x, y := (ip.XMin + ip.XMax) / 2, (ip.YMin + ip.YMax) / 2
+        if zoom < ip.Zoom {
+            x, y = x >> uint(ip.Zoom - zoom), y >> uint(ip.Zoom - zoom)
+        } else {
+            x, y = x << uint(zoom - ip.Zoom), y << uint(zoom - ip.Zoom)
+        }
+        tiles := p.getTiles(x, y, x, y, zoom, p.Scale)
+
+        choices = append(choices, ProviderChoice{name, (*tiles)[0].Url, name == ip.Provider.Name})
     }
+    return choices
+}
 
-    // check path, only root is allowed
-    if r.URL.Path != "/map" {
-        h.log.Warningf("Ignoring request to path %s", r.URL.Path)
-        WriteErrorResponse(w, http.StatusNotFound, fmt.Errorf("Only /map path is supported"))
-        return
-    }
-
-    ctx := r.Context()
-    ip := ctx.Value("ip").(*InputParams)
-
-    ////////////////////////////////////
-    // PREPARE MAP DATA
-
+// newMapParams returns size of map and links changing its range
+func newMapParams(urlBase url.URL, ip *InputParams) MapParams {
     mp := MapParams{}
 
-    urlBase := *r.URL
-    urlBase.Scheme = "http"
-    urlBase.Host = r.Host
-    urlBase.Path = r.URL.Path
-
-    // normallization of input parameters
-    ip.Zoom = IntMax(IntMin(ip.Provider.MaxZoom, ip.Zoom), ip.Provider.MinZoom)
+    // input params are already normalized by HandlerParams
     zoom2 := IntPow2(ip.Zoom)
 
-    h.log.Debugf("Map params before corrections:")
-    h.log.Debugf("  zoom: %d", ip.Zoom)
-    h.log.Debugf("  zoom2: %d", zoom2)
-    h.log.Debugf("  zoom2 - 1: %d", zoom2 - 1)
-    h.log.Debugf("  xmin ymin: %d %d", ip.XMin, ip.YMin)
-    h.log.Debugf("  xmax ymax: %d %d", ip.XMax, ip.YMax)
-
-    ip.XMin = IntMax(0, ip.XMin)
-    ip.YMin = IntMax(0, ip.YMin)
-    h.log.Debugf("mintest %d", IntMin(zoom2 - 1, 73));
-    h.log.Debugf("mintest %d", IntMin(zoom2 - 1, 71));
-    ip.XMax = IntMin(zoom2 - 1, ip.XMax)
-    ip.YMax = IntMin(zoom2 - 1, ip.YMax)
-
-    if ip.XMax < ip.XMin { ip.XMax = ip.XMin }
-    if ip.YMax < ip.YMin { ip.YMax = ip.YMin }
-
     mp.WidthTiles = ip.XMax - ip.XMin + 1
     mp.HeightTiles = ip.YMax - ip.YMin + 1
     mp.WidthPx = mp.WidthTiles * ip.Provider.Scale
     mp.HeightPx = mp.HeightTiles * ip.Provider.Scale
 
-    h.log.Debugf("Map params after corrections:")
-    h.log.Debugf("  zoom: %d", ip.Zoom)
-    h.log.Debugf("  zoom2: %d", zoom2)
-    h.log.Debugf("  zoom2 - 1: %d", zoom2 - 1)
-    h.log.Debugf("  xmin ymin: %d %d", ip.XMin, ip.YMin)
-    h.log.Debugf("  xmax ymax: %d %d", ip.XMax, ip.YMax)
-
     // expand links
     mp.UrlExpandLeft = getMapUrl(urlBase, ip.Zoom, ip.XMin - 1, ip.YMin, ip.XMax, ip.YMax, ip.Provider.Name, ip.XMin == 0)
     mp.UrlExpandRight = getMapUrl(urlBase, ip.Zoom, ip.XMin, ip.YMin, ip.XMax + 1, ip.YMax, ip.Provider.Name, ip.XMax >= zoom2 - 1)
@@ -157,19 +153,76 @@ func (h *HandlerMap) ServeHTTP(w http.ResponseWriter, r *http.Request) {
         ip.Provider.Name,
         ip.Zoom <= ip.Provider.MinZoom)
 
+    mp.UrlCurrent = getMapUrl(urlBase, ip.Zoom, ip.XMin, ip.YMin, ip.XMax, ip.YMax, ip.Provider.Name, false)
     mp.UrlGeneratePng = getStitcherUrl(urlBase, ip)
 
-    data := HtmlMap{InputParams: *ip, MapParams: mp}
+    return mp
+}
+
+// newMapView returns range of tiles rendered on map page, it is selected
+// range surrounded by margin, so editor can drag edges out of selection
+func newMapView(ip *InputParams) MapView {
+    zoom2 := IntPow2(ip.Zoom)
+    view := MapView{
+        XMin: IntMax(0, ip.XMin - MAP_VIEW_MARGIN),
+        YMin: IntMax(0, ip.YMin - MAP_VIEW_MARGIN),
+        XMax: IntMin(zoom2 - 1, ip.XMax + MAP_VIEW_MARGIN),
+        YMax: IntMin(zoom2 - 1, ip.YMax + MAP_VIEW_MARGIN),
+    }
+    view.Tiles = *ip.Provider.getTiles(view.XMin, view.YMin, view.XMax, view.YMax, ip.Zoom, ip.Scale)
+    return view
+}
 
-    // get tiles for current setting
-    tiles := ip.Provider.getTiles(ip.XMin, ip.YMin, ip.XMax, ip.YMax, ip.Zoom, ip.Scale)
+type HandlerMap struct {
+    log *logging.Logger
+    providers *Providers
+    queue *Queue
+}
+
+func (h *HandlerMap) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    var err error
 
-    // loop through all tiles - generate style information
-    for i := 0; i < len(*tiles); i++ {
-        style := fmt.Sprintf("position: absolute; left: %dpx; top: %dpx; width: %dpx; height: %dpx", (*tiles)[i].Left * ip.Scale, (*tiles)[i].Top * ip.Scale, ip.Scale, ip.Scale);
-        data.Images = append(data.Images, HtmlImage{Url: (*tiles)[i].Url, Style: template.CSS(style)})
+    h.log.Debugf("Processing request, path: %s", r.URL.Path)
+
+    // check http method, GET is required
+    if r.Method != http.MethodGet {
+        WriteErrorResponse(w, http.StatusMethodNotAllowed, fmt.Errorf("Only GET method is allowed"))
+        return
+    }
+
+    // check path, only root is allowed
+    if r.URL.Path != "/map" {
+        h.log.Warningf("Ignoring request to path %s", r.URL.Path)
+        WriteErrorResponse(w, http.StatusNotFound, fmt.Errorf("Only /map path is supported"))
+        return
     }
 
+    ctx := r.Context()
+    ip := ctx.Value("ip").(*InputParams)
+
+    ////////////////////////////////////
+    // PREPARE MAP DATA
+
+    urlBase := *r.URL
+    urlBase.Scheme = "http"
+    urlBase.Host = r.Host
+    urlBase.Path = r.URL.Path
+
+    mp := newMapParams(urlBase, ip)
+    view := newMapView(ip)
+
+    data := HtmlMap{InputParams: *ip, MapParams: mp, View: view, ValidityChoices: h.queue.ValidityChoices(), ProviderChoices: providerChoices(h.providers, ip)}
+
+    // loop through all tiles of view - generate style information
+    for i := 0; i < len(view.Tiles); i++ {
+        style := fmt.Sprintf("position: absolute; left: %dpx; top: %dpx; width: %dpx; height: %dpx", view.Tiles[i].Left * ip.Scale, view.Tiles[i].Top * ip.Scale, ip.Scale, ip.Scale);
+        data.Images = append(data.Images, HtmlImage{Url: view.Tiles[i].Url, Style: template.CSS(style)})
+    }
+
+    // selected range within view
+    data.Selection = template.CSS(fmt.Sprintf("left: %dpx; top: %dpx; width: %dpx; height: %dpx",
+        (ip.XMin - view.XMin) * ip.Scale, (ip.YMin - view.YMin) * ip.Scale, mp.WidthPx, mp.HeightPx))
+
     tmpl := template.Must(template.ParseFiles("html/base.html", "html/map.html"))
 
     w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -178,3 +231,38 @@ func (h *HandlerMap) ServeHTTP(w http.ResponseWriter, r *http.Request) {
         w.Write([]byte(fmt.Sprintf("Rendering error: %s", err)))
     }
 }
+
+// MapRange is proposed range normalized by the same rules as range of
+// map page, it is used by editor on map page
+type MapRange struct {
+    InputParams InputParams
+    MapParams MapParams
+    View MapView
+}
+
+// HandlerMapParams returns normalized input params of proposed range (json)
+type HandlerMapParams struct {
+    log *logging.Logger
+}
+
+func (h *HandlerMapParams) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+    h.log.Debugf("Processing request, path: %s", r.URL.Path)
+
+    if r.Method != http.MethodGet {
+        WriteErrorResponse(w, http.StatusMethodNotAllowed, fmt.Errorf("Only GET method is allowed"))
+        return
+    }
+
+    // input params are already normalized by HandlerParams
+    ip := r.Context().Value("ip").(*InputParams)
+
+    // links lead to map page
+    urlBase := *r.URL
+    urlBase.Scheme = "http"
+    urlBase.Host = r.Host
+    urlBase.Path = "/map"
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(MapRange{*ip, newMapParams(urlBase, ip), newMapView(ip)})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "github.com/op/go-logging"
+)
+
+func TestHandlerMapParams(t *testing.T) {
+    log := logging.MustGetLogger("test")
+    providers := NewProviders(map[string]Provider{
+        "a": Provider{Name: "a", MinZoom: 2, MaxZoom: 4, Scale: 256, Url: "http://a/{z}/{x}/{y}.png"},
+    })
+    handler := &HandlerParams{log, providers, &HandlerMapParams{log}}
+
+    get := func(query string) (int, MapRange) {
+        w := httptest.NewRecorder()
+        handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/map/params?" + query, nil))
+        var data MapRange
+        if w.Code == http.StatusOK {
+            Ok(t, json.NewDecoder(w.Body).Decode(&data))
+        }
+        return w.Code, data
+    }
+
+    // range is normalized, view has margin within limits of zoom
+    code, data := get("provider=a&zoom=3&xmin=1&ymin=6&xmax=9&ymax=2")
+    Equals(t, http.StatusOK, code)
+    Equals(t, 3, data.InputParams.Zoom)
+    Equals(t, []int{1, 6, 7, 6}, []int{data.InputParams.XMin, data.InputParams.YMin, data.InputParams.XMax, data.InputParams.YMax})
+    Equals(t, 7 * 256, data.MapParams.WidthPx)
+    Equals(t, []int{0, 4, 7, 7}, []int{data.View.XMin, data.View.YMin, data.View.XMax, data.View.YMax})
+    Equals(t, 8 * 4, len(data.View.Tiles))
+    Equals(t, Tile{1, 2, "http://a/3/1/6.png"}, data.View.Tiles[2 * 8 + 1])
+    Equals(t, true, strings.Contains(data.MapParams.UrlCurrent, "/map?"))
+    Equals(t, "", data.MapParams.UrlExpandRight)
+
+    // zoom is clamped to range of provider
+    _, data = get("provider=a&zoom=10&xmin=0&ymin=0&xmax=1&ymax=1")
+    Equals(t, 4, data.InputParams.Zoom)
+
+    code, _ = get("provider=x&zoom=3")
+    Equals(t, http.StatusBadRequest, code)
+
+    // scale is limited by scale of provider
+    code, _ = get("provider=a&zoom=3&scale=0")
+    Equals(t, http.StatusBadRequest, code)
+    code, _ = get("provider=a&zoom=3&scale=1025")
+    Equals(t, http.StatusBadRequest, code)
+    code, _ = get("provider=a&zoom=3&scale=512")
+    Equals(t, http.StatusOK, code)
+}
@@ -9,7 +9,7 @@ import (
 
 type HandlerParams struct {
     log *logging.Logger
-    providers map[string]Provider
+    providers *Providers
     handler http.Handler
 }
 
@@ -20,20 +20,16 @@ func (h *HandlerParams) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
     ip := InputParams{}
 
-    // provider
+    // choose provider, default one is used if request doesn't name any
+    var exists bool
     providerName := r.URL.Query().Get("provider")
     if len(providerName) == 0 {
-        h.log.Debugf("No provider specified, trying to choose first")
-        for k := range h.providers {
-            providerName = k
-            h.log.Debugf("Choosen provider: %s", providerName)
-            break
-        }
+        ip.Provider, exists = h.providers.Default()
+        h.log.Debugf("No provider specified, using default: %s", ip.Provider.Name)
+    } else {
+        ip.Provider, exists = h.providers.Get(providerName)
     }
-
-    // choose provider
-    var Exists bool
-    if ip.Provider, Exists = h.providers[providerName]; !Exists {
+    if !exists {
         WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("Unknown provider: %s", providerName))
         return
     }
@@ -67,37 +63,21 @@ func (h *HandlerParams) ServeHTTP(w http.ResponseWriter, r *http.Request) {
         w.WriteHeader(400)
         return
     }
+    if err = validScale(ip.Provider, ip.Scale); err != nil {
+        WriteErrorResponse(w, http.StatusBadRequest, err)
+        return
+    }
+
+    // output image format, unknown formats fall back to png
+    ip.Format = r.URL.Query().Get("format")
 
     ////////////////////////////////////
     // PREPARE MAP DATA
 
     // normallization of input parameters
-    ip.Zoom = IntMax(IntMin(ip.Provider.MaxZoom, ip.Zoom), ip.Provider.MinZoom)
-    zoom2 := IntPow2(ip.Zoom)
-
-    h.log.Debugf("Map params before corrections:")
-    h.log.Debugf("  zoom: %d", ip.Zoom)
-    h.log.Debugf("  zoom2: %d", zoom2)
-    h.log.Debugf("  zoom2 - 1: %d", zoom2 - 1)
-    h.log.Debugf("  xmin ymin: %d %d", ip.XMin, ip.YMin)
-    h.log.Debugf("  xmax ymax: %d %d", ip.XMax, ip.YMax)
-
-    ip.XMin = IntMax(0, ip.XMin)
-    ip.YMin = IntMax(0, ip.YMin)
-    h.log.Debugf("mintest %d", IntMin(zoom2 - 1, 73));
-    h.log.Debugf("mintest %d", IntMin(zoom2 - 1, 71));
-    ip.XMax = IntMin(zoom2 - 1, ip.XMax)
-    ip.YMax = IntMin(zoom2 - 1, ip.YMax)
-
-    if ip.XMax < ip.XMin { ip.XMax = ip.XMin }
-    if ip.YMax < ip.YMin { ip.YMax = ip.YMin }
-
-    h.log.Debugf("Map params after corrections:")
-    h.log.Debugf("  zoom: %d", ip.Zoom)
-    h.log.Debugf("  zoom2: %d", zoom2)
-    h.log.Debugf("  zoom2 - 1: %d", zoom2 - 1)
-    h.log.Debugf("  xmin ymin: %d %d", ip.XMin, ip.YMin)
-    h.log.Debugf("  xmax ymax: %d %d", ip.XMax, ip.YMax)
+    h.log.Debugf("Map params before corrections: zoom %d, x %d-%d, y %d-%d", ip.Zoom, ip.XMin, ip.XMax, ip.YMin, ip.YMax)
+    ip.Normalize()
+    h.log.Debugf("Map params after corrections: zoom %d, x %d-%d, y %d-%d", ip.Zoom, ip.XMin, ip.XMax, ip.YMin, ip.YMax)
 
     ctx := r.Context()
 
@@ -4,7 +4,8 @@ import (
     "fmt"
     "html/template"
     "net/http"
-    "path"
+    "strconv"
+    "time"
     "github.com/op/go-logging"
 )
 
@@ -15,6 +16,17 @@ type tplRequest struct {
     HeightTiles int
     WidthPx int
     HeightPx int
+    Priority string
+    // position in queue for new requests
+    Position string
+    ExpiresIn string
+    Shares []tplShare
+}
+
+type tplShare struct {
+    Id string
+    Url string
+    ExpiresIn string
 }
 
 type HandlerQueue struct {
@@ -27,6 +39,18 @@ func (h *HandlerQueue) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
     h.log.Debugf("Processing request, path: %s", r.URL.Path)
 
+    switch r.URL.Path {
+    case "/queue/pin":
+        h.pin(w, r)
+        return
+    case "/queue/share":
+        h.share(w, r)
+        return
+    case "/queue/revoke":
+        h.revoke(w, r)
+        return
+    }
+
     // check http method, GET is required
     if r.Method != http.MethodGet {
         WriteErrorResponse(w, http.StatusMethodNotAllowed, fmt.Errorf("Only GET method is allowed"))
@@ -52,9 +76,22 @@ func (h *HandlerQueue) ServeHTTP(w http.ResponseWriter, r *http.Request) {
         WriteErrorResponse(w, 500, fmt.Errorf("Fetching queue request failed: %s", err))
     }
 
+    positions, err := h.queue.Positions()
+    if err != nil {
+        WriteErrorResponse(w, 500, fmt.Errorf("Fetching queue positions failed: %s", err))
+        return
+    }
+
+    user := requestUser(r)
+
     var tplData []tplRequest
     for _, r := range requests {
 
+        // users see only their own requests
+        if user != nil && !user.CanAccess(r.Owner) {
+            continue
+        }
+
         // if request id was specify, filter requests
         if len(request) != 0 {
             if request != r.Id {
@@ -64,11 +101,40 @@ func (h *HandlerQueue) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
         tr := tplRequest{
             r,
-            path.Join(h.queue.dir, GetImageFileName(r.Id)),
+            "",
             r.Params.XMax - r.Params.XMin,
             r.Params.YMax - r.Params.YMin,
             (r.Params.XMax - r.Params.XMin) * r.Params.Scale,
             (r.Params.YMax - r.Params.YMin) * r.Params.Scale,
+            PriorityName(r.Priority),
+            "",
+            "pinned",
+            nil,
+        }
+
+        if r.State == QUEUE_REQUEST_STATE_DONE {
+            tr.Url = h.queue.OwnerUrl(r)
+            for i := range r.Shares {
+                share := &r.Shares[i]
+                if share.Expires > time.Now().Unix() {
+                    tr.Shares = append(tr.Shares, tplShare{share.Id, h.queue.ShareUrl(r, share), FormatDuration(time.Until(time.Unix(share.Expires, 0)))})
+                }
+            }
+        }
+
+        if !r.Pinned {
+            tr.ExpiresIn = FormatDuration(time.Until(time.Unix(r.Expires, 0)))
+        }
+
+        if position, exists := positions[r.Id]; exists {
+            if position == 0 {
+                tr.Position = "processing"
+                if len(r.Worker) > 0 {
+                    tr.Position += " (" + r.Worker + ")"
+                }
+            } else {
+                tr.Position = strconv.Itoa(position)
+            }
         }
 
         tplData = append(tplData, tr)
@@ -82,3 +148,85 @@ func (h *HandlerQueue) ServeHTTP(w http.ResponseWriter, r *http.Request) {
         w.Write([]byte(fmt.Sprintf("Rendering error: %s", err)))
     }
 }
+
+// pin pins or unpins request, form values are request id and pin (0 or 1)
+func (h *HandlerQueue) pin(w http.ResponseWriter, r *http.Request) {
+
+    if r.Method != http.MethodPost {
+        WriteErrorResponse(w, http.StatusMethodNotAllowed, fmt.Errorf("Only POST method is allowed"))
+        return
+    }
+
+    id := r.FormValue("request")
+    if !h.canAccess(r, id) {
+        WriteErrorResponse(w, http.StatusNotFound, fmt.Errorf("Request %s not found", id))
+        return
+    }
+    if err := h.queue.Pin(id, r.FormValue("pin") == "1"); err != nil {
+        WriteErrorResponse(w, http.StatusConflict, err)
+        return
+    }
+
+    http.Redirect(w, r, "/queue", http.StatusSeeOther)
+}
+
+// share creates download link of request, form values are request id and
+// validity of link (e.g. 1h or 7d)
+func (h *HandlerQueue) share(w http.ResponseWriter, r *http.Request) {
+
+    if r.Method != http.MethodPost {
+        WriteErrorResponse(w, http.StatusMethodNotAllowed, fmt.Errorf("Only POST method is allowed"))
+        return
+    }
+
+    id := r.FormValue("request")
+    if !h.canAccess(r, id) {
+        WriteErrorResponse(w, http.StatusNotFound, fmt.Errorf("Request %s not found", id))
+        return
+    }
+
+    validity, err := ParseValidity(r.FormValue("validity"))
+    if err != nil {
+        WriteErrorResponse(w, http.StatusBadRequest, err)
+        return
+    }
+
+    if _, err := h.queue.CreateShare(id, validity); err != nil {
+        WriteErrorResponse(w, http.StatusConflict, err)
+        return
+    }
+
+    http.Redirect(w, r, "/queue?request=" + id, http.StatusSeeOther)
+}
+
+// revoke removes download link, form values are request id and share id
+func (h *HandlerQueue) revoke(w http.ResponseWriter, r *http.Request) {
+
+    if r.Method != http.MethodPost {
+        WriteErrorResponse(w, http.StatusMethodNotAllowed, fmt.Errorf("Only POST method is allowed"))
+        return
+    }
+
+    id := r.FormValue("request")
+    if !h.canAccess(r, id) {
+        WriteErrorResponse(w, http.StatusNotFound, fmt.Errorf("Request %s not found", id))
+        return
+    }
+
+    if err := h.queue.RevokeShare(id, r.FormValue("share")); err != nil {
+        WriteErrorResponse(w, http.StatusNotFound, err)
+        return
+    }
+
+    http.Redirect(w, r, "/queue?request=" + id, http.StatusSeeOther)
+}
+
+// canAccess checks if caller can manage request of given id
+func (h *HandlerQueue) canAccess(r *http.Request, id string) bool {
+    request, err := h.queue.GetRequest(id)
+    if err != nil || request == nil {
+        return false
+    }
+    user := requestUser(r)
+    return user == nil || user.CanAccess(request.Owner)
+}
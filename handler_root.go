@@ -10,7 +10,21 @@ import (
 
 type HandlerRoot struct {
     log *logging.Logger
-    providers map[string]Provider
+    providers *Providers
+}
+
+type tplRoot struct {
+    Providers map[string]Provider
+    Default string
+}
+
+// data returns providers and name of default provider for templates
+func (h *HandlerRoot) data() tplRoot {
+    data := tplRoot{Providers: h.providers.All()}
+    if p, exists := h.providers.Default(); exists {
+        data.Default = p.Name
+    }
+    return data
 }
 
 func (h *HandlerRoot) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -34,17 +48,19 @@ func (h *HandlerRoot) ServeHTTP(w http.ResponseWriter, r *http.Request) {
     */
 
     if r.URL.Path == "/map.js" {
-        data := h.providers
         tmpl := ttemplate.Must(ttemplate.ParseFiles("js/map.js"))
         w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
-        err = tmpl.Execute(w, data)
+        err = tmpl.Execute(w, h.data())
         if err != nil {
             w.Write([]byte(fmt.Sprintf("Rendering error: %s", err)))
         }
+    } else if r.URL.Path == "/editor.js" {
+        w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+        http.ServeFile(w, r, "js/editor.js")
     } else if r.URL.Path == "/" {
         tmpl := template.Must(template.ParseFiles("html/base.html", "html/index.html"))
         w.Header().Set("Content-Type", "text/html; charset=utf-8")
-        err = tmpl.Execute(w, nil)
+        err = tmpl.Execute(w, h.data())
         if err != nil {
             w.Write([]byte(fmt.Sprintf("Rendering error: %s", err)))
         }
@@ -3,13 +3,70 @@ package main
 import (
     "fmt"
     "html/template"
+    "io/ioutil"
     "net/http"
     "github.com/op/go-logging"
 )
 
+// max size of uploaded GPX overlay
+const OVERLAY_MAX_SIZE = 10 << 20
+
+// readOverlay parses GPX uploaded as file "gpx" with style given by fields
+// track_color, track_width and track_opacity, nil is returned if there is
+// no file
+func readOverlay(r *http.Request) (*Overlay, error) {
+    file, _, err := r.FormFile("gpx")
+    if err == http.ErrMissingFile || err == http.ErrNotMultipart {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, fmt.Errorf("Cannot read GPX: %s", err)
+    }
+    defer file.Close()
+
+    content, err := ioutil.ReadAll(file)
+    if err != nil {
+        return nil, fmt.Errorf("Cannot read GPX: %s", err)
+    }
+    if len(content) == 0 {
+        return nil, nil
+    }
+
+    overlay, err := ParseOverlay(content)
+    if err != nil {
+        return nil, err
+    }
+    if err = overlay.SetStyle(r.FormValue("track_color"), r.FormValue("track_width"), r.FormValue("track_opacity")); err != nil {
+        return nil, err
+    }
+    return overlay, nil
+}
+
+// readGrid parses grid options given by fields graticule, utm_grid,
+// grid_labels and dpi, nil is returned if no grid is enabled
+func readGrid(r *http.Request, ip *InputParams) (*Grid, error) {
+    grid, err := ParseGrid(r.FormValue("graticule"), r.FormValue("utm_grid"), len(r.FormValue("grid_labels")) > 0, r.FormValue("dpi"))
+    if err != nil || grid == nil {
+        return nil, err
+    }
+    if err = grid.validate(ip); err != nil {
+        return nil, err
+    }
+    return grid, nil
+}
+
+// readCartouche parses cartouche options given by fields cartouche, title,
+// units and dpi, nil is returned if cartouche is not enabled
+func readCartouche(r *http.Request, ip *InputParams) (*Cartouche, error) {
+    if len(r.FormValue("cartouche")) == 0 {
+        return nil, nil
+    }
+    return ParseCartouche(r.FormValue("title"), r.FormValue("units"), r.FormValue("dpi"), ip.Provider)
+}
+
 type HandlerStitcher struct {
     log *logging.Logger
-    providers map[string]Provider
+    providers *Providers
     queue *Queue
 }
 
@@ -18,9 +75,9 @@ func (h *HandlerStitcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
     h.log.Debugf("Processing request, path: %s", r.URL.Path)
 
-    // check http method, GET is required
-    if r.Method != http.MethodGet {
-        WriteErrorResponse(w, http.StatusMethodNotAllowed, fmt.Errorf("Only GET method is allowed"))
+    // check http method, GET or POST (form on map page) is required
+    if r.Method != http.MethodGet && r.Method != http.MethodPost {
+        WriteErrorResponse(w, http.StatusMethodNotAllowed, fmt.Errorf("Only GET and POST methods are allowed"))
         return
     }
 
@@ -37,11 +94,47 @@ func (h *HandlerStitcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
     // get input parameters
     ip := ctx.Value("ip").(*InputParams)
 
-    request, err := h.queue.Enqueue(ip)
+    // optional GPX overlay uploaded by map page form
+    r.Body = http.MaxBytesReader(w, r.Body, OVERLAY_MAX_SIZE)
+    overlay, err := readOverlay(r)
+    if err != nil {
+        WriteErrorResponse(w, http.StatusBadRequest, err)
+        return
+    }
+    grid, err := readGrid(r, ip)
+    if err != nil {
+        WriteErrorResponse(w, http.StatusBadRequest, err)
+        return
+    }
+    cartouche, err := readCartouche(r, ip)
+    if err != nil {
+        WriteErrorResponse(w, http.StatusBadRequest, err)
+        return
+    }
+    if overlay != nil || grid != nil || cartouche != nil {
+        params := *ip
+        params.Overlay = overlay
+        params.Grid = grid
+        params.Cartouche = cartouche
+        ip = &params
+    }
+    if err = ip.validate(); err != nil {
+        WriteErrorResponse(w, http.StatusBadRequest, err)
+        return
+    }
+
+    options, err := enqueueOptions(r, h.queue.config.MaxClientPriority)
+    if err != nil {
+        WriteErrorResponse(w, http.StatusBadRequest, err)
+        return
+    }
+
+    request, err := h.queue.Enqueue(ip, options)
     if err != nil {
         e := fmt.Errorf("Cannot enqueue: %s", err)
         h.log.Error(err)
         WriteErrorResponse(w, 500, e)
+        return
     }
 
     tmpl := template.Must(template.ParseFiles("html/base.html", "html/stitcher.html"))
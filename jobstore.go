@@ -0,0 +1,133 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "github.com/op/go-logging"
+)
+
+const JOB_STORE_FILE = "file"
+const JOB_STORE_BOLT = "bolt"
+
+// JobStore keeps queue requests. Implementations must write requests
+// atomically (reader never sees partially written request) and must
+// provide lookups by job key, state, creation and expiration time without
+// parsing all requests. Lists are ordered by creation time (oldest first) unless
+// stated otherwise
+type JobStore interface {
+    // Put creates new or replaces existing request
+    Put(request *QueueRequest) error
+
+    // Get returns request of given id or nil if it doesn't exist
+    Get(id string) (*QueueRequest, error)
+
+    // GetByKey returns request of given job key or nil if there is no
+    // such request. There can be more requests with the same key (enqueued
+    // by versions without keys), the one with the smallest id is returned
+    GetByKey(key string) (*QueueRequest, error)
+
+    Delete(id string) error
+
+    List() ([]*QueueRequest, error)
+
+    ListByState(state string) ([]*QueueRequest, error)
+
+    // ListExpired returns not pinned requests expiring before given unix
+    // time, ordered by expiration
+    ListExpired(now int64) ([]*QueueRequest, error)
+
+    // Refresh reads requests changed by other processes, it is called
+    // periodically by queue
+    Refresh() error
+
+    Close() error
+}
+
+// writeFileAtomic writes data to temporary file which is then renamed
+// to final name, so the file is either complete or it doesn't exist
+func writeFileAtomic(fileName string, data []byte) error {
+    return writeFileAtomicFunc(fileName, func(w io.Writer) error {
+        _, err := w.Write(data)
+        return err
+    })
+}
+
+// writeFileAtomicFunc is writeFileAtomic for content written by function
+// (e.g. encoded image, which is not kept in memory)
+func writeFileAtomicFunc(fileName string, write func(w io.Writer) error) error {
+
+    tmp, err := ioutil.TempFile(filepath.Dir(fileName), "." + filepath.Base(fileName) + ".tmp")
+    if err != nil {
+        return err
+    }
+
+    if err = write(tmp); err == nil {
+        err = tmp.Sync()
+    }
+    if closeErr := tmp.Close(); err == nil {
+        err = closeErr
+    }
+    if err == nil {
+        err = os.Chmod(tmp.Name(), 0644)
+    }
+    if err == nil {
+        err = os.Rename(tmp.Name(), fileName)
+    }
+    if err != nil {
+        os.Remove(tmp.Name())
+    }
+
+    return err
+}
+
+// migrateJobs imports all requests from one store to another, imported
+// requests are deleted from source store
+func migrateJobs(log *logging.Logger, from, to JobStore) error {
+
+    requests, err := from.List()
+    if err != nil {
+        return err
+    }
+
+    for _, r := range requests {
+        if err := to.Put(r); err != nil {
+            return fmt.Errorf("Migration of request %s failed: %s", r.Id, err)
+        }
+        if err := from.Delete(r.Id); err != nil {
+            return fmt.Errorf("Migration of request %s failed: %s", r.Id, err)
+        }
+        log.Infof("Request %s migrated", r.Id)
+    }
+
+    return nil
+}
+
+// OpenJobStore opens store of given kind in queue directory. Bolt store
+// imports requests stored as json files (e.g. by previous versions)
+func OpenJobStore(log *logging.Logger, kind, dir string) (JobStore, error) {
+
+    fileStore, err := NewFileJobStore(log, dir)
+    if err != nil {
+        return nil, err
+    }
+
+    switch kind {
+    case JOB_STORE_FILE:
+        return fileStore, nil
+    case JOB_STORE_BOLT:
+        boltStore, err := NewBoltJobStore(filepath.Join(dir, BOLT_JOB_STORE_FILE))
+        if err != nil {
+            return nil, err
+        }
+        if err = migrateJobs(log, fileStore, boltStore); err != nil {
+            boltStore.Close()
+            return nil, err
+        }
+        return boltStore, nil
+    }
+
+    return nil, fmt.Errorf("Unknown job store: %s", kind)
+}
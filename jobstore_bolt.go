@@ -0,0 +1,259 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "encoding/json"
+    "fmt"
+    "time"
+    bolt "go.etcd.io/bbolt"
+)
+
+const BOLT_JOB_STORE_FILE = "queue.db"
+
+// how long to wait for lock of database file held by other process
+const BOLT_JOB_STORE_TIMEOUT = time.Second * 2
+
+var boltBucketJobs = []byte("jobs")
+
+// index keys are created (8 bytes, big endian) + id
+var boltBucketByCreated = []byte("by-created")
+
+// index keys are state + 0 + created (8 bytes, big endian) + id
+var boltBucketByState = []byte("by-state")
+
+// index keys are expires (8 bytes, big endian) + id, pinned requests
+// are not indexed
+var boltBucketByExpires = []byte("by-expires")
+
+// index keys are job key + 0 + id, requests without key are not indexed
+var boltBucketByKey = []byte("by-key")
+
+// BoltJobStore stores requests in embedded key-value database. Requests
+// are stored as json values, indexes are separate buckets with composed
+// keys pointing to request id
+type BoltJobStore struct {
+    db *bolt.DB
+}
+
+// constructor
+func NewBoltJobStore(fileName string) (*BoltJobStore, error) {
+
+    db, err := bolt.Open(fileName, 0644, &bolt.Options{Timeout: BOLT_JOB_STORE_TIMEOUT})
+    if err != nil {
+        return nil, fmt.Errorf("Cannot open job store %s: %s", fileName, err)
+    }
+
+    err = db.Update(func(tx *bolt.Tx) error {
+        for _, name := range [][]byte{boltBucketJobs, boltBucketByCreated, boltBucketByState} {
+            if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+                return err
+            }
+        }
+
+        // indexes added later are built for existing requests
+        rebuild := false
+        for _, name := range [][]byte{boltBucketByExpires, boltBucketByKey} {
+            if tx.Bucket(name) == nil {
+                if _, err := tx.CreateBucket(name); err != nil {
+                    return err
+                }
+                rebuild = true
+            }
+        }
+        if rebuild {
+            return tx.Bucket(boltBucketJobs).ForEach(func(id, value []byte) error {
+                request, err := boltGet(tx, id)
+                if err != nil {
+                    return err
+                }
+                return boltPutIndexes(tx, request)
+            })
+        }
+
+        return nil
+    })
+    if err != nil {
+        db.Close()
+        return nil, err
+    }
+
+    return &BoltJobStore{db: db}, nil
+}
+
+func boltCreatedKey(created int64, id string) []byte {
+    key := make([]byte, 8, 8 + len(id))
+    binary.BigEndian.PutUint64(key, uint64(created))
+    return append(key, id...)
+}
+
+func boltStatePrefix(state string) []byte {
+    return append([]byte(state), 0)
+}
+
+func boltStateKey(state string, created int64, id string) []byte {
+    return append(boltStatePrefix(state), boltCreatedKey(created, id)...)
+}
+
+func boltKeyPrefix(key string) []byte {
+    return append([]byte(key), 0)
+}
+
+func boltGet(tx *bolt.Tx, id []byte) (*QueueRequest, error) {
+    value := tx.Bucket(boltBucketJobs).Get(id)
+    if value == nil {
+        return nil, nil
+    }
+    request := QueueRequest{}
+    if err := json.Unmarshal(value, &request); err != nil {
+        return nil, err
+    }
+    return &request, nil
+}
+
+func boltExpiresIndexed(request *QueueRequest) bool {
+    return !request.Pinned && request.Expires > 0
+}
+
+// boltPutIndexes creates index entries of request
+func boltPutIndexes(tx *bolt.Tx, request *QueueRequest) error {
+    id := []byte(request.Id)
+    if err := tx.Bucket(boltBucketByCreated).Put(boltCreatedKey(request.Created, request.Id), id); err != nil {
+        return err
+    }
+    if err := tx.Bucket(boltBucketByState).Put(boltStateKey(request.State, request.Created, request.Id), id); err != nil {
+        return err
+    }
+    if len(request.Key) > 0 {
+        if err := tx.Bucket(boltBucketByKey).Put(append(boltKeyPrefix(request.Key), id...), id); err != nil {
+            return err
+        }
+    }
+    if boltExpiresIndexed(request) {
+        return tx.Bucket(boltBucketByExpires).Put(boltCreatedKey(request.Expires, request.Id), id)
+    }
+    return nil
+}
+
+// boltDeleteIndexes removes index entries of stored request
+func boltDeleteIndexes(tx *bolt.Tx, request *QueueRequest) error {
+    if err := tx.Bucket(boltBucketByCreated).Delete(boltCreatedKey(request.Created, request.Id)); err != nil {
+        return err
+    }
+    if err := tx.Bucket(boltBucketByState).Delete(boltStateKey(request.State, request.Created, request.Id)); err != nil {
+        return err
+    }
+    if len(request.Key) > 0 {
+        if err := tx.Bucket(boltBucketByKey).Delete(append(boltKeyPrefix(request.Key), request.Id...)); err != nil {
+            return err
+        }
+    }
+    if boltExpiresIndexed(request) {
+        return tx.Bucket(boltBucketByExpires).Delete(boltCreatedKey(request.Expires, request.Id))
+    }
+    return nil
+}
+
+func (s *BoltJobStore) Put(request *QueueRequest) error {
+
+    value, err := json.Marshal(request)
+    if err != nil {
+        return err
+    }
+
+    return s.db.Update(func(tx *bolt.Tx) error {
+        old, err := boltGet(tx, []byte(request.Id))
+        if err != nil {
+            return err
+        }
+        if old != nil {
+            if err = boltDeleteIndexes(tx, old); err != nil {
+                return err
+            }
+        }
+        if err = tx.Bucket(boltBucketJobs).Put([]byte(request.Id), value); err != nil {
+            return err
+        }
+        return boltPutIndexes(tx, request)
+    })
+}
+
+func (s *BoltJobStore) Get(id string) (*QueueRequest, error) {
+    var request *QueueRequest
+    err := s.db.View(func(tx *bolt.Tx) error {
+        var err error
+        request, err = boltGet(tx, []byte(id))
+        return err
+    })
+    return request, err
+}
+
+func (s *BoltJobStore) GetByKey(key string) (*QueueRequest, error) {
+    var request *QueueRequest
+    err := s.db.View(func(tx *bolt.Tx) error {
+        prefix := boltKeyPrefix(key)
+        k, id := tx.Bucket(boltBucketByKey).Cursor().Seek(prefix)
+        if k == nil || !bytes.HasPrefix(k, prefix) {
+            return nil
+        }
+        var err error
+        request, err = boltGet(tx, id)
+        return err
+    })
+    return request, err
+}
+
+func (s *BoltJobStore) Delete(id string) error {
+    return s.db.Update(func(tx *bolt.Tx) error {
+        old, err := boltGet(tx, []byte(id))
+        if err != nil || old == nil {
+            return err
+        }
+        if err = boltDeleteIndexes(tx, old); err != nil {
+            return err
+        }
+        return tx.Bucket(boltBucketJobs).Delete([]byte(id))
+    })
+}
+
+// scan walks index bucket from key prefix while accept returns true
+func (s *BoltJobStore) scan(bucket, prefix []byte, accept func(key []byte) bool) ([]*QueueRequest, error) {
+    var requests []*QueueRequest
+    err := s.db.View(func(tx *bolt.Tx) error {
+        c := tx.Bucket(bucket).Cursor()
+        for k, id := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix) && accept(k); k, id = c.Next() {
+            request, err := boltGet(tx, id)
+            if err != nil {
+                return err
+            }
+            if request != nil {
+                requests = append(requests, request)
+            }
+        }
+        return nil
+    })
+    return requests, err
+}
+
+func (s *BoltJobStore) List() ([]*QueueRequest, error) {
+    return s.scan(boltBucketByCreated, nil, func(key []byte) bool { return true })
+}
+
+func (s *BoltJobStore) ListByState(state string) ([]*QueueRequest, error) {
+    return s.scan(boltBucketByState, boltStatePrefix(state), func(key []byte) bool { return true })
+}
+
+func (s *BoltJobStore) ListExpired(now int64) ([]*QueueRequest, error) {
+    return s.scan(boltBucketByExpires, nil, func(key []byte) bool {
+        return int64(binary.BigEndian.Uint64(key[:8])) < now
+    })
+}
+
+// Refresh does nothing, database is used by single process only
+func (s *BoltJobStore) Refresh() error {
+    return nil
+}
+
+func (s *BoltJobStore) Close() error {
+    return s.db.Close()
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+    "encoding/json"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sort"
+    "sync"
+    "time"
+    "github.com/op/go-logging"
+)
+
+type fileJobStoreEntry struct {
+    modTime time.Time
+    size int64
+    request *QueueRequest
+}
+
+// FileJobStore stores each request as json file in queue directory. Requests
+// are kept in memory with indexes by job key, state and creation time, so
+// lookups don't touch disk. Files can be created also by other processes
+// (e.g. batch command), they are picked up when directory is scanned again
+// by Refresh (queue calls it periodically)
+type FileJobStore struct {
+    log *logging.Logger
+    dir string
+    mutex sync.Mutex
+    cache map[string]*fileJobStoreEntry
+    // file names of requests of each job key and state
+    byKey map[string]map[string]bool
+    byState map[string]map[string]bool
+    // file names ordered by creation time (and id)
+    byCreated []string
+}
+
+// constructor, requests stored in directory are read
+func NewFileJobStore(log *logging.Logger, dir string) (*FileJobStore, error) {
+    if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+        return nil, err
+    }
+    s := &FileJobStore{
+        log: log,
+        dir: dir,
+        cache: make(map[string]*fileJobStoreEntry),
+        byKey: make(map[string]map[string]bool),
+        byState: make(map[string]map[string]bool),
+    }
+    if err := s.Refresh(); err != nil {
+        return nil, err
+    }
+    return s, nil
+}
+
+// Refresh synchronizes cache with content of directory, only new or
+// modified files are parsed
+func (s *FileJobStore) Refresh() error {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    files, err := ioutil.ReadDir(s.dir)
+    if err != nil {
+        return err
+    }
+
+    present := make(map[string]bool)
+
+    for _, file := range files {
+
+        // skip directories and no-json files
+        if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
+            continue
+        }
+
+        present[file.Name()] = true
+
+        if e, exists := s.cache[file.Name()]; exists && e.modTime.Equal(file.ModTime()) && e.size == file.Size() {
+            continue
+        }
+
+        // read content of json file
+        filePath := filepath.Join(s.dir, file.Name())
+        fileIn, err := ioutil.ReadFile(filePath)
+        if err != nil {
+            s.log.Warningf("Cannot read content of file %s: %s", filePath, err)
+            continue
+        }
+        request := QueueRequest{}
+        if err = json.Unmarshal(fileIn, &request); err != nil {
+            s.log.Warningf("Cannot parse json file %s: %s", filePath, err)
+            continue
+        }
+
+        s.set(file.Name(), &fileJobStoreEntry{file.ModTime(), file.Size(), &request})
+    }
+
+    // forget files removed from directory
+    for name := range s.cache {
+        if !present[name] {
+            s.remove(name)
+        }
+    }
+
+    return nil
+}
+
+// createdBefore orders requests by creation time and id
+func createdBefore(a, b *QueueRequest) bool {
+    if a.Created != b.Created {
+        return a.Created < b.Created
+    }
+    return a.Id < b.Id
+}
+
+// createdPosition returns position of request in creation order, must be
+// called with mutex locked
+func (s *FileJobStore) createdPosition(request *QueueRequest) int {
+    return sort.Search(len(s.byCreated), func(i int) bool {
+        return !createdBefore(s.cache[s.byCreated[i]].request, request)
+    })
+}
+
+// set puts entry to cache and indexes, must be called with mutex locked
+func (s *FileJobStore) set(name string, e *fileJobStoreEntry) {
+    s.remove(name)
+
+    r := e.request
+    if len(r.Key) > 0 {
+        if s.byKey[r.Key] == nil {
+            s.byKey[r.Key] = make(map[string]bool)
+        }
+        s.byKey[r.Key][name] = true
+    }
+    if s.byState[r.State] == nil {
+        s.byState[r.State] = make(map[string]bool)
+    }
+    s.byState[r.State][name] = true
+
+    i := s.createdPosition(r)
+    s.byCreated = append(s.byCreated, "")
+    copy(s.byCreated[i + 1:], s.byCreated[i:])
+    s.byCreated[i] = name
+
+    s.cache[name] = e
+}
+
+// remove removes entry from cache and indexes, must be called with mutex
+// locked
+func (s *FileJobStore) remove(name string) {
+    e, exists := s.cache[name]
+    if !exists {
+        return
+    }
+
+    r := e.request
+    if names := s.byKey[r.Key]; names != nil {
+        delete(names, name)
+        if len(names) == 0 {
+            delete(s.byKey, r.Key)
+        }
+    }
+    if names := s.byState[r.State]; names != nil {
+        delete(names, name)
+        if len(names) == 0 {
+            delete(s.byState, r.State)
+        }
+    }
+    // ids in files written by others may not match file names, so equal
+    // positions are searched too
+    for i := s.createdPosition(r); i < len(s.byCreated); i++ {
+        if s.byCreated[i] == name {
+            s.byCreated = append(s.byCreated[:i], s.byCreated[i + 1:]...)
+            break
+        }
+        if createdBefore(r, s.cache[s.byCreated[i]].request) {
+            break
+        }
+    }
+
+    delete(s.cache, name)
+}
+
+// copies returns copies of cached requests of given file names
+func (s *FileJobStore) copies(names []string) []*QueueRequest {
+    var requests []*QueueRequest
+    for _, name := range names {
+        r := *s.cache[name].request
+        requests = append(requests, &r)
+    }
+    return requests
+}
+
+func (s *FileJobStore) Put(request *QueueRequest) error {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    // store queue record attributes to json file
+    requestJson, err := json.MarshalIndent(request, "", " ")
+    if err != nil {
+        return err
+    }
+
+    fileName := filepath.Join(s.dir, GetJsonFileName(request.Id))
+    if err = writeFileAtomic(fileName, requestJson); err != nil {
+        return err
+    }
+
+    // rewritten file can have the same size and modification time (coarse
+    // timestamps), so cache is updated directly
+    info, err := os.Stat(fileName)
+    if err != nil {
+        return err
+    }
+    r := *request
+    s.set(GetJsonFileName(request.Id), &fileJobStoreEntry{info.ModTime(), info.Size(), &r})
+
+    return nil
+}
+
+func (s *FileJobStore) Get(id string) (*QueueRequest, error) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    e, exists := s.cache[GetJsonFileName(id)]
+    if !exists {
+        return nil, nil
+    }
+    r := *e.request
+    return &r, nil
+}
+
+func (s *FileJobStore) GetByKey(key string) (*QueueRequest, error) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    // the smallest name wins to keep lookups stable
+    found := ""
+    for name := range s.byKey[key] {
+        if len(found) == 0 || name < found {
+            found = name
+        }
+    }
+    if len(found) == 0 {
+        return nil, nil
+    }
+    r := *s.cache[found].request
+    return &r, nil
+}
+
+func (s *FileJobStore) Delete(id string) error {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    s.remove(GetJsonFileName(id))
+    err := os.Remove(filepath.Join(s.dir, GetJsonFileName(id)))
+    if os.IsNotExist(err) {
+        return nil
+    }
+    return err
+}
+
+func (s *FileJobStore) List() ([]*QueueRequest, error) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    return s.copies(s.byCreated), nil
+}
+
+func (s *FileJobStore) ListByState(state string) ([]*QueueRequest, error) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    var names []string
+    for name := range s.byState[state] {
+        names = append(names, name)
+    }
+    requests := s.copies(names)
+    sort.Slice(requests, func(i, j int) bool { return createdBefore(requests[i], requests[j]) })
+    return requests, nil
+}
+
+func (s *FileJobStore) ListExpired(now int64) ([]*QueueRequest, error) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    var names []string
+    for _, name := range s.byCreated {
+        if r := s.cache[name].request; !r.Pinned && r.Expires > 0 && r.Expires < now {
+            names = append(names, name)
+        }
+    }
+    requests := s.copies(names)
+    sort.SliceStable(requests, func(i, j int) bool { return requests[i].Expires < requests[j].Expires })
+    return requests, nil
+}
+
+func (s *FileJobStore) Close() error {
+    return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "github.com/op/go-logging"
+)
+
+func testJobStore(t *testing.T, store JobStore) {
+    Ok(t, store.Put(&QueueRequest{Id: "c", State: QUEUE_REQUEST_STATE_NEW, Created: 30, Expires: 40}))
+    Ok(t, store.Put(&QueueRequest{Id: "a", Key: "k1", State: QUEUE_REQUEST_STATE_NEW, Created: 10, Expires: 100}))
+    Ok(t, store.Put(&QueueRequest{Id: "b", State: QUEUE_REQUEST_STATE_NEW, Created: 20, Expires: 50}))
+    Ok(t, store.Put(&QueueRequest{Id: "d", State: QUEUE_REQUEST_STATE_NEW, Created: 40, Expires: 10}))
+
+    // state change and pinning must update indexes
+    Ok(t, store.Put(&QueueRequest{Id: "a", Key: "k1", State: QUEUE_REQUEST_STATE_DONE, Created: 10, Expires: 20}))
+    Ok(t, store.Put(&QueueRequest{Id: "d", State: QUEUE_REQUEST_STATE_DONE, Created: 40, Expires: 10, Pinned: true}))
+
+    ids := func(requests []*QueueRequest, err error) []string {
+        Ok(t, err)
+        var result []string
+        for _, r := range requests {
+            result = append(result, r.Id)
+        }
+        return result
+    }
+
+    Equals(t, []string{"a", "b", "c", "d"}, ids(store.List()))
+    Equals(t, []string{"b", "c"}, ids(store.ListByState(QUEUE_REQUEST_STATE_NEW)))
+    Equals(t, []string{"a", "d"}, ids(store.ListByState(QUEUE_REQUEST_STATE_DONE)))
+    Equals(t, []string{"a", "c"}, ids(store.ListExpired(50)))
+
+    r, err := store.Get("a")
+    Ok(t, err)
+    Equals(t, QUEUE_REQUEST_STATE_DONE, r.State)
+
+    r, err = store.GetByKey("k1")
+    Ok(t, err)
+    Equals(t, "a", r.Id)
+    r, err = store.GetByKey("k2")
+    Ok(t, err)
+    Equals(t, true, r == nil)
+
+    Ok(t, store.Delete("a"))
+    r, err = store.Get("a")
+    Ok(t, err)
+    Equals(t, true, r == nil)
+    r, err = store.GetByKey("k1")
+    Ok(t, err)
+    Equals(t, true, r == nil)
+    Equals(t, []string{"d"}, ids(store.ListByState(QUEUE_REQUEST_STATE_DONE)))
+
+    // requests sharing key, key index must follow key changes
+    Ok(t, store.Put(&QueueRequest{Id: "f", Key: "k1", State: QUEUE_REQUEST_STATE_NEW, Created: 60}))
+    Ok(t, store.Put(&QueueRequest{Id: "e", Key: "k1", State: QUEUE_REQUEST_STATE_NEW, Created: 50}))
+    r, err = store.GetByKey("k1")
+    Ok(t, err)
+    Equals(t, "e", r.Id)
+    Ok(t, store.Put(&QueueRequest{Id: "e", Key: "k3", State: QUEUE_REQUEST_STATE_NEW, Created: 50}))
+    r, err = store.GetByKey("k1")
+    Ok(t, err)
+    Equals(t, "f", r.Id)
+    r, err = store.GetByKey("k3")
+    Ok(t, err)
+    Equals(t, "e", r.Id)
+}
+
+func TestFileJobStore(t *testing.T) {
+    dir, err := ioutil.TempDir("", "queue")
+    Ok(t, err)
+    defer os.RemoveAll(dir)
+
+    store, err := NewFileJobStore(logging.MustGetLogger("test"), dir)
+    Ok(t, err)
+    testJobStore(t, store)
+}
+
+func TestFileJobStoreRefresh(t *testing.T) {
+    dir, err := ioutil.TempDir("", "queue")
+    Ok(t, err)
+    defer os.RemoveAll(dir)
+
+    store, err := NewFileJobStore(logging.MustGetLogger("test"), dir)
+    Ok(t, err)
+    Ok(t, store.Put(&QueueRequest{Id: "a", Key: "k1", State: QUEUE_REQUEST_STATE_NEW, Created: 10}))
+
+    // request written by other process is not visible until refresh
+    other, err := NewFileJobStore(logging.MustGetLogger("test"), dir)
+    Ok(t, err)
+    Ok(t, other.Put(&QueueRequest{Id: "b", Key: "k2", State: QUEUE_REQUEST_STATE_NEW, Created: 5}))
+    Ok(t, other.Delete("a"))
+
+    r, err := store.GetByKey("k2")
+    Ok(t, err)
+    Equals(t, true, r == nil)
+
+    Ok(t, store.Refresh())
+    r, err = store.GetByKey("k2")
+    Ok(t, err)
+    Equals(t, "b", r.Id)
+    r, err = store.Get("a")
+    Ok(t, err)
+    Equals(t, true, r == nil)
+    requests, err := store.ListByState(QUEUE_REQUEST_STATE_NEW)
+    Ok(t, err)
+    Equals(t, 1, len(requests))
+    Equals(t, "b", requests[0].Id)
+}
+
+func TestBoltJobStore(t *testing.T) {
+    dir, err := ioutil.TempDir("", "queue")
+    Ok(t, err)
+    defer os.RemoveAll(dir)
+
+    store, err := NewBoltJobStore(filepath.Join(dir, BOLT_JOB_STORE_FILE))
+    Ok(t, err)
+    defer store.Close()
+    testJobStore(t, store)
+}
+
+func TestJobStoreMigration(t *testing.T) {
+    dir, err := ioutil.TempDir("", "queue")
+    Ok(t, err)
+    defer os.RemoveAll(dir)
+
+    log := logging.MustGetLogger("test")
+    fileStore, err := NewFileJobStore(log, dir)
+    Ok(t, err)
+    Ok(t, fileStore.Put(&QueueRequest{Id: "a", State: QUEUE_REQUEST_STATE_DONE, Created: 10}))
+
+    store, err := OpenJobStore(log, JOB_STORE_BOLT, dir)
+    Ok(t, err)
+    defer store.Close()
+
+    r, err := store.Get("a")
+    Ok(t, err)
+    Equals(t, QUEUE_REQUEST_STATE_DONE, r.State)
+
+    _, err = os.Stat(filepath.Join(dir, GetJsonFileName("a")))
+    Equals(t, true, os.IsNotExist(err))
+}
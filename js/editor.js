@@ -0,0 +1,209 @@
+// Editor of tile range on map page. Selection is changed on client (edges
+// are dragged, selection is panned, zoom is changed), proposed range is
+// sent to /map/params which returns it normalized by the same rules as map
+// page uses, page is then updated without reload.
+
+// paper sizes in mm (portrait)
+var PAPERS = {
+    'A4': [210, 297],
+    'A3': [297, 420],
+    'A2': [420, 594],
+    'A1': [594, 841],
+    'A0': [841, 1189]
+};
+
+var editor = {
+    ip: null,       // normalized input params
+    view: null,     // rendered range of tiles
+    drag: null      // state of dragging
+};
+
+function editorInit(data) {
+    var selection = document.getElementById('selection');
+
+    selection.onmousedown = function(e) {
+        var edge = e.target.getAttribute('data-edge') || 'move';
+        editor.drag = {edge: edge, x: e.pageX, y: e.pageY, range: editorRange(editor.ip)};
+        e.preventDefault();
+    };
+
+    document.onmousemove = function(e) {
+        if (!editor.drag) return;
+        editorDraw(editorDragRange(e), true);
+    };
+
+    document.onmouseup = function(e) {
+        if (!editor.drag) return;
+        var range = editorDragRange(e);
+        editor.drag = null;
+        editorPropose(range);
+    };
+
+    document.getElementById('zoom-in').onclick = function() {
+        var r = editorRange(editor.ip);
+        editorPropose({zoom: r.zoom + 1, xmin: r.xmin * 2, ymin: r.ymin * 2, xmax: r.xmax * 2 + 1, ymax: r.ymax * 2 + 1});
+    };
+
+    document.getElementById('zoom-out').onclick = function() {
+        var r = editorRange(editor.ip);
+        editorPropose({zoom: r.zoom - 1, xmin: Math.floor(r.xmin / 2), ymin: Math.floor(r.ymin / 2), xmax: Math.floor(r.xmax / 2), ymax: Math.floor(r.ymax / 2)});
+    };
+
+    var paperChanged = function() { editorDraw(editorRange(editor.ip), false); };
+    document.getElementById('paper').onchange = paperChanged;
+    document.getElementById('orientation').onchange = paperChanged;
+    document.getElementById('dpi').oninput = paperChanged;
+
+    editorApply(data);
+}
+
+function editorRange(ip) {
+    return {zoom: ip.Zoom, xmin: ip.XMin, ymin: ip.YMin, xmax: ip.XMax, ymax: ip.YMax};
+}
+
+// editorDragRange returns range given by current position of mouse, edges
+// are moved by whole tiles and cannot leave rendered view
+function editorDragRange(e) {
+    var d = editor.drag, v = editor.view, scale = editor.ip.Scale;
+    var dx = Math.round((e.pageX - d.x) / scale), dy = Math.round((e.pageY - d.y) / scale);
+    var r = {zoom: d.range.zoom, xmin: d.range.xmin, ymin: d.range.ymin, xmax: d.range.xmax, ymax: d.range.ymax};
+
+    if (d.edge == 'move') {
+        dx = Math.max(v.XMin - r.xmin, Math.min(v.XMax - r.xmax, dx));
+        dy = Math.max(v.YMin - r.ymin, Math.min(v.YMax - r.ymax, dy));
+        r.xmin += dx; r.xmax += dx;
+        r.ymin += dy; r.ymax += dy;
+    } else if (d.edge == 'w') {
+        r.xmin = Math.max(v.XMin, Math.min(r.xmax, r.xmin + dx));
+    } else if (d.edge == 'e') {
+        r.xmax = Math.min(v.XMax, Math.max(r.xmin, r.xmax + dx));
+    } else if (d.edge == 'n') {
+        r.ymin = Math.max(v.YMin, Math.min(r.ymax, r.ymin + dy));
+    } else if (d.edge == 's') {
+        r.ymax = Math.min(v.YMax, Math.max(r.ymin, r.ymax + dy));
+    }
+    return r;
+}
+
+// editorPropose sends range to server, normalized range is applied
+function editorPropose(range) {
+    var q = 'provider=' + encodeURIComponent(editor.ip.Provider.Name) +
+        '&zoom=' + range.zoom + '&xmin=' + range.xmin + '&ymin=' + range.ymin +
+        '&xmax=' + range.xmax + '&ymax=' + range.ymax;
+
+    // scale is kept only if it differs from scale of provider
+    if (range.zoom == editor.ip.Zoom && editor.ip.Scale != editor.ip.Provider.Scale) {
+        q += '&scale=' + editor.ip.Scale;
+    }
+
+    var xhr = new XMLHttpRequest();
+    xhr.open('GET', '/map/params?' + q);
+    xhr.onload = function() {
+        if (xhr.status != 200) {
+            document.getElementById('editor-info').textContent = 'Error: ' + xhr.responseText;
+            editorDraw(editorRange(editor.ip), false);
+            return;
+        }
+        editorApply(JSON.parse(xhr.responseText));
+    };
+    xhr.send();
+}
+
+// editorApply renders normalized range returned by server
+function editorApply(data) {
+    var old = editor.view, oldScale = editor.ip ? editor.ip.Scale : 0;
+    editor.ip = data.InputParams;
+    editor.view = data.View;
+
+    // tiles of view
+    var scale = editor.ip.Scale, tiles = document.getElementById('tiles');
+    tiles.innerHTML = '';
+    for (var i = 0; i < data.View.Tiles.length; i++) {
+        var t = data.View.Tiles[i], img = document.createElement('img');
+        img.src = t.Url;
+        img.style.cssText = 'position: absolute; left: ' + (t.Left * scale) + 'px; top: ' + (t.Top * scale) + 'px; width: ' + scale + 'px; height: ' + scale + 'px';
+        tiles.appendChild(img);
+    }
+
+    // keep selection on the same place of window if view moved
+    if (old && oldScale == scale && data.InputParams.Zoom == old.Zoom) {
+        window.scrollBy((old.XMin - data.View.XMin) * scale, (old.YMin - data.View.YMin) * scale);
+    }
+    editor.view.Zoom = data.InputParams.Zoom;
+
+    // links of server side controls
+    var mp = data.MapParams;
+    for (var key in mp) {
+        var el = document.getElementById(key);
+        if (!el || key.indexOf('Url') != 0) continue;
+        var label = el.textContent;
+        el.innerHTML = '';
+        var link = document.createElement(mp[key] ? 'a' : 'span');
+        if (mp[key]) {
+            link.href = mp[key];
+        } else {
+            link.className = 'disabled';
+        }
+        link.textContent = label;
+        el.appendChild(link);
+    }
+    document.getElementById('generate').action = mp.UrlGeneratePng;
+    var f = document.getElementById('provider-form');
+    f.elements['zoom'].value = editor.ip.Zoom;
+    f.elements['xmin'].value = editor.ip.XMin;
+    f.elements['ymin'].value = editor.ip.YMin;
+    f.elements['xmax'].value = editor.ip.XMax;
+    f.elements['ymax'].value = editor.ip.YMax;
+    if (window.history && history.replaceState) {
+        history.replaceState(null, '', mp.UrlCurrent);
+    }
+
+    editorDraw(editorRange(editor.ip), false);
+}
+
+// editorDraw shows selection (dashed while it is not normalized by server),
+// its size and paper frame centered on selection
+function editorDraw(r, proposed) {
+    var v = editor.view, scale = editor.ip.Scale;
+    var w = (r.xmax - r.xmin + 1) * scale, h = (r.ymax - r.ymin + 1) * scale;
+    var left = (r.xmin - v.XMin) * scale, top = (r.ymin - v.YMin) * scale;
+
+    var selection = document.getElementById('selection');
+    selection.style.left = left + 'px';
+    selection.style.top = top + 'px';
+    selection.style.width = w + 'px';
+    selection.style.height = h + 'px';
+    selection.className = proposed ? 'proposed' : '';
+
+    var info = (r.xmax - r.xmin + 1) + 'x' + (r.ymax - r.ymin + 1) + ' tiles, ' +
+        w + 'x' + h + ' px (' + (w * h / 1000000).toFixed(1) + ' Mpx) at zoom ' + r.zoom;
+
+    // paper frame has size of paper at given dpi
+    var frame = document.getElementById('paper-frame');
+    var paper = PAPERS[document.getElementById('paper').value];
+    var dpi = parseInt(document.getElementById('dpi').value, 10);
+    if (paper && dpi > 0) {
+        var pw = paper[0], ph = paper[1];
+        if (document.getElementById('orientation').value == 'landscape') {
+            pw = paper[1]; ph = paper[0];
+        }
+        pw = Math.round(pw / 25.4 * dpi);
+        ph = Math.round(ph / 25.4 * dpi);
+        frame.style.display = 'block';
+        frame.style.left = (left + (w - pw) / 2) + 'px';
+        frame.style.top = (top + (h - ph) / 2) + 'px';
+        frame.style.width = pw + 'px';
+        frame.style.height = ph + 'px';
+        info += ', paper ' + pw + 'x' + ph + ' px';
+        if (w > pw || h > ph) {
+            info += ' (image is cropped by paper)';
+        }
+    } else {
+        frame.style.display = 'none';
+        if (dpi > 0) {
+            info += ', prints ' + (w / dpi * 2.54).toFixed(1) + 'x' + (h / dpi * 2.54).toFixed(1) + ' cm at ' + dpi + ' dpi';
+        }
+    }
+
+    document.getElementById('editor-info').textContent = info;
+}
@@ -1,8 +1,11 @@
-var map, base;
+var map, base, provider = '{{.Default}}';
+
+// vertices of drawn polygon and its layer
+var drawing = false, vertices = [], polygon = null;
 
 function addmap() {
     base = {
-        {{range .}}
+        {{range .Providers}}
         '{{.Name}}': L.tileLayer('{{.Url}}', {
             name: '{{.Name}}', minZoom: {{.MinZoom}}, maxZoom: {{.MaxZoom}},
             attribution: '{{.Attribution}}'
@@ -15,7 +18,52 @@ function addmap() {
     map = L.map('map').setView([52, 11], 3);
     var control = L.control.layers(base);
     map.addControl(control);
-    map.addLayer(base.mapycz);
+    if (base[provider]) {
+        map.addLayer(base[provider]);
+    }
+    map.on('baselayerchange', function(e) {
+        provider = e.layer.options.name;
+    });
+    map.on('click', function(e) {
+        if (!drawing) return;
+        vertices.push(e.latlng);
+        if (polygon) {
+            polygon.setLatLngs(vertices);
+        } else {
+            polygon = L.polygon(vertices, {color: 'red'}).addTo(map);
+        }
+    });
+    map.on('zoomend', function() {
+        document.getElementById('area-zoom').value = map.getZoom();
+    });
+    document.getElementById('area-zoom').value = map.getZoom();
+}
+
+// draw toggles drawing of polygon, vertices are added by clicks on map
+function draw(button) {
+    drawing = !drawing;
+    button.value = drawing ? 'Finish polygon' : 'Draw polygon';
+}
+
+function clearpolygon() {
+    vertices = [];
+    if (polygon) {
+        map.removeLayer(polygon);
+        polygon = null;
+    }
+}
+
+// getarea sends drawn polygon as GeoJSON (uploaded file takes precedence)
+function getarea(f) {
+    f.elements['provider'].value = provider;
+    if (vertices.length >= 3) {
+        var ring = [];
+        for (var i = 0; i < vertices.length; i++) {
+            ring.push([vertices[i].lng, vertices[i].lat]);
+        }
+        ring.push(ring[0]);
+        f.elements['geometry'].value = JSON.stringify({type: 'Polygon', coordinates: [ring]});
+    }
 }
 
 // from http://wiki.openstreetmap.org/wiki/Slippy_map_tilenames
@@ -29,10 +77,5 @@ function getdata(f) {
     f.elements['xmax'].value = lon2tile(b.getEast(), z);
     f.elements['ymin'].value = lat2tile(b.getNorth(), z);
     f.elements['ymax'].value = lat2tile(b.getSouth(), z);
-    var layers = '';
-    map.eachLayer(function(l) {
-        if( layers.length ) layers += '|';
-        layers += l.options.name;
-    });
-    f.elements['provider'].value = layers;
+    f.elements['provider'].value = provider;
 }
@@ -0,0 +1,147 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "os"
+    "time"
+)
+
+// leaseValid checks if request is assigned to some worker
+func leaseValid(request *QueueRequest, now time.Time) bool {
+    return len(request.Worker) > 0 && request.LeaseExpires > now.Unix()
+}
+
+// checkLease returns error if request is not processed by given worker
+// (e.g. lease expired and request was reclaimed by other worker)
+func checkLease(request *QueueRequest, worker string) error {
+    if request.State != QUEUE_REQUEST_STATE_NEW || request.Worker != worker {
+        return fmt.Errorf("Request %s is not leased by worker %s", request.Id, worker)
+    }
+    return nil
+}
+
+// localWorkerName is name of worker running inside server process
+func localWorkerName(n int) string {
+    host, _ := os.Hostname()
+    return fmt.Sprintf("%s-%d-local-%d", host, os.Getpid(), n)
+}
+
+// Claim assigns next request (according to scheduler) to worker for lease
+// duration, nil is returned if there is no waiting request
+func (q *Queue) Claim(worker string) (*QueueRequest, error) {
+    q.mutex.Lock()
+    defer q.mutex.Unlock()
+
+    waiting, err := q.waiting()
+    if err != nil || len(waiting) == 0 {
+        return nil, err
+    }
+
+    request := waiting[0]
+    if len(request.Worker) > 0 {
+        q.log.Warningf("Lease of request %s held by worker %s expired, request is reclaimed", request.Id, request.Worker)
+    }
+    request.Worker = worker
+    request.LeaseExpires = time.Now().Add(q.config.LeaseDuration).Unix()
+    if err := q.store.Put(request); err != nil {
+        return nil, err
+    }
+
+    q.lastSubmitter = request.Submitter
+
+    q.log.Infof("Request %s claimed by worker %s", request.Id, worker)
+
+    return request, nil
+}
+
+// Heartbeat extends lease of request, error is returned if worker
+// lost the lease
+func (q *Queue) Heartbeat(id, worker string) error {
+    return q.updateRequest(id, func(request *QueueRequest) error {
+        if err := checkLease(request, worker); err != nil {
+            return err
+        }
+        request.LeaseExpires = time.Now().Add(q.config.LeaseDuration).Unix()
+        return nil
+    })
+}
+
+// Release returns unfinished request back to queue (e.g. on shutdown
+// of worker), it is claimed again by next free worker
+func (q *Queue) Release(id, worker string) error {
+    return q.updateRequest(id, func(request *QueueRequest) error {
+        if err := checkLease(request, worker); err != nil {
+            return err
+        }
+        request.Worker = ""
+        request.LeaseExpires = 0
+        return nil
+    })
+}
+
+// Complete stores result of request processed by worker. Image written by
+// worker to local file is moved to result store, failed request has no image
+func (q *Queue) Complete(id, worker, imageFile string, failures []TileFailure, failure string) error {
+
+    request, err := q.store.Get(id)
+    if err != nil {
+        return err
+    }
+    if request == nil {
+        return fmt.Errorf("Request %s not found", id)
+    }
+    if err = checkLease(request, worker); err != nil {
+        return err
+    }
+
+    if len(failure) == 0 {
+        if err = q.results.Put(q.resultName(request), imageFile); err != nil {
+            failure = fmt.Sprintf("Cannot store image of request %s: %s", id, err)
+        }
+    }
+
+    // lease is checked again, other attributes could be changed in the meantime
+    var finished QueueRequest
+    err = q.updateRequest(id, func(request *QueueRequest) error {
+        if err := checkLease(request, worker); err != nil {
+            return err
+        }
+        if len(failure) > 0 {
+            request.State = QUEUE_REQUEST_STATE_ERROR
+        } else {
+            request.State = QUEUE_REQUEST_STATE_DONE
+        }
+        request.Error = failure
+        request.FailedTiles = failures
+        request.Worker = ""
+        request.LeaseExpires = 0
+        finished = *request
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+
+    q.notifier.Notify(&finished)
+
+    return nil
+}
+
+// keepLease calls heartbeat periodically until context is done, lost is
+// called (and heartbeats stop) when heartbeat fails
+func keepLease(ctx context.Context, interval time.Duration, heartbeat func() error, lost func(err error)) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+            if err := heartbeat(); err != nil {
+                lost(err)
+                return
+            }
+        }
+    }
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+    "crypto/rand"
+    "encoding/base64"
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// validity of download links shown to owner on queue page
+const LINK_OWNER_DURATION = time.Hour
+
+// default validity of share links in webhook payloads
+const LINK_WEBHOOK_DURATION = time.Hour
+
+// default and maximal validity of share links created by owner
+const LINK_SHARE_DURATION = time.Hour * 24
+const LINK_SHARE_DURATION_MAX = time.Hour * 24 * 30
+
+// Share is download link created by owner of request, it can be revoked
+// before it expires
+type Share struct {
+    Id string
+    Created int64
+    Expires int64
+}
+
+// Links creates and verifies download links of generated images. Link
+// carries id of request, id of share (empty for links which cannot be
+// revoked) and expiration, all signed by HMAC-SHA256 of secret
+type Links struct {
+    secret []byte
+}
+
+// constructor, random secret is used if none is given
+func NewLinks(secret string) (*Links, error) {
+    l := &Links{[]byte(secret)}
+    if len(secret) == 0 {
+        l.secret = make([]byte, 32)
+        if _, err := rand.Read(l.secret); err != nil {
+            return nil, err
+        }
+    }
+    return l, nil
+}
+
+// Url returns download link (path) of request image
+func (l *Links) Url(request *QueueRequest, share string, expires int64) string {
+    value := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s\n%s\n%d", request.Id, share, expires)))
+    return "/download/" + signValue(l.secret, value) + "/" + GetImageFileName(request.Id, request.Params.Format)
+}
+
+// Parse verifies token of download link and returns its request id, share
+// id and expiration
+func (l *Links) Parse(token string) (string, string, int64, error) {
+    value, ok := verifyValue(l.secret, token)
+    if !ok {
+        return "", "", 0, fmt.Errorf("Invalid link")
+    }
+    decoded, err := base64.RawURLEncoding.DecodeString(value)
+    if err != nil {
+        return "", "", 0, fmt.Errorf("Invalid link")
+    }
+    parts := strings.Split(string(decoded), "\n")
+    if len(parts) != 3 {
+        return "", "", 0, fmt.Errorf("Invalid link")
+    }
+    expires, err := strconv.ParseInt(parts[2], 10, 64)
+    if err != nil {
+        return "", "", 0, fmt.Errorf("Invalid link")
+    }
+    return parts[0], parts[1], expires, nil
+}
+
+// findShare returns share of request or nil if it doesn't exist
+func findShare(request *QueueRequest, id string) *Share {
+    for i := range request.Shares {
+        if request.Shares[i].Id == id {
+            return &request.Shares[i]
+        }
+    }
+    return nil
+}
+
+// OwnerUrl returns short living download link shown to owner of request
+func (q *Queue) OwnerUrl(request *QueueRequest) string {
+    return q.links.Url(request, "", time.Now().Add(LINK_OWNER_DURATION).Unix())
+}
+
+// ShareUrl returns download link of share
+func (q *Queue) ShareUrl(request *QueueRequest, share *Share) string {
+    return q.links.Url(request, share.Id, share.Expires)
+}
+
+// CreateShare creates revocable download link of finished request
+func (q *Queue) CreateShare(id string, validity time.Duration) (*Share, error) {
+    if validity <= 0 {
+        validity = LINK_SHARE_DURATION
+    }
+    if validity > LINK_SHARE_DURATION_MAX {
+        return nil, fmt.Errorf("Maximal validity of link is %s", FormatDuration(LINK_SHARE_DURATION_MAX))
+    }
+
+    now := time.Now()
+    share := Share{Id: UniqueId()[:16], Created: now.Unix(), Expires: now.Add(validity).Unix()}
+
+    err := q.updateRequest(id, func(request *QueueRequest) error {
+        if request.State != QUEUE_REQUEST_STATE_DONE {
+            return fmt.Errorf("Only finished requests can be shared")
+        }
+        // expired shares are dropped
+        shares := []Share{}
+        for _, s := range request.Shares {
+            if s.Expires > now.Unix() {
+                shares = append(shares, s)
+            }
+        }
+        request.Shares = append(shares, share)
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    q.log.Infof("Share %s of request %s created", share.Id, id)
+
+    return &share, nil
+}
+
+// RevokeShare removes share of request, its link stops working immediately
+func (q *Queue) RevokeShare(id, share string) error {
+    return q.updateRequest(id, func(request *QueueRequest) error {
+        shares := []Share{}
+        for _, s := range request.Shares {
+            if s.Id != share {
+                shares = append(shares, s)
+            }
+        }
+        if len(shares) == len(request.Shares) {
+            return fmt.Errorf("Share %s not found", share)
+        }
+        request.Shares = shares
+        q.log.Infof("Share %s of request %s revoked", share, id)
+        return nil
+    })
+}
+
+// Download returns request of valid download link
+func (q *Queue) Download(token string) (*QueueRequest, error) {
+    id, share, expires, err := q.links.Parse(token)
+    if err != nil {
+        return nil, err
+    }
+    if expires < time.Now().Unix() {
+        return nil, fmt.Errorf("Link expired")
+    }
+
+    request, err := q.store.Get(id)
+    if err != nil {
+        return nil, err
+    }
+    if request == nil || request.State != QUEUE_REQUEST_STATE_DONE {
+        return nil, fmt.Errorf("Request %s not found", id)
+    }
+    if len(share) > 0 && findShare(request, share) == nil {
+        return nil, fmt.Errorf("Link was revoked")
+    }
+
+    return request, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+    "github.com/op/go-logging"
+)
+
+func TestDownloadLinks(t *testing.T) {
+    q, cleanup := newTestQueue(t, 0)
+    defer cleanup()
+
+    p := Provider{Name: "test", MinZoom: 0, MaxZoom: 5, Scale: 4, Url: "http://localhost/{z}/{x}/{y}.png"}
+    ip := InputParams{Zoom: 1, XMin: 0, YMin: 0, XMax: 1, YMax: 1, Scale: 4, Provider: p}
+    ip.Normalize()
+    r, err := q.Enqueue(&ip, EnqueueOptions{})
+    Ok(t, err)
+
+    // unfinished request cannot be shared
+    _, err = q.CreateShare(r.Id, 0)
+    Equals(t, true, err != nil)
+
+    image := filepath.Join(q.dir, "image.png")
+    Ok(t, ioutil.WriteFile(image, []byte("png"), 0644))
+    Ok(t, q.results.Put(q.resultName(r), image))
+    Ok(t, q.updateRequest(r.Id, func(r *QueueRequest) error {
+        r.State = QUEUE_REQUEST_STATE_DONE
+        return nil
+    }))
+    r, err = q.GetRequest(r.Id)
+    Ok(t, err)
+
+    handler := &HandlerDownload{logging.MustGetLogger("test"), q}
+    get := func(url string) int {
+        w := httptest.NewRecorder()
+        handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+        return w.Code
+    }
+
+    Equals(t, http.StatusOK, get(q.OwnerUrl(r)))
+
+    // tampered, expired and foreign links are rejected
+    owner := q.OwnerUrl(r)
+    Equals(t, http.StatusNotFound, get(strings.Replace(owner, "/download/", "/download/x", 1)))
+    Equals(t, http.StatusNotFound, get(q.links.Url(r, "", time.Now().Add(-time.Second).Unix())))
+    other, err := NewLinks("other")
+    Ok(t, err)
+    Equals(t, http.StatusNotFound, get(other.Url(r, "", time.Now().Add(time.Hour).Unix())))
+    Equals(t, http.StatusNotFound, get(strings.TrimSuffix(owner, ".png") + ".jpg"))
+
+    // share works until it is revoked
+    _, err = q.CreateShare(r.Id, LINK_SHARE_DURATION_MAX + time.Hour)
+    Equals(t, true, err != nil)
+    share, err := q.CreateShare(r.Id, time.Hour)
+    Ok(t, err)
+    Equals(t, http.StatusOK, get(q.ShareUrl(r, share)))
+    Ok(t, q.RevokeShare(r.Id, share.Id))
+    Equals(t, http.StatusNotFound, get(q.ShareUrl(r, share)))
+    Equals(t, true, q.RevokeShare(r.Id, share.Id) != nil)
+}
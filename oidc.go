@@ -0,0 +1,313 @@
+package main
+
+import (
+    "crypto"
+    "crypto/rsa"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "math/big"
+    "net/http"
+    "net/url"
+    "strings"
+    "sync"
+    "time"
+)
+
+const OIDC_TIMEOUT = time.Second * 10
+
+// max size of responses of OIDC provider
+const OIDC_MAX_RESPONSE = 1 << 20
+
+// prefix of names of users authenticated by OIDC, local users cannot
+// have names with this prefix
+const OIDC_USER_PREFIX = "oidc:"
+
+// OIDCConfig holds settings of OpenID Connect provider
+type OIDCConfig struct {
+    Issuer string
+    ClientId string
+    ClientSecret string
+}
+
+// OIDCProvider implements authorization code flow of OpenID Connect. Endpoints
+// are discovered (issuer/.well-known/openid-configuration) on first use, id
+// tokens must be signed by RS256 key published by provider
+type OIDCProvider struct {
+    config OIDCConfig
+    client *http.Client
+
+    mutex sync.Mutex
+    discovered bool
+    authEndpoint string
+    tokenEndpoint string
+    jwksUri string
+    keys map[string]*rsa.PublicKey
+}
+
+// constructor
+func NewOIDCProvider(config OIDCConfig) *OIDCProvider {
+    config.Issuer = strings.TrimSuffix(config.Issuer, "/")
+    return &OIDCProvider{
+        config: config,
+        client: &http.Client{Timeout: OIDC_TIMEOUT},
+        keys: make(map[string]*rsa.PublicKey),
+    }
+}
+
+// getJson fetches json document of provider
+func (p *OIDCProvider) getJson(u string, v interface{}) error {
+    resp, err := p.client.Get(u)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("Cannot fetch %s: %s", u, resp.Status)
+    }
+    return json.NewDecoder(io.LimitReader(resp.Body, OIDC_MAX_RESPONSE)).Decode(v)
+}
+
+// discover reads endpoints of provider, must be called with mutex locked
+func (p *OIDCProvider) discover() error {
+    if p.discovered {
+        return nil
+    }
+
+    var doc struct {
+        Issuer string `json:"issuer"`
+        AuthorizationEndpoint string `json:"authorization_endpoint"`
+        TokenEndpoint string `json:"token_endpoint"`
+        JwksUri string `json:"jwks_uri"`
+    }
+    if err := p.getJson(p.config.Issuer + "/.well-known/openid-configuration", &doc); err != nil {
+        return fmt.Errorf("OIDC discovery failed: %s", err)
+    }
+    if strings.TrimSuffix(doc.Issuer, "/") != p.config.Issuer {
+        return fmt.Errorf("OIDC discovery failed: issuer %s doesn't match %s", doc.Issuer, p.config.Issuer)
+    }
+
+    p.authEndpoint = doc.AuthorizationEndpoint
+    p.tokenEndpoint = doc.TokenEndpoint
+    p.jwksUri = doc.JwksUri
+    p.discovered = true
+
+    return nil
+}
+
+// AuthUrl returns url of provider login page
+func (p *OIDCProvider) AuthUrl(redirectUrl, state, nonce string) (string, error) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    if err := p.discover(); err != nil {
+        return "", err
+    }
+
+    params := url.Values{
+        "response_type": {"code"},
+        "client_id": {p.config.ClientId},
+        "redirect_uri": {redirectUrl},
+        "scope": {"openid profile email"},
+        "state": {state},
+        "nonce": {nonce},
+    }
+
+    separator := "?"
+    if strings.Contains(p.authEndpoint, "?") {
+        separator = "&"
+    }
+    return p.authEndpoint + separator + params.Encode(), nil
+}
+
+// Exchange exchanges authorization code for id token
+func (p *OIDCProvider) Exchange(code, redirectUrl string) (string, error) {
+    p.mutex.Lock()
+    err := p.discover()
+    tokenEndpoint := p.tokenEndpoint
+    p.mutex.Unlock()
+    if err != nil {
+        return "", err
+    }
+
+    form := url.Values{
+        "grant_type": {"authorization_code"},
+        "code": {code},
+        "redirect_uri": {redirectUrl},
+        "client_id": {p.config.ClientId},
+    }
+    req, err := http.NewRequest(http.MethodPost, tokenEndpoint, strings.NewReader(form.Encode()))
+    if err != nil {
+        return "", err
+    }
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req.SetBasicAuth(url.QueryEscape(p.config.ClientId), url.QueryEscape(p.config.ClientSecret))
+
+    resp, err := p.client.Do(req)
+    if err != nil {
+        return "", err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+        return "", fmt.Errorf("OIDC token request failed: %s %s", resp.Status, body)
+    }
+
+    var token struct {
+        IdToken string `json:"id_token"`
+    }
+    if err := json.NewDecoder(io.LimitReader(resp.Body, OIDC_MAX_RESPONSE)).Decode(&token); err != nil {
+        return "", err
+    }
+    if len(token.IdToken) == 0 {
+        return "", fmt.Errorf("OIDC token response without id token")
+    }
+    return token.IdToken, nil
+}
+
+// key returns signing key of given id, keys of provider are fetched again
+// when key is unknown (keys are rotated)
+func (p *OIDCProvider) key(kid string) (*rsa.PublicKey, error) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    if key, exists := p.keys[kid]; exists {
+        return key, nil
+    }
+
+    if err := p.discover(); err != nil {
+        return nil, err
+    }
+
+    var jwks struct {
+        Keys []struct {
+            Kid string `json:"kid"`
+            Kty string `json:"kty"`
+            N string `json:"n"`
+            E string `json:"e"`
+        } `json:"keys"`
+    }
+    if err := p.getJson(p.jwksUri, &jwks); err != nil {
+        return nil, err
+    }
+
+    for _, k := range jwks.Keys {
+        if k.Kty != "RSA" {
+            continue
+        }
+        n, err := base64.RawURLEncoding.DecodeString(k.N)
+        if err != nil {
+            continue
+        }
+        e, err := base64.RawURLEncoding.DecodeString(k.E)
+        if err != nil {
+            continue
+        }
+        p.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+    }
+
+    key, exists := p.keys[kid]
+    if !exists {
+        return nil, fmt.Errorf("Unknown signing key %s", kid)
+    }
+    return key, nil
+}
+
+// Verify checks signature and claims of id token and returns its claims
+func (p *OIDCProvider) Verify(idToken, nonce string) (map[string]interface{}, error) {
+
+    parts := strings.Split(idToken, ".")
+    if len(parts) != 3 {
+        return nil, fmt.Errorf("Malformed id token")
+    }
+
+    var header struct {
+        Alg string `json:"alg"`
+        Kid string `json:"kid"`
+    }
+    if err := decodeJwtPart(parts[0], &header); err != nil {
+        return nil, err
+    }
+    if header.Alg != "RS256" {
+        return nil, fmt.Errorf("Unsupported id token algorithm %s", header.Alg)
+    }
+
+    key, err := p.key(header.Kid)
+    if err != nil {
+        return nil, err
+    }
+    signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+    if err != nil {
+        return nil, fmt.Errorf("Malformed id token signature")
+    }
+    hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+    if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature); err != nil {
+        return nil, fmt.Errorf("Invalid id token signature")
+    }
+
+    claims := make(map[string]interface{})
+    if err := decodeJwtPart(parts[1], &claims); err != nil {
+        return nil, err
+    }
+
+    if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != p.config.Issuer {
+        return nil, fmt.Errorf("Id token issued by %s", iss)
+    }
+    if !jwtAudience(claims["aud"], p.config.ClientId) {
+        return nil, fmt.Errorf("Id token issued for other client")
+    }
+    if exp, _ := claims["exp"].(float64); int64(exp) < time.Now().Unix() {
+        return nil, fmt.Errorf("Id token expired")
+    }
+    if n, _ := claims["nonce"].(string); n != nonce {
+        return nil, fmt.Errorf("Id token nonce doesn't match")
+    }
+
+    return claims, nil
+}
+
+func decodeJwtPart(part string, v interface{}) error {
+    data, err := base64.RawURLEncoding.DecodeString(part)
+    if err != nil {
+        return fmt.Errorf("Malformed id token")
+    }
+    if err := json.Unmarshal(data, v); err != nil {
+        return fmt.Errorf("Malformed id token: %s", err)
+    }
+    return nil
+}
+
+// jwtAudience checks if aud claim (string or list) contains client id
+func jwtAudience(aud interface{}, clientId string) bool {
+    switch v := aud.(type) {
+    case string:
+        return v == clientId
+    case []interface{}:
+        for _, a := range v {
+            if a == clientId {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// oidcUserName returns name of user given by id token claims. Email is
+// used only if provider verified it, subject (unique at issuer) otherwise.
+// Claims like preferred_username can be changed by user, so they are not
+// used at all
+func oidcUserName(claims map[string]interface{}) string {
+    name, _ := claims["sub"].(string)
+    if email, _ := claims["email"].(string); len(email) > 0 {
+        if verified := claims["email_verified"]; verified == true || verified == "true" {
+            name = email
+        }
+    }
+    if len(name) == 0 {
+        return ""
+    }
+    return OIDC_USER_PREFIX + name
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "image"
+    "image/color"
+    "math"
+    "strconv"
+)
+
+// default style of overlay
+const OVERLAY_COLOR = "#e00000"
+const OVERLAY_WIDTH = 4.0
+const OVERLAY_OPACITY = 0.8
+
+// limits of track width in pixels
+const OVERLAY_WIDTH_MIN = 0.5
+const OVERLAY_WIDTH_MAX = 50
+
+// size of waypoint labels in pixels, marker radius is derived from width
+// of tracks
+const OVERLAY_LABEL_SIZE = 14.0
+
+// Waypoint is labelled point of overlay
+type Waypoint struct {
+    Point LonLat
+    Name string
+}
+
+// Overlay is GPX file drawn onto stitched image, tracks and routes are
+// drawn as lines, waypoints as labelled markers
+type Overlay struct {
+    Tracks [][]LonLat
+    Waypoints []Waypoint
+    // color of tracks and markers (#rrggbb)
+    Color string
+    // width of tracks in pixels
+    Width float64
+    // opacity of tracks and markers (0 - 1)
+    Opacity float64
+}
+
+// ParseOverlay parses GPX (or KML) document, style of overlay is set to
+// defaults. Tracks, routes and line strings (polygon rings as well) are
+// drawn as tracks, named points as waypoints
+func ParseOverlay(data []byte) (*Overlay, error) {
+    g, names, err := parseXmlGeometry(bytes.TrimSpace(data))
+    if err != nil {
+        return nil, err
+    }
+
+    // coordinates are checked (and clamped) as geometry
+    if err := g.validate(); err != nil {
+        return nil, err
+    }
+
+    o := &Overlay{Color: OVERLAY_COLOR, Width: OVERLAY_WIDTH, Opacity: OVERLAY_OPACITY}
+    o.Tracks = append(g.Lines, g.Rings...)
+    for i, p := range g.Points {
+        o.Waypoints = append(o.Waypoints, Waypoint{p, names[i]})
+    }
+
+    return o, nil
+}
+
+// SetStyle sets style of overlay given as strings (empty value keeps
+// current setting)
+func (o *Overlay) SetStyle(colorValue, width, opacity string) error {
+    if len(colorValue) > 0 {
+        if _, err := parseColor(colorValue); err != nil {
+            return err
+        }
+        o.Color = colorValue
+    }
+    if len(width) > 0 {
+        w, err := strconv.ParseFloat(width, 64)
+        if err != nil || w < OVERLAY_WIDTH_MIN || w > OVERLAY_WIDTH_MAX {
+            return fmt.Errorf("Track width must be number between %g and %g", OVERLAY_WIDTH_MIN, float64(OVERLAY_WIDTH_MAX))
+        }
+        o.Width = w
+    }
+    if len(opacity) > 0 {
+        op, err := strconv.ParseFloat(opacity, 64)
+        if err != nil || op < 0 || op > 1 {
+            return fmt.Errorf("Track opacity must be number between 0 and 1")
+        }
+        o.Opacity = op
+    }
+    return nil
+}
+
+// Hash returns hash of overlay, it is part of key of job
+func (o *Overlay) Hash() string {
+    data, _ := json.Marshal(o)
+    hash := sha256.Sum256(data)
+    return hex.EncodeToString(hash[:])
+}
+
+// drawOverlay draws tracks and waypoints of overlay onto image, points are
+// projected by the same Web Mercator math as tile grid uses
+func drawOverlay(img *image.RGBA, ip *InputParams) error {
+    o := ip.Overlay
+    if o == nil {
+        return nil
+    }
+
+    c, err := parseColor(o.Color)
+    if err != nil {
+        return err
+    }
+
+    project := func(line []LonLat) [][2]float64 {
+        var points [][2]float64
+        for _, p := range line {
+            x, y := projectPoint(p, ip)
+            points = append(points, [2]float64{x, y})
+        }
+        return points
+    }
+
+    // all tracks are filled at once, crossings are not darker
+    var shapes []Shape
+    for _, track := range o.Tracks {
+        shapes = append(shapes, strokeShapes(project(track), o.Width)...)
+    }
+    fillShapes(img, shapes, withOpacity(c, o.Opacity))
+
+    if len(o.Waypoints) == 0 {
+        return nil
+    }
+
+    face, err := labelFace(OVERLAY_LABEL_SIZE)
+    if err != nil {
+        return err
+    }
+    defer face.Close()
+
+    white := color.RGBA{255, 255, 255, 255}
+    radius := math.Max(4, o.Width * 1.5)
+    b := img.Bounds()
+    for _, w := range o.Waypoints {
+        x, y := projectPoint(w.Point, ip)
+
+        // marker is dot in white ring
+        fillShapes(img, []Shape{circleShape(x, y, radius + 1.5)}, withOpacity(white, o.Opacity))
+        fillShapes(img, []Shape{circleShape(x, y, radius)}, withOpacity(c, o.Opacity))
+
+        if len(w.Name) == 0 {
+            continue
+        }
+
+        // label is right of marker unless it overflows image
+        lx := x + radius + 3
+        if width := textWidth(face, w.Name); lx + width > float64(b.Max.X) {
+            lx = x - radius - 3 - width
+        }
+        drawLabel(img, face, lx, y + OVERLAY_LABEL_SIZE / 3, w.Name, color.RGBA{0, 0, 0, 255}, white)
+    }
+
+    return nil
+}
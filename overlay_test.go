@@ -0,0 +1,96 @@
+package main
+
+import (
+    "image"
+    "image/color"
+    "image/draw"
+    "testing"
+)
+
+const testGpx = `<?xml version="1.0"?>
+<gpx version="1.1" xmlns="http://www.topografix.com/GPX/1/1">
+    <wpt lat="0" lon="0"><name>Null Island</name></wpt>
+    <rte><rtept lat="10" lon="-10"/><rtept lat="10" lon="10"/></rte>
+    <trk><trkseg><trkpt lat="0" lon="-90"/><trkpt lat="0" lon="90"/></trkseg></trk>
+</gpx>`
+
+func TestParseOverlay(t *testing.T) {
+    o, err := ParseOverlay([]byte(testGpx))
+    Ok(t, err)
+    Equals(t, [][]LonLat{{{-10, 10}, {10, 10}}, {{-90, 0}, {90, 0}}}, o.Tracks)
+    Equals(t, []Waypoint{{LonLat{0, 0}, "Null Island"}}, o.Waypoints)
+    Equals(t, OVERLAY_COLOR, o.Color)
+
+    Ok(t, o.SetStyle("#00f", "", "0.5"))
+    Equals(t, "#00f", o.Color)
+    Equals(t, OVERLAY_WIDTH, o.Width)
+    Equals(t, 0.5, o.Opacity)
+    Equals(t, true, o.SetStyle("blue", "", "") != nil)
+    Equals(t, true, o.SetStyle("", "100", "") != nil)
+    Equals(t, true, o.SetStyle("", "", "2") != nil)
+
+    _, err = ParseOverlay([]byte(`<gpx></gpx>`))
+    Equals(t, true, err != nil)
+    _, err = ParseOverlay([]byte(`<kml></kml>`))
+    Equals(t, true, err != nil)
+
+    // placemarks of KML are named waypoints
+    o, err = ParseOverlay([]byte(`<kml><Document>
+        <Placemark><name>Peak</name><Point><coordinates>14.5,50.1,300</coordinates></Point></Placemark>
+        <Placemark><LineString><coordinates>14,50 15,51</coordinates></LineString></Placemark>
+    </Document></kml>`))
+    Ok(t, err)
+    Equals(t, [][]LonLat{{{14, 50}, {15, 51}}}, o.Tracks)
+    Equals(t, []Waypoint{{LonLat{14.5, 50.1}, "Peak"}}, o.Waypoints)
+}
+
+func TestDrawOverlay(t *testing.T) {
+    o, err := ParseOverlay([]byte(testGpx))
+    Ok(t, err)
+    Ok(t, o.SetStyle("#ff0000", "3", "1"))
+    o.Waypoints = nil
+
+    // whole world in 512x512 image, track is horizontal line through center
+    ip := InputParams{Zoom: 0, Scale: 512, Overlay: o}
+    img := image.NewRGBA(image.Rect(0, 0, 512, 512))
+    draw.Draw(img, img.Bounds(), &image.Uniform{color.RGBA{255, 255, 255, 255}}, image.Point{}, draw.Src)
+    Ok(t, drawOverlay(img, &ip))
+
+    Equals(t, color.RGBA{255, 0, 0, 255}, img.RGBAAt(256, 256))
+    Equals(t, color.RGBA{255, 255, 255, 255}, img.RGBAAt(100, 256))
+    Equals(t, color.RGBA{255, 255, 255, 255}, img.RGBAAt(256, 200))
+    // edge of line is anti-aliased
+    edge := img.RGBAAt(128, 257)
+    Equals(t, true, edge.G > 0 && edge.G < 255)
+
+    // waypoint label
+    o.Tracks = nil
+    o.Waypoints = []Waypoint{{LonLat{0, 0}, "Null Island"}}
+    draw.Draw(img, img.Bounds(), &image.Uniform{color.RGBA{255, 255, 255, 255}}, image.Point{}, draw.Src)
+    Ok(t, drawOverlay(img, &ip))
+    Equals(t, color.RGBA{255, 0, 0, 255}, img.RGBAAt(256, 256))
+    dark := 0
+    for x := 265; x < 350; x++ {
+        for y := 245; y < 262; y++ {
+            if img.RGBAAt(x, y).R < 100 {
+                dark++
+            }
+        }
+    }
+    Equals(t, true, dark > 20)
+
+    // overlay is part of job key
+    key := ip.Key()
+    o.Width = 5
+    Equals(t, false, key == ip.Key())
+}
+
+func TestFillShapesBands(t *testing.T) {
+    // vertical line crossing several bands
+    img := image.NewRGBA(image.Rect(0, 0, 16, DRAW_BAND_HEIGHT * 3))
+    fillShapes(img, strokeShapes([][2]float64{{8, 10}, {8, float64(DRAW_BAND_HEIGHT * 3 - 10)}}, 4), color.RGBA{0, 0, 255, 255})
+    for _, y := range []int{10, DRAW_BAND_HEIGHT - 1, DRAW_BAND_HEIGHT, DRAW_BAND_HEIGHT * 2 + 5, DRAW_BAND_HEIGHT * 3 - 11} {
+        Equals(t, color.RGBA{0, 0, 255, 255}, img.RGBAAt(8, y))
+    }
+    Equals(t, color.RGBA{}, img.RGBAAt(1, DRAW_BAND_HEIGHT))
+}
@@ -2,12 +2,15 @@ package main
 
 import (
     "encoding/csv"
+    "fmt"
     "io"
     "math/rand"
     "os"
     "regexp"
+    "sort"
     "strconv"
     "strings"
+    "sync"
 )
 
 type Provider struct {
@@ -26,15 +29,101 @@ type Tile struct {
     Url string
 }
 
-func readProviders() (map[string]Provider, error) {
+// Providers is the set of configured tile providers shared by all handlers.
+// The whole set is swapped atomically on reload, so readers always see
+// either the old or the new configuration, never a mix of both
+type Providers struct {
+    mutex sync.RWMutex
+    providers map[string]Provider
+    // provider used when request doesn't name any
+    defaultName string
+}
+
+// constructor
+func NewProviders(providers map[string]Provider) *Providers {
+    return &Providers{providers: providers}
+}
+
+func (p *Providers) Get(name string) (Provider, bool) {
+    p.mutex.RLock()
+    defer p.mutex.RUnlock()
+    provider, exists := p.providers[name]
+    return provider, exists
+}
+
+// All returns current providers map, the map must not be modified
+// by caller since it is shared by all readers of the same generation
+func (p *Providers) All() map[string]Provider {
+    p.mutex.RLock()
+    defer p.mutex.RUnlock()
+    return p.providers
+}
+
+// Names returns sorted list of provider names
+func (p *Providers) Names() []string {
+    p.mutex.RLock()
+    defer p.mutex.RUnlock()
+    var names []string
+    for name := range p.providers {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// Swap replaces whole set of providers by new one, set without default
+// provider is refused
+func (p *Providers) Swap(providers map[string]Provider) error {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    if _, exists := providers[p.defaultName]; len(p.defaultName) > 0 && !exists {
+        return fmt.Errorf("Default provider %s is missing", p.defaultName)
+    }
+    p.providers = providers
+    return nil
+}
+
+// SetDefault sets provider used when request doesn't name any, first
+// provider by name is the default if it is not set
+func (p *Providers) SetDefault(name string) error {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    if _, exists := p.providers[name]; len(name) > 0 && !exists {
+        return fmt.Errorf("Unknown default provider: %s", name)
+    }
+    p.defaultName = name
+    return nil
+}
+
+// Default returns provider used when request doesn't name any
+func (p *Providers) Default() (Provider, bool) {
+    p.mutex.RLock()
+    name := p.defaultName
+    p.mutex.RUnlock()
+
+    if len(name) == 0 {
+        names := p.Names()
+        if len(names) == 0 {
+            return Provider{}, false
+        }
+        name = names[0]
+    }
+    return p.Get(name)
+}
+
+func readProviders(fileName string) (map[string]Provider, error) {
 
-    csvfile, err := os.Open("providers.csv")
+    csvfile, err := os.Open(fileName)
     if err != nil {
         return nil, err
     }
+    defer csvfile.Close()
 
     r := csv.NewReader(csvfile)
 
+    // comments and incomplete records are skipped below
+    r.FieldsPerRecord = -1
+
     providers := make(map[string]Provider)
 
     // Iterate through the records
@@ -48,7 +137,7 @@ func readProviders() (map[string]Provider, error) {
         }
 
         // if line is comment, ignore it
-        if rec[0][0] == '#' {
+        if len(rec[0]) > 0 && rec[0][0] == '#' {
             continue
         }
 
@@ -82,9 +171,42 @@ func readProviders() (map[string]Provider, error) {
         providers[p.Name] = p
     }
 
+    if err := validateProviders(providers); err != nil {
+        return nil, err
+    }
+
     return providers, nil
 }
 
+// validateProviders checks that set of providers is usable, it is called
+// before new set replaces the current one, so broken config file never
+// makes it to the handlers
+func validateProviders(providers map[string]Provider) error {
+
+    if len(providers) == 0 {
+        return fmt.Errorf("No providers defined")
+    }
+
+    for name, p := range providers {
+        if len(name) == 0 {
+            return fmt.Errorf("Provider with empty name")
+        }
+        if p.MinZoom < 0 || p.MaxZoom < p.MinZoom {
+            return fmt.Errorf("Provider %s: invalid zoom range %d-%d", name, p.MinZoom, p.MaxZoom)
+        }
+        if p.Scale <= 0 {
+            return fmt.Errorf("Provider %s: invalid scale %d", name, p.Scale)
+        }
+        for _, placeholder := range []string{"{x}", "{y}", "{z}"} {
+            if !strings.Contains(p.Url, placeholder) {
+                return fmt.Errorf("Provider %s: url %s doesn't contain %s", name, p.Url, placeholder)
+            }
+        }
+    }
+
+    return nil
+}
+
 func (p *Provider) getTiles(xmin, ymin, xmax, ymax, zoom, scale int) *[]Tile {
 
     var tiles []Tile
@@ -0,0 +1,187 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "image"
+    "io"
+    "net/http"
+    "text/tabwriter"
+    "time"
+)
+
+// reference point used for sample tiles (Prague), tiles around 0:0 are
+// in the ocean and regional providers don't serve them at higher zooms
+const PROVIDER_CHECK_LAT = 50.08
+const PROVIDER_CHECK_LON = 14.42
+
+const PROVIDER_CHECK_TIMEOUT = time.Second * 10
+
+// result of fetching one sample tile
+type ProviderCheckTile struct {
+    Zoom int
+    Url string
+    Status int
+    LatencyMs int64
+    ContentType string
+    Width int
+    Height int
+    ScaleOk bool
+    Error string
+}
+
+// result of checking one provider
+type ProviderCheck struct {
+    Provider string
+    Scale int
+    MinZoom int
+    MaxZoom int
+    MinZoomServed bool
+    MaxZoomServed bool
+    Tiles []ProviderCheckTile
+}
+
+func (c *ProviderCheck) Ok() bool {
+    for _, t := range c.Tiles {
+        if len(t.Error) > 0 || !t.ScaleOk {
+            return false
+        }
+    }
+    return c.MinZoomServed && c.MaxZoomServed
+}
+
+// zoom levels to be probed - both declared limits and one in the middle
+func providerCheckZooms(p *Provider) []int {
+    zooms := []int{p.MinZoom}
+    if middle := (p.MinZoom + p.MaxZoom) / 2; middle != p.MinZoom && middle != p.MaxZoom {
+        zooms = append(zooms, middle)
+    }
+    if p.MaxZoom != p.MinZoom {
+        zooms = append(zooms, p.MaxZoom)
+    }
+    return zooms
+}
+
+func checkProviderTile(policy *FetchPolicy, client *http.Client, p *Provider, zoom int, lat, lon float64) ProviderCheckTile {
+
+    x := LonToTileX(lon, zoom)
+    y := LatToTileY(lat, zoom)
+    tiles := p.getTiles(x, y, x, y, zoom, p.Scale)
+
+    result := ProviderCheckTile{Zoom: zoom, Url: (*tiles)[0].Url}
+
+    start := time.Now()
+    res, err := client.Get(result.Url)
+    if err != nil {
+        result.Error = err.Error()
+        return result
+    }
+    defer res.Body.Close()
+
+    result.Status = res.StatusCode
+    result.ContentType = res.Header.Get("Content-Type")
+
+    if res.StatusCode != http.StatusOK {
+        result.LatencyMs = time.Since(start).Milliseconds()
+        result.Error = fmt.Sprintf("Unexpected status %s", res.Status)
+        return result
+    }
+
+    data, err := policy.ReadImage(res)
+    result.LatencyMs = time.Since(start).Milliseconds()
+    if err != nil {
+        result.Error = err.Error()
+        return result
+    }
+
+    m, _, err := image.Decode(bytes.NewReader(data))
+    if err != nil {
+        result.Error = fmt.Sprintf("Decoding failed: %s", err)
+        return result
+    }
+
+    result.Width = m.Bounds().Dx()
+    result.Height = m.Bounds().Dy()
+    result.ScaleOk = result.Width == p.Scale && result.Height == p.Scale
+
+    return result
+}
+
+// checkProvider fetches sample tile at several zoom levels
+func checkProvider(policy *FetchPolicy, p Provider, lat, lon float64) ProviderCheck {
+
+    client := policy.Client()
+    client.Timeout = PROVIDER_CHECK_TIMEOUT
+
+    check := ProviderCheck{Provider: p.Name, Scale: p.Scale, MinZoom: p.MinZoom, MaxZoom: p.MaxZoom}
+
+    for _, zoom := range providerCheckZooms(&p) {
+        t := checkProviderTile(policy, client, &p, zoom, lat, lon)
+        served := len(t.Error) == 0
+        if zoom == p.MinZoom {
+            check.MinZoomServed = served
+        }
+        if zoom == p.MaxZoom {
+            check.MaxZoomServed = served
+        }
+        check.Tiles = append(check.Tiles, t)
+    }
+
+    return check
+}
+
+// checkProviders checks all providers in the order given by names
+func checkProviders(policy *FetchPolicy, providers *Providers, names []string) ([]ProviderCheck, error) {
+
+    if len(names) == 0 {
+        names = providers.Names()
+    }
+
+    var checks []ProviderCheck
+    for _, name := range names {
+        p, exists := providers.Get(name)
+        if !exists {
+            return nil, fmt.Errorf("Unknown provider: %s", name)
+        }
+        checks = append(checks, checkProvider(policy, p, PROVIDER_CHECK_LAT, PROVIDER_CHECK_LON))
+    }
+
+    return checks, nil
+}
+
+func writeProviderChecksJson(w io.Writer, checks []ProviderCheck) error {
+    enc := json.NewEncoder(w)
+    enc.SetIndent("", " ")
+    return enc.Encode(checks)
+}
+
+func writeProviderChecksTable(w io.Writer, checks []ProviderCheck) error {
+    tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(tw, "PROVIDER\tZOOM\tSTATUS\tLATENCY\tCONTENT TYPE\tSIZE\tSCALE\tRESULT")
+    for _, c := range checks {
+        for _, t := range c.Tiles {
+            result := "ok"
+            if len(t.Error) > 0 {
+                result = t.Error
+            } else if !t.ScaleOk {
+                result = "scale mismatch"
+            }
+            fmt.Fprintf(tw, "%s\t%d\t%d\t%dms\t%s\t%dx%d\t%d\t%s\n",
+                c.Provider, t.Zoom, t.Status, t.LatencyMs, t.ContentType, t.Width, t.Height, c.Scale, result)
+        }
+        fmt.Fprintf(tw, "%s\tmin zoom %d served: %t, max zoom %d served: %t\t\t\t\t\t\t\n",
+            c.Provider, c.MinZoom, c.MinZoomServed, c.MaxZoom, c.MaxZoomServed)
+    }
+    return tw.Flush()
+}
+
+func writeProviderChecks(w io.Writer, checks []ProviderCheck, format string) error {
+    switch format {
+    case "json":
+        return writeProviderChecksJson(w, checks)
+    case "table", "":
+        return writeProviderChecksTable(w, checks)
+    }
+    return fmt.Errorf("Unknown output format: %s", format)
+}
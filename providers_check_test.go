@@ -0,0 +1,38 @@
+package main
+
+import (
+    "image"
+    "image/png"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "github.com/op/go-logging"
+)
+
+func TestCheckProvider(t *testing.T) {
+
+    // serves 256px tiles up to zoom 10
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if strings.HasPrefix(r.URL.Path, "/12/") {
+            w.WriteHeader(http.StatusNotFound)
+            return
+        }
+        w.Header().Set("Content-Type", "image/png")
+        png.Encode(w, image.NewRGBA(image.Rect(0, 0, 256, 256)))
+    }))
+    defer ts.Close()
+
+    p := Provider{Name: "test", MinZoom: 2, MaxZoom: 12, Scale: 256, Url: ts.URL + "/{z}/{x}/{y}.png"}
+    policy := NewFetchPolicy(logging.MustGetLogger("test"), FetchPolicyConfig{AllowPrivate: true})
+    check := checkProvider(policy, p, PROVIDER_CHECK_LAT, PROVIDER_CHECK_LON)
+
+    Equals(t, 3, len(check.Tiles))
+    Equals(t, 7, check.Tiles[1].Zoom)
+    Equals(t, "image/png", check.Tiles[1].ContentType)
+    Equals(t, true, check.Tiles[1].ScaleOk)
+    Equals(t, true, check.MinZoomServed)
+    Equals(t, false, check.MaxZoomServed)
+    Equals(t, 404, check.Tiles[2].Status)
+    Equals(t, false, check.Ok())
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+    "os"
+    "os/signal"
+    "syscall"
+    "time"
+    "github.com/op/go-logging"
+)
+
+// ProvidersReloader keeps Providers in sync with the config file. The file
+// is reloaded when its modification time changes (checked in given interval)
+// or when process receives SIGHUP. Invalid config is reported and ignored,
+// handlers keep using the last valid set of providers.
+//
+// Queued requests are not affected by reload at all, since each of them
+// carries its own copy of Provider in InputParams
+type ProvidersReloader struct {
+    log *logging.Logger
+    fileName string
+    providers *Providers
+    interval time.Duration
+    modTime time.Time
+}
+
+// constructor
+func NewProvidersReloader(log *logging.Logger, fileName string, providers *Providers, interval time.Duration) *ProvidersReloader {
+    r := &ProvidersReloader{log: log, fileName: fileName, providers: providers, interval: interval}
+    if info, err := os.Stat(fileName); err == nil {
+        r.modTime = info.ModTime()
+    }
+    return r
+}
+
+func (r *ProvidersReloader) Start() {
+    go r.watch()
+}
+
+func (r *ProvidersReloader) watch() {
+
+    hup := make(chan os.Signal, 1)
+    signal.Notify(hup, syscall.SIGHUP)
+
+    // zero interval disables watching of file changes, only SIGHUP works
+    var tick <-chan time.Time
+    if r.interval > 0 {
+        ticker := time.NewTicker(r.interval)
+        defer ticker.Stop()
+        tick = ticker.C
+    }
+
+    for {
+        select {
+        case <-hup:
+            r.log.Infof("SIGHUP received, reloading providers")
+            r.Reload()
+        case <-tick:
+            info, err := os.Stat(r.fileName)
+            if err != nil {
+                r.log.Warningf("Cannot stat providers file %s: %s", r.fileName, err)
+                continue
+            }
+            if !info.ModTime().Equal(r.modTime) {
+                r.log.Infof("Providers file %s changed, reloading", r.fileName)
+                r.modTime = info.ModTime()
+                r.Reload()
+            }
+        }
+    }
+}
+
+// Reload reads and validates providers file and swaps it with current set
+func (r *ProvidersReloader) Reload() error {
+
+    providers, err := readProviders(r.fileName)
+    if err != nil {
+        r.log.Errorf("Providers reload failed, keeping current providers: %s", err)
+        return err
+    }
+
+    if err = r.providers.Swap(providers); err != nil {
+        r.log.Errorf("Providers reload failed, keeping current providers: %s", err)
+        return err
+    }
+
+    r.log.Infof("Providers reloaded:")
+    for _, name := range r.providers.Names() {
+        r.log.Infof("- %s", name)
+    }
+
+    return nil
+}
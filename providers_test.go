@@ -0,0 +1,80 @@
+package main
+
+import (
+    "io/ioutil"
+    "net/url"
+    "os"
+    "strings"
+    "testing"
+)
+
+func writeProvidersFile(t *testing.T, content string) string {
+    f, err := ioutil.TempFile("", "providers-*.csv")
+    Ok(t, err)
+    _, err = f.WriteString(content)
+    Ok(t, err)
+    Ok(t, f.Close())
+    return f.Name()
+}
+
+func TestReadProviders(t *testing.T) {
+    fileName := writeProvidersFile(t, "#comment\n\nosm,0,18,256,http://[abc].tile.osm.org/{z}/{x}/{y}.png,\"OSM\"\n")
+    defer os.Remove(fileName)
+
+    providers, err := readProviders(fileName)
+    Ok(t, err)
+    Equals(t, 1, len(providers))
+    Equals(t, "http://{s}.tile.osm.org/{z}/{x}/{y}.png", providers["osm"].Url)
+    Equals(t, "abc", providers["osm"].SubDomains)
+}
+
+func TestReadProvidersInvalid(t *testing.T) {
+    fileName := writeProvidersFile(t, "osm,10,5,256,http://tile.osm.org/{z}/{x}/{y}.png,\"OSM\"\n")
+    defer os.Remove(fileName)
+
+    _, err := readProviders(fileName)
+    Equals(t, true, err != nil)
+}
+
+func TestProvidersSwap(t *testing.T) {
+    providers := NewProviders(map[string]Provider{"a": Provider{Name: "a"}})
+    _, exists := providers.Get("a")
+    Equals(t, true, exists)
+
+    Ok(t, providers.Swap(map[string]Provider{"b": Provider{Name: "b"}, "c": Provider{Name: "c"}}))
+    _, exists = providers.Get("a")
+    Equals(t, false, exists)
+    Equals(t, []string{"b", "c"}, providers.Names())
+
+    // first provider by name is default unless it is set
+    p, _ := providers.Default()
+    Equals(t, "b", p.Name)
+    Equals(t, true, providers.SetDefault("x") != nil)
+    Ok(t, providers.SetDefault("c"))
+    p, _ = providers.Default()
+    Equals(t, "c", p.Name)
+
+    // set without default provider is refused
+    Equals(t, true, providers.Swap(map[string]Provider{"b": Provider{Name: "b"}}) != nil)
+    Equals(t, []string{"b", "c"}, providers.Names())
+}
+
+func TestProviderChoices(t *testing.T) {
+    providers := NewProviders(map[string]Provider{
+        "a": Provider{Name: "a", MinZoom: 0, MaxZoom: 18, Scale: 256, Url: "http://a/{z}/{x}/{y}.png"},
+        "b": Provider{Name: "b", MinZoom: 12, MaxZoom: 14, Scale: 256, Url: "http://b/{z}/{x}/{y}.png"},
+    })
+    ip := InputParams{Zoom: 10, XMin: 10, YMin: 20, XMax: 12, YMax: 22}
+    ip.Provider, _ = providers.Get("a")
+
+    choices := providerChoices(providers, &ip)
+    Equals(t, 2, len(choices))
+    Equals(t, ProviderChoice{"a", "http://a/10/11/21.png", true}, choices[0])
+    // zoom is clamped to range of provider
+    Equals(t, ProviderChoice{"b", "http://b/12/44/84.png", false}, choices[1])
+
+    // links keep provider
+    u, _ := url.Parse("http://localhost/map")
+    Equals(t, true, strings.Contains(getMapUrl(*u, 10, 10, 20, 12, 22, "b", false), "provider=b"))
+    Equals(t, true, strings.Contains(getStitcherUrl(*u, &ip), "provider=a"))
+}
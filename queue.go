@@ -1,16 +1,13 @@
 package main
 
 import (
-    "encoding/json"
-    "io/ioutil"
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
     "os"
-    "image"
-    "image/draw"
-    "image/png"
-    "net/http"
-    "path"
     "path/filepath"
-    "reflect"
+    "sync"
     "time"
     "github.com/op/go-logging"
 )
@@ -19,24 +16,141 @@ const QUEUE_REQUEST_STATE_NEW = "new"
 const QUEUE_REQUEST_STATE_DONE = "done"
 const QUEUE_REQUEST_STATE_ERROR = "error"
 
+// subdirectory of queue directory for batch records
+const QUEUE_BATCH_DIR = "batches"
+
+// subdirectory of queue directory for tiles of requests being processed
+const QUEUE_SCRATCH_DIR = "scratch"
+
+// default lease of request claimed by worker
+const QUEUE_LEASE_DURATION = time.Minute
+
+// the shortest lease, leases expire with second precision and local
+// workers send heartbeats three times per lease
+const QUEUE_LEASE_MIN = time.Second * 3
+
+// temporary files older than this are left by crashed process, younger
+// ones could be written by other process sharing queue directory
+const QUEUE_TEMP_FILE_AGE = time.Hour
+
 type QueueRequest struct {
     Id string
+    // canonical key of params, requests with the same key are duplicates
+    Key string
     Params InputParams
     State string
     Created int64
+    FailedTiles []TileFailure
+    Priority int
+    // client address or user name, used for fair scheduling
+    Submitter string
+    // authenticated user who enqueued request (empty if authentication
+    // is disabled), only owner and admins can see the request
+    Owner string
+    // estimated cost of processing (number of tiles)
+    Cost int
+    // unix time of expiration, pinned requests don't expire
+    Expires int64
+    Pinned bool
+    // reason of failure of request in error state
+    Error string
+    // worker processing new request and unix time when its lease expires
+    // (unless it is extended by heartbeat)
+    Worker string
+    LeaseExpires int64
+    // webhooks notified when request is finished
+    Callbacks []string
+    // download links created by owner
+    Shares []Share
+}
+
+// EnqueueOptions are attributes of request given by submitter
+type EnqueueOptions struct {
+    Submitter string
+    Owner string
+    Priority int
+    // the highest priority submitter may choose (batch rows included)
+    MaxPriority int
+    // zero means default validity
+    Validity time.Duration
+    // url notified when request is finished (optional)
+    Callback string
+}
+
+// QueueConfig holds queue settings given by command line options
+type QueueConfig struct {
+    Dir string
+    // default time for request (generated image) to be kept in queue
+    Validity time.Duration
+    // bounds of validity chosen by submitter (zero means no bound)
+    ValidityMin time.Duration
+    ValidityMax time.Duration
+    // maximal total size of pinned images in bytes (zero means no limit)
+    PinnedQuota int64
+    // interval of checking store for requests enqueued by other processes
+    PollInterval time.Duration
+    // interval of removing expired requests
+    CleanupInterval time.Duration
+    // number of requests processed in parallel by server process
+    Workers int
+    // how long claimed request stays assigned to worker without heartbeat
+    LeaseDuration time.Duration
+    // maximal total size of queue directory in bytes (zero means no limit)
+    MaxSize int64
+    // disk space in bytes which must stay free when request is processed
+    MinFreeSpace int64
+    // the highest priority clients of web interface and api may choose
+    MaxClientPriority int
+    // urls notified about all finished requests
+    Webhooks []string
+    // secret used for signing of webhook payloads
+    WebhookSecret string
+    // validity of share links in webhook payloads
+    WebhookLinkValidity time.Duration
+    // url of server used in webhook payloads
+    PublicUrl string
+    // secret used for signing of download links (random if empty)
+    LinkSecret string
+    // rules for fetching of tiles and callbacks
+    Fetch FetchPolicyConfig
 }
 
 type Queue struct {
     log *logging.Logger
     dir string
-    validity time.Duration
-    interval time.Duration
+    config QueueConfig
+    stitcher *Stitcher
+    store JobStore
+    results ResultStore
+    notifier *Notifier
+    links *Links
+    policy *FetchPolicy
+
+    // wakes up idle workers when new request is enqueued
+    wake chan struct{}
+
+    // serializes changes of stored requests
+    mutex sync.Mutex
+    // submitter of last claimed request (for round robin scheduling)
+    lastSubmitter string
+    // requests processed by workers of this process
+    processing map[string]bool
+
+    // disk space reserved for outputs of requests being processed
+    spaceMutex sync.Mutex
+    reserved map[string]int64
+
+    workers sync.WaitGroup
+
+    // cancels requests being processed when shutdown grace period elapses
+    abortCtx context.Context
+    abort context.CancelFunc
 }
 
 // constructor
-func NewQueue(log *logging.Logger, dir string, validity, interval time.Duration) (*Queue, error) {
+func NewQueue(log *logging.Logger, store JobStore, results ResultStore, config QueueConfig) (*Queue, error) {
 
-    log.Debugf("Interval is %v", interval)
+    dir := config.Dir
 
     if _, err := os.Stat(dir); os.IsNotExist(err) {
         log.Infof("Creating queue directory: %s", dir)
@@ -46,228 +160,554 @@ func NewQueue(log *logging.Logger, dir string, validity, interval time.Duration)
         }
     }
 
-    q := &Queue{log: log, dir: dir, validity: validity, interval: interval}
+    batchDir := filepath.Join(dir, QUEUE_BATCH_DIR)
+    if _, err := os.Stat(batchDir); os.IsNotExist(err) {
+        if err = os.MkdirAll(batchDir, os.ModePerm); err != nil {
+            return nil, err
+        }
+    }
 
-    go q.monitor()
+    if config.PollInterval <= 0 {
+        return nil, fmt.Errorf("Queue monitor interval must be positive")
+    }
+    if config.CleanupInterval <= 0 {
+        return nil, fmt.Errorf("Queue cleanup interval must be positive")
+    }
+
+    if config.LeaseDuration == 0 {
+        config.LeaseDuration = QUEUE_LEASE_DURATION
+    }
+    if config.LeaseDuration < QUEUE_LEASE_MIN {
+        return nil, fmt.Errorf("Worker lease must be at least %s", QUEUE_LEASE_MIN)
+    }
+
+    if config.WebhookLinkValidity <= 0 {
+        config.WebhookLinkValidity = LINK_WEBHOOK_DURATION
+    }
+    if config.WebhookLinkValidity > LINK_SHARE_DURATION_MAX {
+        return nil, fmt.Errorf("Maximal validity of webhook links is %s", FormatDuration(LINK_SHARE_DURATION_MAX))
+    }
+
+    links, err := NewLinks(config.LinkSecret)
+    if err != nil {
+        return nil, err
+    }
+
+    policy := NewFetchPolicy(log, config.Fetch)
+
+    q := &Queue{
+        log: log,
+        dir: dir,
+        config: config,
+        stitcher: NewStitcher(log, policy),
+        store: store,
+        results: results,
+        notifier: NewNotifier(log, config.Webhooks, config.WebhookSecret, config.PublicUrl, filepath.Join(dir, WEBHOOK_LOG_FILE), links, config.WebhookLinkValidity, policy.CallbackClient()),
+        links: links,
+        policy: policy,
+        wake: make(chan struct{}, config.Workers),
+        reserved: make(map[string]int64),
+        processing: make(map[string]bool),
+    }
+    q.abortCtx, q.abort = context.WithCancel(context.Background())
+    q.notifier.share = q.CreateShare
 
     return q, nil
 }
 
-func (q *Queue) GetRequests() ([]*QueueRequest, error) {
+// Start runs workers processing requests and cleanup of expired requests
+// in background until context is cancelled. Queue which is not started can
+// still be used for enqueueing (e.g. from command line)
+func (q *Queue) Start(ctx context.Context) {
 
-    var requests []*QueueRequest
+    q.log.Infof("Starting queue with %d workers", q.config.Workers)
 
-    // read all files in queue directory
-    files, err := ioutil.ReadDir(q.dir)
-    if err != nil {
-        q.log.Errorf("Cannot read content of directory %s: %s", q.dir, err)
+    q.removeTemporaryFiles()
+    q.fixExpiration()
+    q.fixKeys()
+
+    for i := 0; i < q.config.Workers; i++ {
+        q.workers.Add(1)
+        go q.worker(ctx, i)
     }
 
-    for _, file := range files {
+    q.workers.Add(1)
+    go q.monitor(ctx)
 
-        // skip directories and no-json files
-        if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
-            continue
-        }
+    q.workers.Add(1)
+    go q.cleaner(ctx)
+}
 
-        // read content of json file
-        filePath := filepath.Join(q.dir, file.Name())
-        fileIn, err := ioutil.ReadFile(filePath)
-        if err != nil {
-            q.log.Warningf("Cannot read content of file %s: %s", filePath, err)
+// Wait blocks until all workers started by Start are finished
+func (q *Queue) Wait() {
+    q.workers.Wait()
+}
+
+// Shutdown waits for workers to finish requests being processed, context
+// given to Start must be already cancelled. Requests still running after
+// grace period are interrupted and left in queue to be processed again
+func (q *Queue) Shutdown(grace time.Duration) {
+
+    done := make(chan struct{})
+    go func() {
+        q.workers.Wait()
+        close(done)
+    }()
+
+    select {
+    case <-done:
+    case <-time.After(grace):
+        q.log.Warningf("Shutdown grace period elapsed, interrupting running requests")
+        q.abort()
+        <-done
+    }
+
+    // webhooks of finished requests are delivered (failed ones are
+    // attempted once more) within another grace period
+    q.notifier.Shutdown(grace)
+}
+
+// removeTemporaryFiles removes partially written files left in queue
+// directory by crashed or killed process. Files being written by other
+// processes (remote workers, other server) are recent, they are kept
+func (q *Queue) removeTemporaryFiles() {
+    files, err := filepath.Glob(filepath.Join(q.dir, ".*.tmp*"))
+    if err != nil {
+        return
+    }
+    for _, file := range files {
+        info, err := os.Stat(file)
+        if err != nil || time.Since(info.ModTime()) < QUEUE_TEMP_FILE_AGE {
             continue
         }
-        request := QueueRequest{}
-        err = json.Unmarshal([]byte(fileIn), &request)
-        if err != nil {
-            q.log.Warningf("Cannot parse json file %s: %s", filePath, err)
+        q.log.Infof("Removing temporary file %s", file)
+        os.Remove(file)
+    }
+}
+
+// notify wakes up one idle worker, it never blocks - if all workers
+// are busy, they pick up new request once they finish current one
+func (q *Queue) notify() {
+    select {
+    case q.wake <- struct{}{}:
+    default:
+    }
+}
+
+// GetRequest returns request of given id or nil if it doesn't exist
+func (q *Queue) GetRequest(id string) (*QueueRequest, error) {
+    return q.store.Get(id)
+}
+
+func (q *Queue) GetRequests() ([]*QueueRequest, error) {
+    return q.store.List()
+}
+
+// waiting returns new requests not leased by workers in order given by
+// scheduler (requests with expired lease are waiting again), must be called
+// with mutex locked
+func (q *Queue) waiting() ([]*QueueRequest, error) {
+
+    requests, err := q.store.ListByState(QUEUE_REQUEST_STATE_NEW)
+    if err != nil {
+        return nil, err
+    }
+
+    now := time.Now()
+    var waiting []*QueueRequest
+    for _, request := range requests {
+        if !leaseValid(request, now) {
+            waiting = append(waiting, request)
         }
+    }
+
+    return scheduleOrder(waiting, q.lastSubmitter, now), nil
+}
 
-        requests = append(requests, &request)
+// updateRequest applies change to stored request, changes made by
+// different goroutines (e.g. worker and http handler) are serialized
+func (q *Queue) updateRequest(id string, change func(request *QueueRequest) error) error {
+    q.mutex.Lock()
+    defer q.mutex.Unlock()
+
+    request, err := q.store.Get(id)
+    if err != nil {
+        return err
+    }
+    if request == nil {
+        return fmt.Errorf("Request %s not found", id)
     }
 
-    return requests, nil
+    if err = change(request); err != nil {
+        return err
+    }
+
+    return q.store.Put(request)
 }
 
-func (q *Queue) monitor() {
+// Positions returns position (starting from 1) of each waiting request,
+// requests being processed have position 0
+func (q *Queue) Positions() (map[string]int, error) {
+    q.mutex.Lock()
+    defer q.mutex.Unlock()
 
-    // infinite loop that is exited on closing of this routine
-    // by program exiting - no sync (channel) with main routine
-    for {
-        q.log.Debugf("Queue monitor iteration")
+    waiting, err := q.waiting()
+    if err != nil {
+        return nil, err
+    }
 
-        // read all files in queue directory
-        files, err := ioutil.ReadDir(q.dir)
-        if err != nil {
-            q.log.Errorf("Cannot read content of directory %s: %s", q.dir, err)
+    positions := make(map[string]int)
+    for i, request := range waiting {
+        positions[request.Id] = i + 1
+    }
+
+    requests, err := q.store.ListByState(QUEUE_REQUEST_STATE_NEW)
+    if err != nil {
+        return nil, err
+    }
+    for _, request := range requests {
+        if _, exists := positions[request.Id]; !exists {
+            positions[request.Id] = 0
         }
+    }
 
-        for _, file := range files {
+    return positions, nil
+}
 
-            // skip directories and no-json files
-            if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
-                continue
-            }
+func (q *Queue) worker(ctx context.Context, n int) {
+    defer q.workers.Done()
 
-            q.log.Debugf("- file %s", file.Name())
+    name := localWorkerName(n)
 
-            // read content of json file
-            filePath := filepath.Join(q.dir, file.Name())
-            fileIn, err := ioutil.ReadFile(filePath)
-            if err != nil {
-                q.log.Warningf("Cannot read content of file %s: %s", filePath, err)
-                continue
-            }
-            request := QueueRequest{}
-            err = json.Unmarshal([]byte(fileIn), &request)
-            if err != nil {
-                q.log.Warningf("Cannot parse json file %s: %s", filePath, err)
-            }
+    for {
+        request, err := q.Claim(name)
+        if err != nil {
+            q.log.Errorf("Cannot read new requests: %s", err)
+        }
 
-            // check request validity and delete expired requests
-            created := time.Unix(request.Created, 0)
-            if time.Since(created) > q.validity {
-                q.removeRequest(&request)
-                continue
-            }
+        if request != nil {
+            // there could be more requests waiting, pass the token
+            q.notify()
+
+            q.log.Debugf("Worker %d processing request %s", n, request.Id)
+            q.processRequest(request, name)
 
-            if request.State == QUEUE_REQUEST_STATE_NEW {
-                q.processRequest(&request)
+            if ctx.Err() != nil {
+                return
             }
+            continue
         }
 
-        time.Sleep(q.interval)
+        select {
+        case <-ctx.Done():
+            q.log.Debugf("Worker %d finished", n)
+            return
+        case <-q.wake:
+        }
     }
 }
 
-func GetJsonFileName(id string) string {
-    return id + ".json"
-}
+// monitor periodically reads requests enqueued by other processes and wakes
+// up workers
+func (q *Queue) monitor(ctx context.Context) {
+    defer q.workers.Done()
 
-func GetImageFileName(id string) string {
-    return id + ".png"
+    ticker := time.NewTicker(q.config.PollInterval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+
+        if err := q.store.Refresh(); err != nil {
+            q.log.Errorf("Cannot read new requests: %s", err)
+        }
+        q.notify()
+    }
 }
 
-func (q *Queue) processRequest(request *QueueRequest) {
-    q.log.Debugf("Processing request %s", request.Id)
+// cleaner periodically removes expired requests and batches
+func (q *Queue) cleaner(ctx context.Context) {
+    defer q.workers.Done()
 
-    err := q.generateRequestImage(request)
+    ticker := time.NewTicker(q.config.CleanupInterval)
+    defer ticker.Stop()
 
-    if err != nil {
-        q.log.Errorf("%s", err)
-        request.State = QUEUE_REQUEST_STATE_ERROR
-    } else {
-        request.State = QUEUE_REQUEST_STATE_DONE
+    for {
+        q.removeExpired()
+
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
     }
+}
+
+func (q *Queue) removeExpired() {
+    q.log.Debugf("Removing expired requests")
 
-    // update json file of new status
-    if err := q.writeRequestJson(request); err != nil {
-        q.log.Debugf("Cannot write to json file: %s", err)
+    expired, err := q.store.ListExpired(time.Now().Unix())
+    if err != nil {
+        q.log.Errorf("Cannot read expired requests: %s", err)
     }
+    for _, request := range expired {
+        q.removeExpiredRequest(request.Id)
+    }
+
+    q.removeExpiredBatches()
+
+    q.enforceSizeLimit()
 }
 
+// removeExpiredRequest removes request unless it is being processed or
+// leased.
+// Request is read again under lock, it could be claimed or pinned after it
+// was listed
+func (q *Queue) removeExpiredRequest(id string) {
+    q.mutex.Lock()
+    defer q.mutex.Unlock()
 
-func (q *Queue) generateRequestImage(request *QueueRequest) error {
-    q.log.Debugf("Generating image for request %s", request.Id)
+    request, err := q.store.Get(id)
+    if err != nil {
+        q.log.Errorf("Cannot read request %s: %s", id, err)
+        return
+    }
+    if request == nil || request.Pinned || request.Expires > time.Now().Unix() {
+        return
+    }
+    // request leased by worker (local or remote) is removed once it is
+    // finished or its lease expires
+    if q.processing[id] || leaseValid(request, time.Now()) {
+        q.log.Debugf("Expired request %s is being processed, it is removed later", id)
+        return
+    }
 
-    ip := request.Params
+    q.removeRequest(request)
+}
 
-    q.log.Debugf("Input params: %v", ip);
-    finalRect := image.Rectangle{image.Point{0, 0}, image.Point{(ip.XMax - ip.XMin + 1) * ip.Scale, (ip.YMax - ip.YMin + 1) * ip.Scale}}
-    q.log.Debugf("Final image size: %v", finalRect);
-    final := image.NewRGBA(finalRect)
+func GetJsonFileName(id string) string {
+    return id + ".json"
+}
+
+func GetImageFileName(id, format string) string {
+    if format == IMAGE_FORMAT_JPEG {
+        return id + ".jpg"
+    }
+    return id + ".png"
+}
 
-    // get tiles for current set of parameters
-    tiles := ip.Provider.getTiles(ip.XMin, ip.YMin, ip.XMax, ip.YMax, ip.Zoom, ip.Scale)
+// resultName is name of request image in result store
+func (q *Queue) resultName(request *QueueRequest) string {
+    return GetImageFileName(request.Id, request.Params.Format)
+}
 
-    // loop through all tiles
-    for i := 0; i < len(*tiles); i++ {
+// scratchDir is directory for intermediate state of request processing
+func (q *Queue) scratchDir(request *QueueRequest) string {
+    return filepath.Join(q.dir, QUEUE_SCRATCH_DIR, request.Id)
+}
 
-        t := (*tiles)[i]
+func (q *Queue) removeScratch(request *QueueRequest) {
+    if err := os.RemoveAll(q.scratchDir(request)); err != nil {
+        q.log.Warningf("Remove scratch directory of request %s failed: %s", request.Id, err)
+    }
+}
 
-        q.log.Debugf("Fetching tile %s (%d:%d)", t.Url, t.Left, t.Top);
-        res, err := http.Get(t.Url)
-        if err != nil || res.StatusCode != 200 {
-            // silently skip this tile
-            //WriteErrorResponse(w, http., fmt.Errorf("Only GET method is allowed"))
-            q.log.Warningf("Fetching tile %s failed", t.Url);
-            continue
-        }
-        defer res.Body.Close()
+func (q *Queue) processRequest(request *QueueRequest, worker string) {
+    q.log.Debugf("Processing request %s", request.Id)
 
-        m, format, err := image.Decode(res.Body)
-        if err != nil {
-            q.log.Warningf("Decoding tile image %s failed: %s", t.Url, err);
-            continue
+    // expired request is not removed while it is processed
+    q.mutex.Lock()
+    q.processing[request.Id] = true
+    q.mutex.Unlock()
+    defer func() {
+        q.mutex.Lock()
+        delete(q.processing, request.Id)
+        q.mutex.Unlock()
+    }()
+
+    // processing is interrupted by shutdown or loss of lease
+    ctx, cancel := context.WithCancel(q.abortCtx)
+    defer cancel()
+    go keepLease(ctx, q.config.LeaseDuration / 3, func() error {
+        return q.Heartbeat(request.Id, worker)
+    }, func(err error) {
+        q.log.Errorf("%s", err)
+        cancel()
+    })
+
+    // request which doesn't fit fails before any tile is fetched
+    var imageFile string
+    err := q.reserveSpace(request)
+    if err == nil {
+        imageFile, err = generateImage(ctx, q.log, q.stitcher, request, q.scratchDir(request))
+        q.releaseSpace(request)
+    }
+
+    // request interrupted by shutdown stays new, it is processed again
+    // once server is started
+    if err != nil && q.abortCtx.Err() != nil {
+        q.log.Warningf("Processing of request %s interrupted, it will be resumed on next start", request.Id)
+        if err := q.Release(request.Id, worker); err != nil {
+            q.log.Errorf("Cannot release request %s: %s", request.Id, err)
         }
+        return
+    }
 
-        q.log.Debugf("Decoding tile image passed (format: %s)", format);
+    // request was reclaimed by other worker
+    if err != nil && ctx.Err() != nil {
+        q.log.Warningf("Processing of request %s abandoned, lease was lost", request.Id)
+        return
+    }
 
-        // put fetched tile image at proper place in final image
-        finalPoint := image.Point{t.Left * ip.Scale, t.Top * ip.Scale}
-        finalRect := m.Bounds().Add(finalPoint)
+    failure := ""
+    if err != nil {
+        q.log.Errorf("%s", err)
+        failure = err.Error()
+    }
 
-        q.log.Debugf("Putting tile at %v", finalRect)
-        draw.Draw(final, finalRect, m, image.Point{}, draw.Over)
+    if err = q.Complete(request.Id, worker, imageFile, request.FailedTiles, failure); err != nil {
+        q.log.Errorf("Cannot store request %s: %s", request.Id, err)
+        return
     }
 
-    // save to image file (PNG)
-    out, err := os.Create(filepath.Join(q.dir, GetImageFileName(request.Id)))
+    q.removeScratch(request)
+}
+
+// generateImage stitches image of request, tiles are cached in scratch
+// directory (so processing can be resumed) and image is written there as
+// well. Failed tiles are set to request
+func generateImage(ctx context.Context, log *logging.Logger, stitcher *Stitcher, request *QueueRequest, scratchDir string) (string, error) {
+    log.Debugf("Generating image for request %s", request.Id)
+
+    // tiles fetched before crash or restart are reused
+    cache, err := NewDirTileCache(scratchDir)
     if err != nil {
-        return err
+        return "", err
+    }
+    if count := cache.Count(); count > 0 {
+        log.Infof("Resuming request %s, %d tiles already fetched", request.Id, count)
     }
 
-    err = png.Encode(out, final)
+    final, failures, err := stitcher.Stitch(ctx, &request.Params, cache)
     if err != nil {
-        return err
+        return "", err
+    }
+    request.FailedTiles = failures
+
+    // grids and cartouche are drawn after compositing, grid labels may add
+    // margins to image
+    if final, err = decorateImage(final, &request.Params); err != nil {
+        return "", err
+    }
+
+    fileName := filepath.Join(scratchDir, GetImageFileName(request.Id, request.Params.Format))
+    if err = writeImage(fileName, final, request.Params.Format); err != nil {
+        return "", err
     }
 
-    return nil
+    return fileName, nil
 }
 
 func (q *Queue) removeRequest(request *QueueRequest) {
     q.log.Debugf("Remove request %v", request.Id)
 
-    // delete generated png file
-    if err := os.Remove(path.Join(q.dir, GetImageFileName(request.Id))); err != nil {
-        q.log.Warningf("Remove image file for request %s failed: %s", request.Id, err)
+    // delete generated image
+    if err := q.results.Delete(q.resultName(request)); err != nil && !os.IsNotExist(err) {
+        q.log.Warningf("Remove image of request %s failed: %s", request.Id, err)
     }
 
-    // delete json file
-    if err := os.Remove(path.Join(q.dir, GetJsonFileName(request.Id))); err != nil {
-        q.log.Warningf("Remove json file for request %s failed: %s", request.Id, err)
+    q.removeScratch(request)
+
+    if err := q.store.Delete(request.Id); err != nil {
+        q.log.Warningf("Remove request %s from store failed: %s", request.Id, err)
     }
 }
 
-func (q Queue) writeRequestJson(request *QueueRequest) error {
+// jobKey returns key of job, requests of different owners are never
+// deduplicated, owner could see results of other user otherwise
+func jobKey(ip *InputParams, owner string) string {
+    if len(owner) == 0 {
+        return ip.Key()
+    }
+    hash := sha256.Sum256([]byte(ip.Key() + "\n" + owner))
+    return hex.EncodeToString(hash[:])
+}
 
-    // store queue record attributes to json file
-    requestJson, err := json.MarshalIndent(request, "", " ")
+// fixKeys sets job keys of requests stored by versions without
+// deduplication by key
+func (q *Queue) fixKeys() {
+    requests, err := q.store.List()
     if err != nil {
-        return err
+        q.log.Errorf("Cannot read requests: %s", err)
+        return
+    }
+    for _, r := range requests {
+        if len(r.Key) == 0 {
+            r.Key = jobKey(&r.Params, r.Owner)
+            if err := q.store.Put(r); err != nil {
+                q.log.Errorf("Cannot store request %s: %s", r.Id, err)
+            }
+        }
     }
-
-    err = ioutil.WriteFile(path.Join(q.dir, GetJsonFileName(request.Id)), requestJson, 0644)
-    return err
 }
 
-func (q *Queue) Enqueue(ip *InputParams) (*QueueRequest, error) {
+// Enqueue creates new request or returns existing request of the same job
+// key. Failed request is processed again when it is enqueued repeatedly
+func (q *Queue) Enqueue(ip *InputParams, options EnqueueOptions) (*QueueRequest, error) {
+    q.mutex.Lock()
+    defer q.mutex.Unlock()
 
-    // 1. first look if same request already exist
+    key := jobKey(ip, options.Owner)
+    expires := time.Now().Add(q.clampValidity(options.Validity)).Unix()
 
-    // get current list of all queued requests
-    requests, err := q.GetRequests()
+    // 1. first look if same request already exist
+    request, err := q.store.GetByKey(key)
     if err != nil {
         return nil, err
     }
 
-    for _, r := range requests {
+    if request != nil {
+        q.log.Debugf("Detected request with same params as existing request: %s", request.Id)
+
+        // existing request is kept at least as long as the new one would be
+        if !request.Pinned && expires > request.Expires {
+            request.Expires = expires
+        }
+
+        // finished request is reported to new callback immediately
+        notify := false
+        if len(options.Callback) > 0 && !containsString(request.Callbacks, options.Callback) {
+            request.Callbacks = append(request.Callbacks, options.Callback)
+            notify = request.State == QUEUE_REQUEST_STATE_DONE
+        }
 
-        // if same request alrady exist, return it and don't generate new one
-        if reflect.DeepEqual(r.Params, *ip) {
-            q.log.Debugf("Detected request with same params as existing request: %s", r.Id)
-            return r, nil
+        if request.State == QUEUE_REQUEST_STATE_ERROR {
+            q.log.Infof("Failed request %s enqueued again", request.Id)
+            request.State = QUEUE_REQUEST_STATE_NEW
+            request.Error = ""
+            request.FailedTiles = nil
+            request.Worker = ""
+            request.LeaseExpires = 0
+            request.Priority = options.Priority
+            request.Submitter = options.Submitter
         }
+
+        if err := q.store.Put(request); err != nil {
+            return nil, err
+        }
+
+        if request.State == QUEUE_REQUEST_STATE_NEW {
+            q.notify()
+        }
+        if notify {
+            q.notifier.Notify(request, options.Callback)
+        }
+
+        return request, nil
     }
 
     // 2. create new request
@@ -278,10 +718,27 @@ func (q *Queue) Enqueue(ip *InputParams) (*QueueRequest, error) {
     q.log.Debugf("New request in queue: %s", id)
 
     // create new queue record
-    request:= QueueRequest{id, *ip, QUEUE_REQUEST_STATE_NEW, time.Now().Unix()}
+    request = &QueueRequest{
+        Id: id,
+        Key: key,
+        Params: *ip,
+        State: QUEUE_REQUEST_STATE_NEW,
+        Created: time.Now().Unix(),
+        Priority: options.Priority,
+        Submitter: options.Submitter,
+        Owner: options.Owner,
+        Cost: ip.TilesCount(),
+        Expires: expires,
+    }
+    if len(options.Callback) > 0 {
+        request.Callbacks = []string{options.Callback}
+    }
 
-    if err := q.writeRequestJson(&request); err != nil {
+    if err := q.store.Put(request); err != nil {
         return nil, err
     }
-    return &request, nil
+
+    q.notify()
+
+    return request, nil
 }
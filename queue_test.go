@@ -0,0 +1,370 @@
+package main
+
+import (
+    "context"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+    "github.com/op/go-logging"
+)
+
+func newTestQueue(t *testing.T, workers int) (*Queue, func()) {
+    dir, err := ioutil.TempDir("", "queue")
+    Ok(t, err)
+
+    log := logging.MustGetLogger("test")
+    store, err := NewFileJobStore(log, dir)
+    Ok(t, err)
+
+    // long intervals, requests must be dispatched by enqueue
+    q, err := NewQueue(log, store, NewLocalResultStore(dir), QueueConfig{
+        Dir: dir,
+        Validity: time.Hour,
+        PollInterval: time.Hour,
+        CleanupInterval: time.Hour,
+        Workers: workers,
+        Fetch: FetchPolicyConfig{AllowPrivate: true},
+    })
+    Ok(t, err)
+
+    return q, func() { os.RemoveAll(dir) }
+}
+
+// waitForState polls store until request reaches given state
+func waitForState(t *testing.T, q *Queue, id, state string) *QueueRequest {
+    deadline := time.Now().Add(5 * time.Second)
+    for time.Now().Before(deadline) {
+        r, err := q.GetRequest(id)
+        Ok(t, err)
+        if r != nil && r.State == state {
+            return r
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    t.Fatalf("Request %s didn't reach state %s", id, state)
+    return nil
+}
+
+func TestQueueDispatch(t *testing.T) {
+    ts := newTestTileServer()
+    defer ts.Close()
+
+    q, cleanup := newTestQueue(t, 2)
+    defer cleanup()
+
+    ctx, cancel := context.WithCancel(context.Background())
+    q.Start(ctx)
+
+    p := Provider{Name: "test", MinZoom: 0, MaxZoom: 5, Scale: 4, Url: ts.URL + "/{z}/{x}/{y}.png"}
+
+    var ids []string
+    for zoom := 2; zoom < 5; zoom++ {
+        ip := InputParams{Zoom: zoom, XMin: 0, YMin: 0, XMax: 1, YMax: 1, Scale: 4, Provider: p}
+        ip.Normalize()
+        r, err := q.Enqueue(&ip, EnqueueOptions{})
+        Ok(t, err)
+        ids = append(ids, r.Id)
+    }
+
+    for _, id := range ids {
+        r := waitForState(t, q, id, QUEUE_REQUEST_STATE_DONE)
+        _, err := q.results.Size(q.resultName(r))
+        Ok(t, err)
+    }
+
+    cancel()
+    q.Wait()
+}
+
+func TestQueueShutdownInterrupts(t *testing.T) {
+    // tile server which never answers in time
+    block := make(chan struct{})
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        select {
+        case <-block:
+        case <-r.Context().Done():
+        }
+    }))
+    defer ts.Close()
+    defer close(block)
+
+    q, cleanup := newTestQueue(t, 1)
+    defer cleanup()
+
+    ctx, cancel := context.WithCancel(context.Background())
+    q.Start(ctx)
+
+    p := Provider{Name: "test", MinZoom: 0, MaxZoom: 5, Scale: 4, Url: ts.URL + "/{z}/{x}/{y}.png"}
+    ip := InputParams{Zoom: 1, XMin: 0, YMin: 0, XMax: 1, YMax: 1, Scale: 4, Provider: p}
+    ip.Normalize()
+    r, err := q.Enqueue(&ip, EnqueueOptions{})
+    Ok(t, err)
+
+    // give worker time to start processing
+    time.Sleep(100 * time.Millisecond)
+
+    cancel()
+    q.Shutdown(100 * time.Millisecond)
+
+    r, err = q.GetRequest(r.Id)
+    Ok(t, err)
+    Equals(t, QUEUE_REQUEST_STATE_NEW, r.State)
+    _, err = q.results.Size(q.resultName(r))
+    Equals(t, true, os.IsNotExist(err))
+}
+
+func TestQueuePin(t *testing.T) {
+    ts := newTestTileServer()
+    defer ts.Close()
+
+    q, cleanup := newTestQueue(t, 1)
+    defer cleanup()
+    q.config.ValidityMax = time.Hour * 2
+    q.config.PinnedQuota = 1
+
+    ctx, cancel := context.WithCancel(context.Background())
+    q.Start(ctx)
+    defer q.Wait()
+    defer cancel()
+
+    p := Provider{Name: "test", MinZoom: 0, MaxZoom: 5, Scale: 4, Url: ts.URL + "/{z}/{x}/{y}.png"}
+    ip := InputParams{Zoom: 1, XMin: 0, YMin: 0, XMax: 1, YMax: 1, Scale: 4, Provider: p}
+    ip.Normalize()
+
+    // validity is limited by maximum
+    r, err := q.Enqueue(&ip, EnqueueOptions{Validity: time.Hour * 24})
+    Ok(t, err)
+    Equals(t, true, r.Expires <= time.Now().Add(time.Hour * 2).Unix())
+
+    waitForState(t, q, r.Id, QUEUE_REQUEST_STATE_DONE)
+
+    // image doesn't fit into quota
+    Equals(t, true, q.Pin(r.Id, true) != nil)
+
+    q.config.PinnedQuota = 1 << 20
+    Ok(t, q.Pin(r.Id, true))
+
+    expired, err := q.store.ListExpired(time.Now().Add(time.Hour * 24).Unix())
+    Ok(t, err)
+    Equals(t, 0, len(expired))
+}
+
+func TestQueueExpiredProcessing(t *testing.T) {
+    q, cleanup := newTestQueue(t, 1)
+    defer cleanup()
+
+    p := Provider{Name: "test", MinZoom: 0, MaxZoom: 5, Scale: 4, Url: "http://127.0.0.1:1/{z}/{x}/{y}.png"}
+    ip := InputParams{Zoom: 1, XMin: 0, YMin: 0, XMax: 1, YMax: 1, Scale: 4, Provider: p}
+    ip.Normalize()
+
+    r, err := q.Enqueue(&ip, EnqueueOptions{})
+    Ok(t, err)
+    Ok(t, q.updateRequest(r.Id, func(request *QueueRequest) error {
+        request.Expires = time.Now().Add(-time.Minute).Unix()
+        return nil
+    }))
+
+    // request being processed is kept
+    q.processing[r.Id] = true
+    q.removeExpired()
+    stored, err := q.GetRequest(r.Id)
+    Ok(t, err)
+    Equals(t, true, stored != nil)
+
+    delete(q.processing, r.Id)
+    q.removeExpired()
+    stored, err = q.GetRequest(r.Id)
+    Ok(t, err)
+    Equals(t, (*QueueRequest)(nil), stored)
+}
+
+func TestQueueExpiredLeased(t *testing.T) {
+    q, cleanup := newTestQueue(t, 1)
+    defer cleanup()
+
+    p := Provider{Name: "test", MinZoom: 0, MaxZoom: 5, Scale: 4, Url: "http://127.0.0.1:1/{z}/{x}/{y}.png"}
+    ip := InputParams{Zoom: 1, XMin: 0, YMin: 0, XMax: 1, YMax: 1, Scale: 4, Provider: p}
+    ip.Normalize()
+
+    r, err := q.Enqueue(&ip, EnqueueOptions{})
+    Ok(t, err)
+    claimed, err := q.Claim("remote")
+    Ok(t, err)
+    Equals(t, r.Id, claimed.Id)
+    Ok(t, q.updateRequest(r.Id, func(request *QueueRequest) error {
+        request.Expires = time.Now().Add(-time.Minute).Unix()
+        return nil
+    }))
+
+    // request with live lease is kept
+    q.removeExpired()
+    stored, err := q.GetRequest(r.Id)
+    Ok(t, err)
+    Equals(t, true, stored != nil)
+
+    // lease expired, worker is gone
+    Ok(t, q.updateRequest(r.Id, func(request *QueueRequest) error {
+        request.LeaseExpires = time.Now().Add(-time.Minute).Unix()
+        return nil
+    }))
+    q.removeExpired()
+    stored, err = q.GetRequest(r.Id)
+    Ok(t, err)
+    Equals(t, (*QueueRequest)(nil), stored)
+}
+
+func TestQueueRemoveTemporaryFiles(t *testing.T) {
+    q, cleanup := newTestQueue(t, 1)
+    defer cleanup()
+
+    stale := filepath.Join(q.dir, ".a.png.tmp123")
+    fresh := filepath.Join(q.dir, ".b.png.tmp456")
+    Ok(t, ioutil.WriteFile(stale, []byte("x"), 0644))
+    Ok(t, ioutil.WriteFile(fresh, []byte("x"), 0644))
+    old := time.Now().Add(-QUEUE_TEMP_FILE_AGE * 2)
+    Ok(t, os.Chtimes(stale, old, old))
+
+    // file possibly written by other process is kept
+    q.removeTemporaryFiles()
+    _, err := os.Stat(stale)
+    Equals(t, true, os.IsNotExist(err))
+    _, err = os.Stat(fresh)
+    Ok(t, err)
+}
+
+func TestParseValidity(t *testing.T) {
+    d, err := ParseValidity("7d")
+    Ok(t, err)
+    Equals(t, time.Hour * 24 * 7, d)
+
+    d, err = ParseValidity("36h")
+    Ok(t, err)
+    Equals(t, "1d 12h", FormatDuration(d))
+
+    _, err = ParseValidity("x")
+    Equals(t, true, err != nil)
+}
+
+func TestEstimateRequestSize(t *testing.T) {
+    // @2x request of provider with 256 px tiles is estimated by its own scale
+    p := Provider{Name: "test", MinZoom: 0, MaxZoom: 5, Scale: 256}
+    ip := InputParams{Zoom: 2, XMin: 0, YMin: 0, XMax: 1, YMax: 0, Scale: 512, Provider: p}
+    Equals(t, int64(2 * 512 * 512 * 4 + 2 * TILE_ESTIMATED_SIZE), estimateRequestSize(&ip))
+
+    ip.Format = IMAGE_FORMAT_JPEG
+    Equals(t, int64(2 * 512 * 512 + 2 * TILE_ESTIMATED_SIZE), estimateRequestSize(&ip))
+}
+
+func TestQueueSizeLimit(t *testing.T) {
+    ts := newTestTileServer()
+    defer ts.Close()
+
+    q, cleanup := newTestQueue(t, 1)
+    defer cleanup()
+
+    p := Provider{Name: "test", MinZoom: 0, MaxZoom: 5, Scale: 4, Url: ts.URL + "/{z}/{x}/{y}.png"}
+    ip := InputParams{Zoom: 2, XMin: 0, YMin: 0, XMax: 0, YMax: 0, Scale: 4, Provider: p}
+    ip.Normalize()
+    size := estimateRequestSize(&ip)
+
+    // finished requests, the oldest one is pinned
+    var old []*QueueRequest
+    for i := 0; i < 3; i++ {
+        r := &QueueRequest{Id: UniqueId(), Params: ip, State: QUEUE_REQUEST_STATE_DONE, Created: int64(i + 1), Pinned: i == 0}
+        Ok(t, q.store.Put(r))
+        Ok(t, ioutil.WriteFile(filepath.Join(q.dir, q.resultName(r)), make([]byte, size), 0644))
+        old = append(old, r)
+    }
+
+    used, err := dirSize(q.dir)
+    Ok(t, err)
+
+    // space for one more request, the oldest unpinned one is evicted
+    q.config.MaxSize = used + size / 2
+    r := &QueueRequest{Id: UniqueId(), Params: ip, State: QUEUE_REQUEST_STATE_NEW}
+    Ok(t, q.reserveSpace(r))
+    q.releaseSpace(r)
+
+    for i, expected := range []bool{true, false, true} {
+        stored, err := q.store.Get(old[i].Id)
+        Ok(t, err)
+        Equals(t, expected, stored != nil)
+    }
+
+    // request bigger than limit fails early
+    q.config.MaxSize = size - 1
+    ip.Zoom = 3
+    _, err = q.Enqueue(&ip, EnqueueOptions{})
+    Ok(t, err)
+    r, err = q.Claim("test")
+    Ok(t, err)
+    q.processRequest(r, "test")
+    r, err = q.GetRequest(r.Id)
+    Ok(t, err)
+    Equals(t, QUEUE_REQUEST_STATE_ERROR, r.State)
+    Equals(t, true, len(r.Error) > 0)
+    _, err = os.Stat(q.scratchDir(r))
+    Equals(t, true, os.IsNotExist(err))
+}
+
+func TestQueueDeduplication(t *testing.T) {
+    q, cleanup := newTestQueue(t, 1)
+    defer cleanup()
+
+    p := Provider{Name: "test", MinZoom: 0, MaxZoom: 5, Scale: 4, Url: "http://{s}.example.com/{z}/{x}/{y}.png", Attribution: "A"}
+    ip := InputParams{Zoom: 2, XMin: 0, YMin: 0, XMax: 1, YMax: 1, Scale: 4, Provider: p}
+    ip.Normalize()
+
+    r1, err := q.Enqueue(&ip, EnqueueOptions{})
+    Ok(t, err)
+
+    // attribution and subdomains don't affect image
+    dup := ip
+    dup.Provider.Attribution = "B"
+    dup.Provider.SubDomains = "abc"
+    r2, err := q.Enqueue(&dup, EnqueueOptions{})
+    Ok(t, err)
+    Equals(t, r1.Id, r2.Id)
+
+    dup.Zoom = 3
+    r3, err := q.Enqueue(&dup, EnqueueOptions{})
+    Ok(t, err)
+    Equals(t, true, r1.Id != r3.Id)
+
+    // failed request is enqueued again
+    Ok(t, q.updateRequest(r1.Id, func(r *QueueRequest) error {
+        r.State = QUEUE_REQUEST_STATE_ERROR
+        r.Error = "failure"
+        return nil
+    }))
+    r2, err = q.Enqueue(&ip, EnqueueOptions{Submitter: "x"})
+    Ok(t, err)
+    Equals(t, r1.Id, r2.Id)
+    Equals(t, QUEUE_REQUEST_STATE_NEW, r2.State)
+    Equals(t, "", r2.Error)
+    Equals(t, "x", r2.Submitter)
+}
+
+func TestQueueConfigIntervals(t *testing.T) {
+    dir, err := ioutil.TempDir("", "queue")
+    Ok(t, err)
+    defer os.RemoveAll(dir)
+
+    log := logging.MustGetLogger("test")
+    store, err := NewFileJobStore(log, dir)
+    Ok(t, err)
+
+    // zero intervals (and too short lease) would make tickers panic
+    for _, config := range []QueueConfig{
+        {Dir: dir, PollInterval: 0, CleanupInterval: time.Hour},
+        {Dir: dir, PollInterval: time.Hour, CleanupInterval: -time.Second},
+        {Dir: dir, PollInterval: time.Hour, CleanupInterval: time.Hour, LeaseDuration: time.Nanosecond},
+    } {
+        _, err = NewQueue(log, store, NewLocalResultStore(dir), config)
+        Equals(t, true, err != nil)
+    }
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+    "path/filepath"
+)
+
+const RESULT_STORE_LOCAL = "local"
+const RESULT_STORE_S3 = "s3"
+
+// ResultStore keeps generated images. Results are identified by name
+// (file name of image), missing results are reported by errors satisfying
+// os.IsNotExist
+type ResultStore interface {
+    // Put moves local file to store under given name
+    Put(name, fileName string) error
+
+    // Open returns content of stored result
+    Open(name string) (io.ReadCloser, error)
+
+    // Size returns size of stored result in bytes
+    Size(name string) (int64, error)
+
+    Delete(name string) error
+
+    // Serve sends result to client, either directly or by redirect
+    Serve(w http.ResponseWriter, r *http.Request, name string)
+}
+
+// OpenResultStore creates result store of given kind, local results are
+// kept in queue directory
+func OpenResultStore(kind, dir string, s3Config S3Config) (ResultStore, error) {
+    switch kind {
+    case RESULT_STORE_LOCAL:
+        return NewLocalResultStore(dir), nil
+    case RESULT_STORE_S3:
+        return NewS3ResultStore(s3Config)
+    }
+    return nil, fmt.Errorf("Unknown result store: %s", kind)
+}
+
+// LocalResultStore keeps results as files in directory
+type LocalResultStore struct {
+    dir string
+}
+
+// constructor
+func NewLocalResultStore(dir string) *LocalResultStore {
+    return &LocalResultStore{dir: dir}
+}
+
+func (s *LocalResultStore) path(name string) string {
+    return filepath.Join(s.dir, filepath.Base(name))
+}
+
+// Put renames file, so it must be on the same filesystem as store directory
+func (s *LocalResultStore) Put(name, fileName string) error {
+    return os.Rename(fileName, s.path(name))
+}
+
+func (s *LocalResultStore) Open(name string) (io.ReadCloser, error) {
+    return os.Open(s.path(name))
+}
+
+func (s *LocalResultStore) Size(name string) (int64, error) {
+    info, err := os.Stat(s.path(name))
+    if err != nil {
+        return 0, err
+    }
+    return info.Size(), nil
+}
+
+func (s *LocalResultStore) Delete(name string) error {
+    return os.Remove(s.path(name))
+}
+
+func (s *LocalResultStore) Serve(w http.ResponseWriter, r *http.Request, name string) {
+    f, err := os.Open(s.path(name))
+    if err != nil {
+        http.NotFound(w, r)
+        return
+    }
+    defer f.Close()
+
+    info, err := f.Stat()
+    if err != nil {
+        WriteErrorResponse(w, 500, err)
+        return
+    }
+
+    http.ServeContent(w, r, name, info.ModTime(), f)
+}
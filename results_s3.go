@@ -0,0 +1,320 @@
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "mime"
+    "net/http"
+    "net/url"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const S3_ALGORITHM = "AWS4-HMAC-SHA256"
+const S3_UNSIGNED_PAYLOAD = "UNSIGNED-PAYLOAD"
+
+// hash of empty payload (requests without body)
+const S3_EMPTY_PAYLOAD = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Config holds settings of S3 compatible object storage
+type S3Config struct {
+    // e.g. https://s3.eu-central-1.amazonaws.com or http://localhost:9000
+    Endpoint string
+    Bucket string
+    Region string
+    AccessKey string
+    SecretKey string
+    // prefix of object names (e.g. bsbigmap/)
+    Prefix string
+    // validity of pre-signed download urls, zero means that downloads are
+    // streamed through server
+    PresignExpiry time.Duration
+}
+
+// S3ResultStore keeps results as objects in S3 compatible storage (AWS S3,
+// MinIO, ...), objects are addressed in path style (endpoint/bucket/object)
+type S3ResultStore struct {
+    config S3Config
+    client *http.Client
+}
+
+// constructor
+func NewS3ResultStore(config S3Config) (*S3ResultStore, error) {
+    if len(config.Endpoint) == 0 || len(config.Bucket) == 0 {
+        return nil, fmt.Errorf("S3 endpoint and bucket must be set")
+    }
+    if _, err := url.Parse(config.Endpoint); err != nil {
+        return nil, fmt.Errorf("Cannot parse S3 endpoint %s: %s", config.Endpoint, err)
+    }
+    if len(config.Region) == 0 {
+        config.Region = "us-east-1"
+    }
+    return &S3ResultStore{config: config, client: &http.Client{}}, nil
+}
+
+// objectUrl returns url of object of given result
+func (s *S3ResultStore) objectUrl(name string) *url.URL {
+    u, _ := url.Parse(strings.TrimSuffix(s.config.Endpoint, "/"))
+    u.Path = u.Path + "/" + s.config.Bucket + "/" + s.config.Prefix + filepath.Base(name)
+    return u
+}
+
+// s3Escape encodes string as required by signature (everything except
+// unreserved characters, space is %20)
+func s3Escape(s string, keepSlash bool) string {
+    var b strings.Builder
+    for _, c := range []byte(s) {
+        switch {
+        case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+            b.WriteByte(c)
+        case c == '/' && keepSlash:
+            b.WriteByte(c)
+        default:
+            fmt.Fprintf(&b, "%%%02X", c)
+        }
+    }
+    return b.String()
+}
+
+func s3CanonicalQuery(query url.Values) string {
+    var params []string
+    for key, values := range query {
+        for _, value := range values {
+            params = append(params, s3Escape(key, false) + "=" + s3Escape(value, false))
+        }
+    }
+    sort.Strings(params)
+    return strings.Join(params, "&")
+}
+
+func hmacSha256(key []byte, data string) []byte {
+    h := hmac.New(sha256.New, key)
+    h.Write([]byte(data))
+    return h.Sum(nil)
+}
+
+func s3Scope(now time.Time, region string) string {
+    return now.UTC().Format("20060102") + "/" + region + "/s3/aws4_request"
+}
+
+// s3Signature computes signature (version 4) of request given by method,
+// url (path and query), signed headers (lowercase names) and payload hash
+func s3Signature(secretKey, region string, now time.Time, method string, u *url.URL, headers map[string]string, payloadHash string) (signature, signedHeaders string) {
+
+    var names []string
+    for name := range headers {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    var canonicalHeaders strings.Builder
+    for _, name := range names {
+        canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+    }
+    signedHeaders = strings.Join(names, ";")
+
+    path := u.Path
+    if len(path) == 0 {
+        path = "/"
+    }
+
+    canonicalRequest := strings.Join([]string{
+        method,
+        s3Escape(path, true),
+        s3CanonicalQuery(u.Query()),
+        canonicalHeaders.String(),
+        signedHeaders,
+        payloadHash,
+    }, "\n")
+
+    hash := sha256.Sum256([]byte(canonicalRequest))
+    stringToSign := strings.Join([]string{
+        S3_ALGORITHM,
+        now.UTC().Format("20060102T150405Z"),
+        s3Scope(now, region),
+        hex.EncodeToString(hash[:]),
+    }, "\n")
+
+    key := hmacSha256([]byte("AWS4" + secretKey), now.UTC().Format("20060102"))
+    key = hmacSha256(key, region)
+    key = hmacSha256(key, "s3")
+    key = hmacSha256(key, "aws4_request")
+
+    return hex.EncodeToString(hmacSha256(key, stringToSign)), signedHeaders
+}
+
+// s3Presign returns url which can be used without credentials until it expires
+func s3Presign(accessKey, secretKey, region, method string, u *url.URL, now time.Time, expires time.Duration) string {
+    query := u.Query()
+    query.Set("X-Amz-Algorithm", S3_ALGORITHM)
+    query.Set("X-Amz-Credential", accessKey + "/" + s3Scope(now, region))
+    query.Set("X-Amz-Date", now.UTC().Format("20060102T150405Z"))
+    query.Set("X-Amz-Expires", strconv.Itoa(int(expires / time.Second)))
+    query.Set("X-Amz-SignedHeaders", "host")
+
+    signed := *u
+    signed.RawQuery = s3CanonicalQuery(query)
+
+    signature, _ := s3Signature(secretKey, region, now, method, &signed, map[string]string{"host": u.Host}, S3_UNSIGNED_PAYLOAD)
+
+    signed.RawQuery += "&X-Amz-Signature=" + signature
+    return signed.String()
+}
+
+// sign adds authorization headers to request
+func (s *S3ResultStore) sign(req *http.Request, payloadHash string) {
+    now := time.Now()
+    req.Header.Set("X-Amz-Date", now.UTC().Format("20060102T150405Z"))
+    req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+    headers := map[string]string{
+        "host": req.URL.Host,
+        "x-amz-date": req.Header.Get("X-Amz-Date"),
+        "x-amz-content-sha256": payloadHash,
+    }
+    signature, signedHeaders := s3Signature(s.config.SecretKey, s.config.Region, now, req.Method, req.URL, headers, payloadHash)
+
+    req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+        S3_ALGORITHM, s.config.AccessKey, s3Scope(now, s.config.Region), signedHeaders, signature))
+}
+
+// do sends signed request without body, response with status other than
+// 2xx is returned as error (404 as os.ErrNotExist)
+func (s *S3ResultStore) do(method, name string, header http.Header) (*http.Response, error) {
+    req, err := http.NewRequest(method, s.objectUrl(name).String(), nil)
+    if err != nil {
+        return nil, err
+    }
+    for key, values := range header {
+        req.Header[key] = values
+    }
+    s.sign(req, S3_EMPTY_PAYLOAD)
+
+    resp, err := s.client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    if resp.StatusCode == http.StatusNotFound {
+        resp.Body.Close()
+        return nil, os.ErrNotExist
+    }
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        resp.Body.Close()
+        return nil, fmt.Errorf("S3 %s of %s failed: %s", method, name, resp.Status)
+    }
+    return resp, nil
+}
+
+// Put uploads file and removes it
+func (s *S3ResultStore) Put(name, fileName string) error {
+
+    f, err := os.Open(fileName)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+
+    info, err := f.Stat()
+    if err != nil {
+        return err
+    }
+
+    // payload is signed, file is read twice
+    hash := sha256.New()
+    if _, err = io.Copy(hash, f); err != nil {
+        return err
+    }
+    if _, err = f.Seek(0, io.SeekStart); err != nil {
+        return err
+    }
+
+    req, err := http.NewRequest(http.MethodPut, s.objectUrl(name).String(), f)
+    if err != nil {
+        return err
+    }
+    req.ContentLength = info.Size()
+    req.Header.Set("Content-Type", mime.TypeByExtension(filepath.Ext(name)))
+    s.sign(req, hex.EncodeToString(hash.Sum(nil)))
+
+    resp, err := s.client.Do(req)
+    if err != nil {
+        return fmt.Errorf("S3 upload of %s failed: %s", name, err)
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+        return fmt.Errorf("S3 upload of %s failed: %s %s", name, resp.Status, body)
+    }
+
+    f.Close()
+    return os.Remove(fileName)
+}
+
+func (s *S3ResultStore) Open(name string) (io.ReadCloser, error) {
+    resp, err := s.do(http.MethodGet, name, nil)
+    if err != nil {
+        return nil, err
+    }
+    return resp.Body, nil
+}
+
+func (s *S3ResultStore) Size(name string) (int64, error) {
+    resp, err := s.do(http.MethodHead, name, nil)
+    if err != nil {
+        return 0, err
+    }
+    resp.Body.Close()
+    return resp.ContentLength, nil
+}
+
+func (s *S3ResultStore) Delete(name string) error {
+    resp, err := s.do(http.MethodDelete, name, nil)
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    return nil
+}
+
+// Serve redirects client to pre-signed url or streams object through server
+func (s *S3ResultStore) Serve(w http.ResponseWriter, r *http.Request, name string) {
+
+    if s.config.PresignExpiry > 0 {
+        u := s3Presign(s.config.AccessKey, s.config.SecretKey, s.config.Region, http.MethodGet, s.objectUrl(name), time.Now(), s.config.PresignExpiry)
+        http.Redirect(w, r, u, http.StatusFound)
+        return
+    }
+
+    // range requests are passed to storage
+    header := http.Header{}
+    if rng := r.Header.Get("Range"); len(rng) > 0 {
+        header.Set("Range", rng)
+    }
+
+    resp, err := s.do(http.MethodGet, name, header)
+    if os.IsNotExist(err) {
+        http.NotFound(w, r)
+        return
+    }
+    if err != nil {
+        WriteErrorResponse(w, http.StatusBadGateway, err)
+        return
+    }
+    defer resp.Body.Close()
+
+    for _, key := range []string{"Content-Type", "Content-Length", "Content-Range", "Last-Modified", "Etag", "Accept-Ranges"} {
+        if value := resp.Header.Get(key); len(value) > 0 {
+            w.Header().Set(key, value)
+        }
+    }
+    w.WriteHeader(resp.StatusCode)
+    io.Copy(w, resp.Body)
+}
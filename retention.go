@@ -0,0 +1,163 @@
+package main
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// predefined validities offered in user interface (if allowed by bounds)
+var validityChoices = []time.Duration{
+    time.Hour,
+    time.Hour * 24,
+    time.Hour * 24 * 2,
+    time.Hour * 24 * 7,
+    time.Hour * 24 * 30,
+    time.Hour * 24 * 365,
+}
+
+type ValidityChoice struct {
+    Value string
+    Label string
+    Selected bool
+}
+
+// ParseValidity parses duration of request validity, besides standard
+// go durations (e.g. 36h) days are accepted (e.g. 7d)
+func ParseValidity(value string) (time.Duration, error) {
+    if len(value) == 0 {
+        return 0, nil
+    }
+    if strings.HasSuffix(value, "d") {
+        days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+        if err != nil {
+            return 0, fmt.Errorf("Cannot parse validity %s: %s", value, err)
+        }
+        return time.Duration(days) * time.Hour * 24, nil
+    }
+    d, err := time.ParseDuration(value)
+    if err != nil {
+        return 0, fmt.Errorf("Cannot parse validity %s: %s", value, err)
+    }
+    return d, nil
+}
+
+// FormatDuration formats duration in human readable form (e.g. 2d 4h)
+func FormatDuration(d time.Duration) string {
+    if d < time.Minute {
+        return "less than minute"
+    }
+    days := int(d / (time.Hour * 24))
+    hours := int(d % (time.Hour * 24) / time.Hour)
+    minutes := int(d % time.Hour / time.Minute)
+    switch {
+    case days > 0 && hours > 0:
+        return fmt.Sprintf("%dd %dh", days, hours)
+    case days > 0:
+        return fmt.Sprintf("%dd", days)
+    case hours > 0 && minutes > 0:
+        return fmt.Sprintf("%dh %dm", hours, minutes)
+    case hours > 0:
+        return fmt.Sprintf("%dh", hours)
+    }
+    return fmt.Sprintf("%dm", minutes)
+}
+
+// clampValidity fits requested validity into bounds given by admin,
+// zero validity means default one
+func (q *Queue) clampValidity(validity time.Duration) time.Duration {
+    if validity == 0 {
+        validity = q.config.Validity
+    }
+    if q.config.ValidityMin > 0 && validity < q.config.ValidityMin {
+        validity = q.config.ValidityMin
+    }
+    if q.config.ValidityMax > 0 && validity > q.config.ValidityMax {
+        validity = q.config.ValidityMax
+    }
+    return validity
+}
+
+// ValidityChoices returns validities which can be chosen by user
+func (q *Queue) ValidityChoices() []ValidityChoice {
+    var choices []ValidityChoice
+    for _, d := range validityChoices {
+        if d != q.clampValidity(d) {
+            continue
+        }
+        choices = append(choices, ValidityChoice{d.String(), FormatDuration(d), d == q.clampValidity(0)})
+    }
+    return choices
+}
+
+// fixExpiration sets expiration of requests stored by versions without
+// per-request validity
+func (q *Queue) fixExpiration() {
+    requests, err := q.store.List()
+    if err != nil {
+        q.log.Errorf("Cannot read requests: %s", err)
+        return
+    }
+    for _, r := range requests {
+        if r.Expires == 0 {
+            r.Expires = time.Unix(r.Created, 0).Add(q.config.Validity).Unix()
+            if err := q.store.Put(r); err != nil {
+                q.log.Errorf("Cannot store request %s: %s", r.Id, err)
+            }
+        }
+    }
+}
+
+// pinnedSize returns total size of images of pinned requests
+func (q *Queue) pinnedSize() (int64, error) {
+    requests, err := q.store.List()
+    if err != nil {
+        return 0, err
+    }
+    var size int64
+    for _, r := range requests {
+        if r.Pinned {
+            if s, err := q.results.Size(q.resultName(r)); err == nil {
+                size += s
+            }
+        }
+    }
+    return size, nil
+}
+
+// Pin exempts request from expiration (or returns it back to expiration
+// if pinned is false). Pinned images must fit into pinned quota
+func (q *Queue) Pin(id string, pinned bool) error {
+    return q.updateRequest(id, func(request *QueueRequest) error {
+        if pinned && !request.Pinned {
+            if request.State != QUEUE_REQUEST_STATE_DONE {
+                return fmt.Errorf("Only finished requests can be pinned")
+            }
+            if q.config.PinnedQuota > 0 {
+                size, err := q.pinnedSize()
+                if err != nil {
+                    return err
+                }
+                imageSize, err := q.results.Size(q.resultName(request))
+                if err != nil {
+                    return err
+                }
+                if size + imageSize > q.config.PinnedQuota {
+                    return fmt.Errorf("Pinned images would exceed quota (%d MB)", q.config.PinnedQuota >> 20)
+                }
+            }
+        }
+
+        request.Pinned = pinned
+
+        // unpinned request which would expire immediately gets default validity
+        if !pinned && request.Expires < time.Now().Unix() {
+            request.Expires = time.Now().Add(q.clampValidity(0)).Unix()
+        }
+
+        q.log.Infof("Request %s pinned: %t", id, pinned)
+
+        return nil
+    })
+}
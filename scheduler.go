@@ -0,0 +1,124 @@
+package main
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+    "time"
+)
+
+// normal priority is zero, so it is default for requests without priority
+const QUEUE_PRIORITY_LOW = -1
+const QUEUE_PRIORITY_NORMAL = 0
+const QUEUE_PRIORITY_HIGH = 1
+
+// requests waiting longer than this are not overtaken by cheaper
+// requests of the same submitter anymore
+const SCHEDULER_MAX_WAIT = time.Minute * 10
+
+var queuePriorityNames = map[int]string{
+    QUEUE_PRIORITY_LOW: "low",
+    QUEUE_PRIORITY_NORMAL: "normal",
+    QUEUE_PRIORITY_HIGH: "high",
+}
+
+// ParsePriority converts priority name to priority level, unknown
+// and empty names give normal priority
+func ParsePriority(name string) int {
+    level, _ := ParsePriorityStrict(name)
+    return level
+}
+
+// ParsePriorityStrict converts priority name to priority level, unknown
+// (or empty) name is an error
+func ParsePriorityStrict(name string) (int, error) {
+    for level, n := range queuePriorityNames {
+        if strings.EqualFold(n, name) {
+            return level, nil
+        }
+    }
+    return QUEUE_PRIORITY_NORMAL, fmt.Errorf("Unknown priority %q (use low, normal or high)", name)
+}
+
+func PriorityName(level int) string {
+    if name, exists := queuePriorityNames[level]; exists {
+        return name
+    }
+    return queuePriorityNames[QUEUE_PRIORITY_NORMAL]
+}
+
+// scheduleOrder returns order in which new requests will be processed.
+// Requests of higher priority go first. Within the same priority, submitters
+// take turns (round robin starting after last served submitter) and each
+// submitter's requests are ordered from the cheapest one, unless some of
+// them waits too long already
+func scheduleOrder(requests []*QueueRequest, lastSubmitter string, now time.Time) []*QueueRequest {
+
+    var order []*QueueRequest
+
+    for priority := QUEUE_PRIORITY_HIGH; priority >= QUEUE_PRIORITY_LOW; priority-- {
+
+        // requests of this priority grouped by submitter
+        groups := make(map[string][]*QueueRequest)
+        var submitters []string
+        for _, r := range requests {
+            p := r.Priority
+            if p < QUEUE_PRIORITY_LOW || p > QUEUE_PRIORITY_HIGH {
+                p = QUEUE_PRIORITY_NORMAL
+            }
+            if p != priority {
+                continue
+            }
+            if _, exists := groups[r.Submitter]; !exists {
+                submitters = append(submitters, r.Submitter)
+            }
+            groups[r.Submitter] = append(groups[r.Submitter], r)
+        }
+
+        if len(submitters) == 0 {
+            continue
+        }
+
+        for _, s := range submitters {
+            sortSubmitterRequests(groups[s], now)
+        }
+
+        // stable rotation of submitters, start after the last served one
+        sort.Strings(submitters)
+        start := sort.SearchStrings(submitters, lastSubmitter)
+        if start < len(submitters) && submitters[start] == lastSubmitter {
+            start++
+        }
+        submitters = append(submitters[start:], submitters[:start]...)
+
+        for len(submitters) > 0 {
+            var remaining []string
+            for _, s := range submitters {
+                order = append(order, groups[s][0])
+                groups[s] = groups[s][1:]
+                if len(groups[s]) > 0 {
+                    remaining = append(remaining, s)
+                }
+            }
+            submitters = remaining
+        }
+    }
+
+    return order
+}
+
+func sortSubmitterRequests(requests []*QueueRequest, now time.Time) {
+    starving := func(r *QueueRequest) bool {
+        return now.Sub(time.Unix(r.Created, 0)) > SCHEDULER_MAX_WAIT
+    }
+    sort.SliceStable(requests, func(i, j int) bool {
+        si, sj := starving(requests[i]), starving(requests[j])
+        if si != sj {
+            return si
+        }
+        if !si && requests[i].Cost != requests[j].Cost {
+            return requests[i].Cost < requests[j].Cost
+        }
+        return requests[i].Created < requests[j].Created
+    })
+}
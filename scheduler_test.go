@@ -0,0 +1,85 @@
+package main
+
+import (
+    "context"
+    "net/http/httptest"
+    "testing"
+    "time"
+)
+
+func scheduledIds(requests []*QueueRequest) []string {
+    var ids []string
+    for _, r := range requests {
+        ids = append(ids, r.Id)
+    }
+    return ids
+}
+
+func TestScheduleOrderFair(t *testing.T) {
+    now := time.Unix(1000, 0)
+    requests := []*QueueRequest{
+        &QueueRequest{Id: "a1", Submitter: "a", Cost: 5000, Created: 990, Priority: QUEUE_PRIORITY_NORMAL},
+        &QueueRequest{Id: "a2", Submitter: "a", Cost: 4000, Created: 991, Priority: QUEUE_PRIORITY_NORMAL},
+        &QueueRequest{Id: "a3", Submitter: "a", Cost: 10, Created: 992, Priority: QUEUE_PRIORITY_NORMAL},
+        &QueueRequest{Id: "b1", Submitter: "b", Cost: 20, Created: 995, Priority: QUEUE_PRIORITY_NORMAL},
+        &QueueRequest{Id: "c1", Submitter: "c", Cost: 20, Created: 996, Priority: QUEUE_PRIORITY_LOW},
+        &QueueRequest{Id: "c2", Submitter: "c", Cost: 20, Created: 997, Priority: QUEUE_PRIORITY_HIGH},
+    }
+
+    Equals(t, []string{"c2", "a3", "b1", "a2", "a1", "c1"}, scheduledIds(scheduleOrder(requests, "", now)))
+
+    // round robin continues after last served submitter
+    Equals(t, []string{"c2", "b1", "a3", "a2", "a1", "c1"}, scheduledIds(scheduleOrder(requests, "a", now)))
+}
+
+func TestScheduleOrderStarving(t *testing.T) {
+    now := time.Unix(10000, 0)
+    requests := []*QueueRequest{
+        &QueueRequest{Id: "big", Submitter: "a", Cost: 5000, Created: 10000 - int64(SCHEDULER_MAX_WAIT.Seconds()) - 1},
+        &QueueRequest{Id: "small", Submitter: "a", Cost: 1, Created: 9999},
+    }
+
+    Equals(t, []string{"big", "small"}, scheduledIds(scheduleOrder(requests, "", now)))
+}
+
+func TestParsePriority(t *testing.T) {
+    Equals(t, QUEUE_PRIORITY_HIGH, ParsePriority("High"))
+    Equals(t, QUEUE_PRIORITY_LOW, ParsePriority("low"))
+    Equals(t, QUEUE_PRIORITY_NORMAL, ParsePriority(""))
+    Equals(t, "normal", PriorityName(7))
+
+    level, err := ParsePriorityStrict("HIGH")
+    Ok(t, err)
+    Equals(t, QUEUE_PRIORITY_HIGH, level)
+    for _, name := range []string{"", "hihg", "urgent"} {
+        _, err = ParsePriorityStrict(name)
+        Equals(t, true, err != nil)
+    }
+}
+
+func TestEnqueueOptionsPriority(t *testing.T) {
+    priority := func(value string, max int) int {
+        options, err := enqueueOptions(httptest.NewRequest("GET", "/stitcher?priority=" + value, nil), max)
+        Ok(t, err)
+        return options.Priority
+    }
+
+    // client can lower priority, but not raise it above limit
+    Equals(t, QUEUE_PRIORITY_NORMAL, priority("high", QUEUE_PRIORITY_NORMAL))
+    Equals(t, QUEUE_PRIORITY_LOW, priority("low", QUEUE_PRIORITY_NORMAL))
+    Equals(t, QUEUE_PRIORITY_LOW, priority("normal", QUEUE_PRIORITY_LOW))
+    Equals(t, QUEUE_PRIORITY_HIGH, priority("high", QUEUE_PRIORITY_HIGH))
+
+    // only authenticated admins can raise priority
+    userPriority := func(user *User, max int) int {
+        r := httptest.NewRequest("GET", "/stitcher?priority=high", nil)
+        r = r.WithContext(context.WithValue(r.Context(), "user", user))
+        options, err := enqueueOptions(r, max)
+        Ok(t, err)
+        return options.Priority
+    }
+    Equals(t, QUEUE_PRIORITY_HIGH, userPriority(&User{Name: "root", Role: AUTH_ROLE_ADMIN}, QUEUE_PRIORITY_NORMAL))
+    Equals(t, QUEUE_PRIORITY_NORMAL, userPriority(&User{Name: "joe", Role: AUTH_ROLE_USER}, QUEUE_PRIORITY_HIGH))
+    // without authentication everybody is admin without name, limit applies
+    Equals(t, QUEUE_PRIORITY_NORMAL, userPriority(&User{Role: AUTH_ROLE_ADMIN}, QUEUE_PRIORITY_NORMAL))
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+    "context"
+    "fmt"
     "log"
     "net/http"
     "os"
+    "os/signal"
+    "syscall"
     "time"
     "github.com/urfave/cli/v2"
     "github.com/op/go-logging"
@@ -11,13 +15,11 @@ import (
 
 const LOG_FORMAT = "%{color}%{time:2006/01/02 15:04:05 -07:00 MST} [%{level:.6s}] %{shortfile} : %{color:reset}%{message}"
 
-func runServer(c *cli.Context) error {
-
-    ///////////////////////////////// LOGGER
-    // NewLogger creates instance of logger that should be used
-    // in all server handlers and routines. The idea is to have
-    // unified style of logging - logger is configured only once
-    // and at one place
+// newLogger creates instance of logger that should be used
+// in all server handlers and routines. The idea is to have
+// unified style of logging - logger is configured only once
+// and at one place
+func newLogger(c *cli.Context) (*logging.Logger, error) {
     backend := logging.NewLogBackend(os.Stderr, "", 0)
     format := logging.MustStringFormatter(LOG_FORMAT)
     backendFormatter := logging.NewBackendFormatter(backend, format)
@@ -26,58 +28,241 @@ func runServer(c *cli.Context) error {
     logLevel, err := logging.LogLevel(c.String("log-level"))
     if err != nil {
         log.Fatalf("Cannot create logger for level %s (%v)", c.String("log-level"), err)
-        return err
+        return nil, err
         //os.Exit(1)
     }
     backendLeveled.SetLevel(logLevel, "")
 
     logging.SetBackend(backendLeveled)
-    logger := logging.MustGetLogger("server")
+    return logging.MustGetLogger("server"), nil
+}
+
+func newQueueConfig(c *cli.Context) (QueueConfig, error) {
+    maxClientPriority, err := ParsePriorityStrict(c.String("queue-max-client-priority"))
+    if err != nil {
+        return QueueConfig{}, fmt.Errorf("Invalid max client priority: %s", err)
+    }
+
+    return QueueConfig{
+        Dir: c.String("queue-dir"),
+        Validity: c.Duration("queue-validity"),
+        ValidityMin: c.Duration("queue-validity-min"),
+        ValidityMax: c.Duration("queue-validity-max"),
+        PinnedQuota: c.Int64("queue-pinned-quota") << 20,
+        PollInterval: c.Duration("queue-monitor-interval"),
+        CleanupInterval: c.Duration("queue-cleanup-interval"),
+        Workers: c.Int("queue-workers"),
+        LeaseDuration: c.Duration("worker-lease"),
+        Webhooks: c.StringSlice("webhook"),
+        WebhookSecret: c.String("webhook-secret"),
+        WebhookLinkValidity: c.Duration("webhook-link-validity"),
+        PublicUrl: c.String("public-url"),
+        LinkSecret: c.String("link-secret"),
+        Fetch: newFetchPolicyConfig(c),
+        MaxSize: c.Int64("queue-max-size") << 20,
+        MinFreeSpace: c.Int64("queue-min-free-space") << 20,
+        MaxClientPriority: maxClientPriority,
+    }, nil
+}
+
+func newFetchPolicyConfig(c *cli.Context) FetchPolicyConfig {
+    return FetchPolicyConfig{
+        Hosts: c.StringSlice("fetch-allowed-hosts"),
+        Schemes: c.StringSlice("fetch-allowed-schemes"),
+        AllowPrivate: c.Bool("fetch-allow-private"),
+        MaxSize: c.Int64("fetch-max-size") << 20,
+        MaxRedirects: c.Int("fetch-max-redirects"),
+    }
+}
+
+func newAuth(c *cli.Context, log *logging.Logger) (*Auth, error) {
+    return NewAuth(log, AuthConfig{
+        UsersFile: c.String("users"),
+        SessionSecret: c.String("session-secret"),
+        Admins: c.StringSlice("auth-admins"),
+        OIDC: OIDCConfig{
+            Issuer: c.String("oidc-issuer"),
+            ClientId: c.String("oidc-client-id"),
+            ClientSecret: c.String("oidc-client-secret"),
+        },
+    })
+}
+
+func newResultStore(c *cli.Context) (ResultStore, error) {
+    return OpenResultStore(c.String("result-store"), c.String("queue-dir"), S3Config{
+        Endpoint: c.String("s3-endpoint"),
+        Bucket: c.String("s3-bucket"),
+        Region: c.String("s3-region"),
+        AccessKey: c.String("s3-access-key"),
+        SecretKey: c.String("s3-secret-key"),
+        Prefix: c.String("s3-prefix"),
+        PresignExpiry: c.Duration("s3-presign-expiry"),
+    })
+}
+
+// runServer runs web interface and processes requests by workers
+// inside server process
+func runServer(c *cli.Context) error {
+    return serve(c, c.Int("queue-workers"))
+}
+
+// runServe runs web interface only, requests are processed by worker
+// processes (see worker command)
+func runServe(c *cli.Context) error {
+    if len(c.String("worker-token")) == 0 {
+        return fmt.Errorf("Worker token must be set, workers cannot connect without it")
+    }
+    return serve(c, 0)
+}
+
+func serve(c *cli.Context, workers int) error {
+
+    ///////////////////////////////// LOGGER
+    logger, err := newLogger(c)
+    if err != nil {
+        return err
+    }
 
     logger.Infof("Starting BSBigMap server")
 
     ////////////////////////////////// TILE PROVIDERS
 
     logger.Infof("Reading providers")
-    providers, err := readProviders()
+    providersMap, err := readProviders(c.String("providers"))
     if err != nil {
         logger.Errorf("Providers config error: %s", err)
         return err
     }
-    for provider := range providers {
-        logger.Infof("- %s %s", provider, providers[provider].Name)
+    providers := NewProviders(providersMap)
+    for _, name := range providers.Names() {
+        logger.Infof("- %s", name)
     }
+    if err := providers.SetDefault(c.String("default-provider")); err != nil {
+        logger.Errorf("Providers config error: %s", err)
+        return err
+    }
+    if p, exists := providers.Default(); exists {
+        logger.Infof("Default provider: %s", p.Name)
+    }
+
+    NewProvidersReloader(logger, c.String("providers"), providers, c.Duration("providers-reload-interval")).Start()
 
     ////////////////////////////////// QUEUE
-    queue, err := NewQueue(
-            logger,
-            c.String("queue-dir"),
-            c.Duration("queue-validity"),
-            c.Duration("queue-monitor-interval"),
-        )
+    store, err := OpenJobStore(logger, c.String("queue-store"), c.String("queue-dir"))
+    if err != nil {
+        return err
+    }
+    defer store.Close()
+
+    results, err := newResultStore(c)
     if err != nil {
         return err
     }
 
+    config, err := newQueueConfig(c)
+    if err != nil {
+        return err
+    }
+    config.Workers = workers
+
+    queue, err := NewQueue(logger, store, results, config)
+    if err != nil {
+        return err
+    }
+
+    // cancelling of context stops queue workers from taking new requests
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    queue.Start(ctx)
+
+    ////////////////////////////////// AUTHENTICATION
+    auth, err := newAuth(c, logger)
+    if err != nil {
+        return err
+    }
+    if !auth.Enabled() {
+        logger.Warningf("Authentication is disabled, everybody can access all requests")
+    }
+
+    // protect wraps handler which requires authenticated user
+    protect := func(handler http.Handler) http.Handler {
+        return &HandlerAuth{logger, auth, handler, false}
+    }
+
     ////////////////////////////////// HTTP HANDLERS
-    http.Handle("/stitcher", &HandlerParams{logger, providers, &HandlerStitcher{logger, providers, queue}})
+    http.Handle("/stitcher", protect(&HandlerParams{logger, providers, &HandlerStitcher{logger, providers, queue}}))
+
+    http.Handle("/map", protect(&HandlerParams{logger, providers, &HandlerMap{logger, providers, queue}}))
+    http.Handle("/map/params", protect(&HandlerParams{logger, providers, &HandlerMapParams{logger}}))
+
+    http.Handle("/area", protect(&HandlerArea{logger, providers, queue}))
+
+    queueHandler := protect(&HandlerQueue{logger, queue})
+    http.Handle("/queue", queueHandler)
+    http.Handle("/queue/pin", queueHandler)
+    http.Handle("/queue/share", queueHandler)
+    http.Handle("/queue/revoke", queueHandler)
 
-    http.Handle("/map", &HandlerParams{logger, providers, &HandlerMap{logger, providers}})
+    batchHandler := protect(&HandlerBatch{logger, providers, queue})
+    http.Handle("/batch", batchHandler)
+    http.Handle("/batch/zip", batchHandler)
 
-    http.Handle("/queue", &HandlerQueue{logger, queue})
+    // generated images, links are signed and given only to owners
+    http.Handle("/download/", &HandlerDownload{logger, queue})
 
-    // server static content
-    fs := http.FileServer(http.Dir(queue.dir))
-    http.Handle("/queue/", http.StripPrefix("/" + queue.dir + "/", fs))
+    // api of worker processes
+    http.Handle("/api/jobs/", &HandlerJobs{logger, queue, c.String("worker-token")})
+
+    http.Handle("/admin/providers/check", &HandlerAuth{logger, auth, &HandlerProvidersCheck{logger, providers, queue.policy}, true})
+
+    http.Handle("/admin/fetch-violations", &HandlerAuth{logger, auth, &HandlerFetchViolations{logger, queue.policy}, true})
+
+    loginHandler := &HandlerLogin{logger, auth, c.String("public-url")}
+    http.Handle("/login", loginHandler)
+    http.Handle("/logout", loginHandler)
+    http.Handle("/auth/", loginHandler)
 
     http.Handle("/", &HandlerRoot{logger, providers})
 
 
     ////////////////////////////////// SERVER
 
-    logger.Infof("Listening on %s...", c.String("bind-address"))
-    err = http.ListenAndServe(c.String("bind-address"), nil)
-    return err
+    server := &http.Server{Addr: c.String("bind-address")}
+
+    serverErr := make(chan error, 1)
+    go func() {
+        logger.Infof("Listening on %s...", c.String("bind-address"))
+        serverErr <- server.ListenAndServe()
+    }()
+
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+    select {
+    case err = <-serverErr:
+        return err
+    case sig := <-signals:
+        logger.Infof("Signal %s received, shutting down", sig)
+    }
+
+    ////////////////////////////////// SHUTDOWN
+
+    grace := c.Duration("shutdown-grace-period")
+
+    // stop accepting new requests, in-flight http requests are finished
+    shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), grace)
+    defer shutdownCancel()
+    if err = server.Shutdown(shutdownCtx); err != nil {
+        logger.Warningf("Http server shutdown failed: %s", err)
+    }
+
+    // let running requests finish, interrupt them after grace period
+    cancel()
+    queue.Shutdown(grace)
+
+    logger.Infof("Server stopped")
+
+    return nil
 }
 
 func FatalOnError(err error, msg string, args ...interface{}) {
@@ -100,6 +285,180 @@ func main() {
     }
     app.Usage = "Stitch map tiles into single PNG image"
     app.Action = runServer
+    app.Commands = []*cli.Command{
+        {
+            Name: "serve",
+            Usage: "Run server without workers, requests are processed by worker processes",
+            Action: runServe,
+        },
+        {
+            Name: "worker",
+            Usage: "Process requests claimed from server (see serve command)",
+            Action: runWorker,
+            Flags: []cli.Flag{
+                &cli.StringFlag{
+                    Name: "server",
+                    Usage: "Url of server (e.g. http://bigmap.example.com:8080)",
+                    Required: true,
+                    EnvVars: []string{"WORKER_SERVER"},
+                },
+                &cli.StringFlag{
+                    Name: "name",
+                    Usage: "Name of worker shown on queue page (default is host name and process id)",
+                    EnvVars: []string{"WORKER_NAME"},
+                },
+                &cli.DurationFlag{
+                    Name: "heartbeat-interval",
+                    Usage: "The interval of extending leases of requests being processed (must be shorter than --worker-lease of server)",
+                    Value: time.Second * 20,
+                    EnvVars: []string{"WORKER_HEARTBEAT_INTERVAL"},
+                },
+            },
+        },
+        {
+            Name: "users",
+            Usage: "Tools for maintaining users file (see --users)",
+            Subcommands: []*cli.Command{
+                {
+                    Name: "hash-password",
+                    Usage: "Read password from standard input and print its bcrypt hash",
+                    Action: runHashPassword,
+                },
+                {
+                    Name: "new-token",
+                    Usage: "Generate api token and print it together with hash to be stored in users file",
+                    Action: runNewToken,
+                },
+            },
+        },
+        {
+            Name: "providers",
+            Usage: "Tile providers tools",
+            Subcommands: []*cli.Command{
+                {
+                    Name: "check",
+                    Usage: "Fetch sample tiles of providers and report their health",
+                    ArgsUsage: "[provider...]",
+                    Action: runProvidersCheck,
+                    Flags: []cli.Flag{
+                        &cli.StringFlag{
+                            Name: "format",
+                            Aliases: []string{"f"},
+                            Usage: "Output format (table or json)",
+                            Value: "table",
+                        },
+                    },
+                },
+            },
+        },
+        {
+            Name: "batch",
+            Usage: "Enqueue all rows of batch manifest (json or csv) to queue processed by server",
+            ArgsUsage: "<manifest>",
+            Action: runBatch,
+            Flags: []cli.Flag{
+                &cli.StringFlag{
+                    Name: "priority",
+                    Usage: "Priority of requests without priority column (low, normal or high)",
+                    Value: "normal",
+                },
+                &cli.StringFlag{
+                    Name: "validity",
+                    Usage: "Validity of requests without validity column (e.g. 36h or 7d, default is --queue-validity)",
+                },
+                &cli.StringFlag{
+                    Name: "callback",
+                    Usage: "Url notified when each request of batch is finished",
+                },
+            },
+        },
+        {
+            Name: "stitch",
+            Usage: "Stitch map tiles into PNG (or JPEG) image without running server",
+            Action: runStitch,
+            Flags: []cli.Flag{
+                &cli.StringFlag{
+                    Name: "provider",
+                    Usage: "Tile provider name",
+                    Required: true,
+                },
+                &cli.IntFlag{
+                    Name: "zoom",
+                    Aliases: []string{"z"},
+                    Usage: "Zoom level",
+                    Required: true,
+                },
+                &cli.StringFlag{
+                    Name: "bbox",
+                    Usage: "Area to be covered as minlon,minlat,maxlon,maxlat",
+                    Required: true,
+                },
+                &cli.IntFlag{
+                    Name: "scale",
+                    Usage: "Tile size in pixels (default is scale of provider)",
+                },
+                &cli.PathFlag{
+                    Name: "out",
+                    Aliases: []string{"o"},
+                    Usage: "Output image file (.jpg or .jpeg extension produces JPEG)",
+                    Value: "map.png",
+                },
+                &cli.BoolFlag{
+                    Name: "quiet",
+                    Usage: "Don't show progress bar",
+                },
+                &cli.PathFlag{
+                    Name: "gpx",
+                    Usage: "GPX file with tracks and waypoints drawn onto image",
+                },
+                &cli.StringFlag{
+                    Name: "track-color",
+                    Usage: "Color of GPX tracks and waypoints (#rrggbb)",
+                    Value: OVERLAY_COLOR,
+                },
+                &cli.Float64Flag{
+                    Name: "track-width",
+                    Usage: "Width of GPX tracks in pixels",
+                    Value: OVERLAY_WIDTH,
+                },
+                &cli.Float64Flag{
+                    Name: "track-opacity",
+                    Usage: "Opacity of GPX tracks and waypoints (0 - 1)",
+                    Value: OVERLAY_OPACITY,
+                },
+                &cli.StringFlag{
+                    Name: "graticule",
+                    Usage: "Interval of lat/lon graticule in degrees (e.g. 0.25)",
+                },
+                &cli.StringFlag{
+                    Name: "utm-grid",
+                    Usage: "Interval of UTM/MGRS grid in kilometres",
+                },
+                &cli.BoolFlag{
+                    Name: "grid-labels",
+                    Usage: "Label grid coordinates in margins around map",
+                },
+                &cli.IntFlag{
+                    Name: "dpi",
+                    Usage: "Resolution of output, size of grid labels and cartouche is scaled by it",
+                    Value: GRID_DPI,
+                },
+                &cli.BoolFlag{
+                    Name: "cartouche",
+                    Usage: "Draw cartouche with title, scale bar, north arrow, attribution and date",
+                },
+                &cli.StringFlag{
+                    Name: "title",
+                    Usage: "Title of map shown in cartouche",
+                },
+                &cli.StringFlag{
+                    Name: "units",
+                    Usage: "Units of scale bar (metric or imperial)",
+                    Value: CARTOUCHE_METRIC,
+                },
+            },
+        },
+    }
     app.Flags = []cli.Flag{
         &cli.StringFlag{
             Name:   "bind-address",
@@ -108,6 +467,25 @@ func main() {
             Value:  "0.0.0.0:9090",
             EnvVars: []string{"BIND_ADDRESS"},
         },
+        &cli.PathFlag{
+            Name:   "providers",
+            Aliases: []string{"p"},
+            Usage:  "Tile providers config file (csv)",
+            Value:  "providers.csv",
+            EnvVars: []string{"PROVIDERS"},
+        },
+        &cli.StringFlag{
+            Name:   "default-provider",
+            Usage:  "Provider used when request doesn't name any (first provider by name if empty)",
+            Value:  "mapycz",
+            EnvVars: []string{"DEFAULT_PROVIDER"},
+        },
+        &cli.DurationFlag{
+            Name: "providers-reload-interval",
+            Usage: "The interval in which providers file is checked for changes (0 disables it, SIGHUP still works)",
+            Value: time.Second * 10,
+            EnvVars: []string{"PROVIDERS_RELOAD_INTERVAL"},
+        },
         &cli.StringFlag{
             Name:   "log-level",
             Aliases: []string{"l"},
@@ -122,18 +500,216 @@ func main() {
             Value:  "queue",
             EnvVars: []string{"QUEUE_DIR"},
         },
+        &cli.StringFlag{
+            Name:   "queue-store",
+            Usage:  "Storage of queue requests: file (json files, shared with batch command) or bolt (embedded database, single process)",
+            Value:  JOB_STORE_FILE,
+            EnvVars: []string{"QUEUE_STORE"},
+        },
         &cli.DurationFlag{
             Name: "queue-validity",
-            Usage: "The maximal time for request (generated image) to be kept in queue",
+            Usage: "The default time for request (generated image) to be kept in queue",
             Value: time.Hour * 24 * 2,
             EnvVars: []string{"QUEUE_VALIDITY"},
         },
+        &cli.DurationFlag{
+            Name: "queue-validity-min",
+            Usage: "The minimal validity which can be chosen for request (0 means no limit)",
+            Value: time.Hour,
+            EnvVars: []string{"QUEUE_VALIDITY_MIN"},
+        },
+        &cli.DurationFlag{
+            Name: "queue-validity-max",
+            Usage: "The maximal validity which can be chosen for request (0 means no limit)",
+            Value: time.Hour * 24 * 30,
+            EnvVars: []string{"QUEUE_VALIDITY_MAX"},
+        },
+        &cli.Int64Flag{
+            Name: "queue-pinned-quota",
+            Usage: "The maximal total size of pinned images in MB (0 means no limit)",
+            Value: 1024,
+            EnvVars: []string{"QUEUE_PINNED_QUOTA"},
+        },
         &cli.DurationFlag{
             Name: "queue-monitor-interval",
-            Usage: "The interval in which queue checks new requests to be processed",
+            Usage: "The interval in which queue checks requests enqueued by other processes (requests enqueued by server are processed immediately)",
             Value: time.Second * 5,
             EnvVars: []string{"QUEUE_MONITOR_INTERVAL"},
         },
+        &cli.DurationFlag{
+            Name: "queue-cleanup-interval",
+            Usage: "The interval in which expired requests are removed from queue",
+            Value: time.Minute,
+            EnvVars: []string{"QUEUE_CLEANUP_INTERVAL"},
+        },
+        &cli.DurationFlag{
+            Name: "shutdown-grace-period",
+            Usage: "The maximal time to wait for requests being processed on shutdown, unfinished requests are processed again on next start",
+            Value: time.Second * 30,
+            EnvVars: []string{"SHUTDOWN_GRACE_PERIOD"},
+        },
+        &cli.IntFlag{
+            Name: "queue-workers",
+            Usage: "Number of requests processed in parallel",
+            Value: 1,
+            EnvVars: []string{"QUEUE_WORKERS"},
+        },
+        &cli.Int64Flag{
+            Name: "queue-max-size",
+            Usage: "The maximal total size of queue directory in MB, oldest unpinned images are removed when exceeded (0 means no limit)",
+            Value: 0,
+            EnvVars: []string{"QUEUE_MAX_SIZE"},
+        },
+        &cli.Int64Flag{
+            Name: "queue-min-free-space",
+            Usage: "Disk space in MB which must stay free, oldest unpinned images are removed when disk is running out of space",
+            Value: 100,
+            EnvVars: []string{"QUEUE_MIN_FREE_SPACE"},
+        },
+        &cli.StringFlag{
+            Name: "queue-max-client-priority",
+            Usage: "The highest priority (low, normal or high) which clients can give to their requests",
+            Value: "normal",
+            EnvVars: []string{"QUEUE_MAX_CLIENT_PRIORITY"},
+        },
+        &cli.StringSliceFlag{
+            Name: "webhook",
+            Usage: "Url notified about every finished request (can be repeated)",
+            EnvVars: []string{"WEBHOOKS"},
+        },
+        &cli.StringFlag{
+            Name: "webhook-secret",
+            Usage: "Secret for signing of webhook payloads (HMAC-SHA256 in X-BSBigMap-Signature header), payloads are not signed if empty",
+            EnvVars: []string{"WEBHOOK_SECRET"},
+        },
+        &cli.DurationFlag{
+            Name: "webhook-link-validity",
+            Usage: "Validity of image links in webhook payloads, links are shares which can be revoked on queue page",
+            Value: LINK_WEBHOOK_DURATION,
+            EnvVars: []string{"WEBHOOK_LINK_VALIDITY"},
+        },
+        &cli.StringFlag{
+            Name: "public-url",
+            Usage: "Url of server used in webhook payloads (e.g. https://bigmap.example.com)",
+            EnvVars: []string{"PUBLIC_URL"},
+        },
+        &cli.StringSliceFlag{
+            Name: "fetch-allowed-hosts",
+            Usage: "Hosts tiles can be fetched from, *.example.com matches subdomains (can be repeated, default is any host)",
+            EnvVars: []string{"FETCH_ALLOWED_HOSTS"},
+        },
+        &cli.StringSliceFlag{
+            Name: "fetch-allowed-schemes",
+            Usage: "Url schemes of tiles and callbacks",
+            Value: cli.NewStringSlice("http", "https"),
+            EnvVars: []string{"FETCH_ALLOWED_SCHEMES"},
+        },
+        &cli.BoolFlag{
+            Name: "fetch-allow-private",
+            Usage: "Allow fetching of tiles and callbacks from private, loopback and link-local addresses",
+            EnvVars: []string{"FETCH_ALLOW_PRIVATE"},
+        },
+        &cli.Int64Flag{
+            Name: "fetch-max-size",
+            Usage: "The maximal size of fetched tile in MB",
+            Value: FETCH_MAX_SIZE >> 20,
+            EnvVars: []string{"FETCH_MAX_SIZE"},
+        },
+        &cli.IntFlag{
+            Name: "fetch-max-redirects",
+            Usage: "The maximal number of redirects followed when tile is fetched",
+            Value: 3,
+            EnvVars: []string{"FETCH_MAX_REDIRECTS"},
+        },
+        &cli.StringFlag{
+            Name: "link-secret",
+            Usage: "Secret for signing of download links (random if not set, links don't survive restart then)",
+            EnvVars: []string{"LINK_SECRET"},
+        },
+        &cli.StringFlag{
+            Name: "worker-token",
+            Usage: "Shared secret of worker processes, job api for workers is disabled if not set",
+            EnvVars: []string{"WORKER_TOKEN"},
+        },
+        &cli.DurationFlag{
+            Name: "worker-lease",
+            Usage: "How long request stays assigned to worker which stopped sending heartbeats (at least 3s)",
+            Value: QUEUE_LEASE_DURATION,
+            EnvVars: []string{"WORKER_LEASE"},
+        },
+        &cli.StringFlag{
+            Name: "result-store",
+            Usage: "Storage of generated images: local (queue directory) or s3 (S3 compatible object storage)",
+            Value: RESULT_STORE_LOCAL,
+            EnvVars: []string{"RESULT_STORE"},
+        },
+        &cli.StringFlag{
+            Name: "s3-endpoint",
+            Usage: "Url of S3 compatible storage (e.g. https://s3.eu-central-1.amazonaws.com or http://localhost:9000)",
+            EnvVars: []string{"S3_ENDPOINT"},
+        },
+        &cli.StringFlag{
+            Name: "s3-bucket",
+            Usage: "Bucket for generated images",
+            EnvVars: []string{"S3_BUCKET"},
+        },
+        &cli.StringFlag{
+            Name: "s3-region",
+            Usage: "Region of S3 storage",
+            Value: "us-east-1",
+            EnvVars: []string{"S3_REGION"},
+        },
+        &cli.StringFlag{
+            Name: "s3-access-key",
+            Usage: "Access key of S3 storage",
+            EnvVars: []string{"S3_ACCESS_KEY"},
+        },
+        &cli.StringFlag{
+            Name: "s3-secret-key",
+            Usage: "Secret key of S3 storage",
+            EnvVars: []string{"S3_SECRET_KEY"},
+        },
+        &cli.StringFlag{
+            Name: "s3-prefix",
+            Usage: "Prefix of object names (e.g. bsbigmap/)",
+            EnvVars: []string{"S3_PREFIX"},
+        },
+        &cli.DurationFlag{
+            Name: "s3-presign-expiry",
+            Usage: "Validity of pre-signed download urls, 0 means that images are streamed through server",
+            Value: time.Minute * 15,
+            EnvVars: []string{"S3_PRESIGN_EXPIRY"},
+        },
+        &cli.PathFlag{
+            Name: "users",
+            Usage: "Users file (csv: name, bcrypt hash of password, role, hashes of api tokens), authentication is disabled if neither users nor OIDC is set",
+            EnvVars: []string{"USERS"},
+        },
+        &cli.StringFlag{
+            Name: "session-secret",
+            Usage: "Secret for signing of session cookies (random if not set, sessions don't survive restart then)",
+            EnvVars: []string{"SESSION_SECRET"},
+        },
+        &cli.StringSliceFlag{
+            Name: "auth-admins",
+            Usage: "Users authenticated by OIDC which have admin role, given by verified email or subject (can be repeated)",
+            EnvVars: []string{"AUTH_ADMINS"},
+        },
+        &cli.StringFlag{
+            Name: "oidc-issuer",
+            Usage: "Issuer url of OpenID Connect provider (e.g. https://accounts.google.com)",
+            EnvVars: []string{"OIDC_ISSUER"},
+        },
+        &cli.StringFlag{
+            Name: "oidc-client-id",
+            Usage: "Client id registered at OpenID Connect provider",
+            EnvVars: []string{"OIDC_CLIENT_ID"},
+        },
+        &cli.StringFlag{
+            Name: "oidc-client-secret",
+            Usage: "Client secret registered at OpenID Connect provider",
+            EnvVars: []string{"OIDC_CLIENT_SECRET"},
+        },
 
     }
 
@@ -0,0 +1,254 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "image"
+    "image/color"
+    "image/draw"
+    "image/jpeg"
+    "image/png"
+    "io"
+    "net/http"
+    "github.com/op/go-logging"
+)
+
+const IMAGE_FORMAT_PNG = "png"
+const IMAGE_FORMAT_JPEG = "jpeg"
+
+const JPEG_QUALITY = 90
+
+// absolute limit of generated image size in pixels (1 GB of RGBA data),
+// checked before image is allocated
+const IMAGE_MAX_PIXELS = 16384 * 16384
+
+// TileFailure describes tile that couldn't be put into final image
+type TileFailure struct {
+    X int
+    Y int
+    Url string
+    Reason string
+}
+
+// Stitcher fetches tiles for given input params and composes them
+// into single image. It is used by queue as well as by command line
+// stitch command
+type Stitcher struct {
+    log *logging.Logger
+    policy *FetchPolicy
+    client *http.Client
+    // called after each processed tile (nil means no reporting)
+    progress func(done, total int)
+}
+
+// constructor
+func NewStitcher(log *logging.Logger, policy *FetchPolicy) *Stitcher {
+    return &Stitcher{log: log, policy: policy, client: policy.Client()}
+}
+
+// fetchTile downloads raw tile data
+func (s *Stitcher) fetchTile(ctx context.Context, url string) ([]byte, error) {
+
+    req, err := http.NewRequest(http.MethodGet, url, nil)
+    if err != nil {
+        return nil, err
+    }
+
+    res, err := s.client.Do(req.WithContext(ctx))
+    if err != nil {
+        return nil, err
+    }
+    defer res.Body.Close()
+
+    if res.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("Unexpected status %s", res.Status)
+    }
+
+    return s.policy.ReadImage(res)
+}
+
+// tiles bigger than scale of provider multiplied by this factor are rejected
+// without decoding (high resolution tiles are usually 2x or 4x)
+const TILE_MAX_SCALE_FACTOR = 4
+
+// absolute limit of tile width and height in pixels
+const TILE_MAX_DIMENSION = 4096
+
+// decodeTile decodes tile data. Dimensions are checked before image is
+// decoded, so hostile server cannot exhaust memory by small file of huge
+// dimensions. Tile of other size than expected (scale of provider) is
+// rescaled to size of tile in final image
+func (s *Stitcher) decodeTile(data []byte, expected, size int) (m image.Image, err error) {
+
+    // decoders of malformed data shouldn't panic, but tile must never
+    // take down the whole request
+    defer func() {
+        if r := recover(); r != nil {
+            m, err = nil, fmt.Errorf("Decoding failed: %v", r)
+        }
+    }()
+
+    config, format, err := image.DecodeConfig(bytes.NewReader(data))
+    if err != nil {
+        return nil, fmt.Errorf("Decoding failed: %s", err)
+    }
+
+    if expected <= 0 {
+        expected = size
+    }
+    limit := IntMin(expected * TILE_MAX_SCALE_FACTOR, TILE_MAX_DIMENSION)
+    if config.Width <= 0 || config.Height <= 0 || config.Width > limit || config.Height > limit {
+        return nil, fmt.Errorf("Tile size %dx%d exceeds limit %dx%d", config.Width, config.Height, limit, limit)
+    }
+    if config.Width != config.Height {
+        return nil, fmt.Errorf("Tile size %dx%d is not square", config.Width, config.Height)
+    }
+
+    m, _, err = image.Decode(bytes.NewReader(data))
+    if err != nil {
+        return nil, fmt.Errorf("Decoding failed: %s", err)
+    }
+
+    s.log.Debugf("Decoding tile image passed (format: %s)", format)
+
+    if m.Bounds().Dx() != size {
+        s.log.Debugf("Rescaling tile from %dpx to %dpx", m.Bounds().Dx(), size)
+        m = scaleTile(m, size)
+    }
+
+    return m, nil
+}
+
+// scaleTile resizes square tile to given size, each pixel is average of
+// pixels of source area it covers
+func scaleTile(src image.Image, size int) *image.RGBA {
+    b := src.Bounds()
+    srcSize := b.Dx()
+    dst := image.NewRGBA(image.Rect(0, 0, size, size))
+
+    for y := 0; y < size; y++ {
+        y0 := y * srcSize / size
+        y1 := IntMax((y + 1) * srcSize / size, y0 + 1)
+        for x := 0; x < size; x++ {
+            x0 := x * srcSize / size
+            x1 := IntMax((x + 1) * srcSize / size, x0 + 1)
+
+            var r, g, bl, a, n uint32
+            for sy := y0; sy < y1; sy++ {
+                for sx := x0; sx < x1; sx++ {
+                    cr, cg, cb, ca := src.At(b.Min.X + sx, b.Min.Y + sy).RGBA()
+                    r, g, bl, a = r + cr, g + cg, bl + cb, a + ca
+                    n++
+                }
+            }
+            dst.SetRGBA64(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(bl / n), uint16(a / n)})
+        }
+    }
+
+    return dst
+}
+
+// getTile returns decoded tile, tile is taken from cache if it was
+// already fetched (cache can be nil)
+func (s *Stitcher) getTile(ctx context.Context, cache TileCache, x, y int, url string, expected, size int) (image.Image, error) {
+
+    if cache != nil {
+        if data, exists := cache.Get(x, y); exists {
+            s.log.Debugf("Using cached tile %d:%d", x, y)
+            return s.decodeTile(data, expected, size)
+        }
+    }
+
+    s.log.Debugf("Fetching tile %s (%d:%d)", url, x, y)
+    data, err := s.fetchTile(ctx, url)
+    if err != nil {
+        return nil, err
+    }
+
+    m, err := s.decodeTile(data, expected, size)
+    if err != nil {
+        return nil, err
+    }
+
+    // only valid tiles are cached, failed ones are fetched again on resume
+    if cache != nil {
+        if err := cache.Put(x, y, data); err != nil {
+            s.log.Warningf("Caching tile %d:%d failed: %s", x, y, err)
+        }
+    }
+
+    return m, nil
+}
+
+// Stitch generates final image, tiles that cannot be fetched or decoded
+// are skipped (left transparent) and reported in returned list. Stitching
+// is interrupted (and error returned) when context is cancelled. Fetched
+// tiles are stored to cache (if not nil) so interrupted stitching can be
+// resumed later
+func (s *Stitcher) Stitch(ctx context.Context, ip *InputParams, cache TileCache) (*image.RGBA, []TileFailure, error) {
+
+    s.log.Debugf("Input params: %v", ip)
+    if err := ip.validate(); err != nil {
+        return nil, nil, err
+    }
+    finalRect := image.Rectangle{image.Point{0, 0}, image.Point{(ip.XMax - ip.XMin + 1) * ip.Scale, (ip.YMax - ip.YMin + 1) * ip.Scale}}
+    s.log.Debugf("Final image size: %v", finalRect)
+    final := image.NewRGBA(finalRect)
+
+    var failures []TileFailure
+
+    // get tiles for current set of parameters
+    tiles := ip.Provider.getTiles(ip.XMin, ip.YMin, ip.XMax, ip.YMax, ip.Zoom, ip.Scale)
+
+    // loop through all tiles
+    for i := 0; i < len(*tiles); i++ {
+
+        t := (*tiles)[i]
+
+        if ctx.Err() != nil {
+            return nil, nil, ctx.Err()
+        }
+
+        m, err := s.getTile(ctx, cache, ip.XMin + t.Left, ip.YMin + t.Top, t.Url, ip.Provider.Scale, ip.Scale)
+        if err != nil && ctx.Err() != nil {
+            return nil, nil, ctx.Err()
+        }
+        if err != nil {
+            // skip this tile, it stays transparent in final image
+            s.log.Warningf("Fetching tile %s failed: %s", t.Url, err)
+            failures = append(failures, TileFailure{ip.XMin + t.Left, ip.YMin + t.Top, t.Url, err.Error()})
+        } else {
+            // put fetched tile image at proper place in final image
+            finalPoint := image.Point{t.Left * ip.Scale, t.Top * ip.Scale}
+            tileRect := m.Bounds().Sub(m.Bounds().Min).Add(finalPoint)
+
+            s.log.Debugf("Putting tile at %v", tileRect)
+            draw.Draw(final, tileRect, m, m.Bounds().Min, draw.Over)
+        }
+
+        if s.progress != nil {
+            s.progress(i + 1, len(*tiles))
+        }
+    }
+
+    applyMask(final, ip)
+
+    if err := drawOverlay(final, ip); err != nil {
+        return nil, nil, fmt.Errorf("Cannot draw overlay: %s", err)
+    }
+
+    return final, failures, nil
+}
+
+// writeImage saves image to file in given format (png or jpeg). Image is
+// encoded to temporary file which is renamed to final name once it is
+// complete, so partially written images never appear under final name
+func writeImage(fileName string, img image.Image, format string) error {
+    return writeFileAtomicFunc(fileName, func(w io.Writer) error {
+        if format == IMAGE_FORMAT_JPEG {
+            return jpeg.Encode(w, img, &jpeg.Options{Quality: JPEG_QUALITY})
+        }
+        return png.Encode(w, img)
+    })
+}
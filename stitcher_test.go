@@ -0,0 +1,126 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "image"
+    "image/color"
+    "image/draw"
+    "image/png"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "github.com/op/go-logging"
+)
+
+// tile server returning red 4px tiles, tile 1/1 is missing
+func newTestTileServer() *httptest.Server {
+    return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/1/1/1.png" {
+            w.WriteHeader(http.StatusNotFound)
+            return
+        }
+        m := image.NewRGBA(image.Rect(0, 0, 4, 4))
+        draw.Draw(m, m.Bounds(), image.NewUniform(color.RGBA{255, 0, 0, 255}), image.Point{}, draw.Src)
+        png.Encode(w, m)
+    }))
+}
+
+func TestStitch(t *testing.T) {
+    ts := newTestTileServer()
+    defer ts.Close()
+
+    p := Provider{Name: "test", MinZoom: 0, MaxZoom: 5, Scale: 4, Url: ts.URL + "/{z}/{x}/{y}.png"}
+    ip := InputParams{Zoom: 1, XMin: 0, YMin: 0, XMax: 1, YMax: 1, Scale: 4, Provider: p}
+
+    var progress []int
+    s := NewStitcher(logging.MustGetLogger("test"), newTestFetchPolicy())
+    s.progress = func(done, total int) { progress = append(progress, done) }
+
+    final, failures, err := s.Stitch(context.Background(), &ip, nil)
+    Ok(t, err)
+
+    Equals(t, image.Rect(0, 0, 8, 8), final.Bounds())
+    Equals(t, []int{1, 2, 3, 4}, progress)
+    Equals(t, 1, len(failures))
+    Equals(t, 1, failures[0].X)
+    Equals(t, 1, failures[0].Y)
+    Equals(t, color.RGBA{255, 0, 0, 255}, final.RGBAAt(5, 1))
+    Equals(t, color.RGBA{0, 0, 0, 0}, final.RGBAAt(5, 5))
+}
+
+func TestStitchLimits(t *testing.T) {
+    p := Provider{Name: "test", MinZoom: 0, MaxZoom: 20, Scale: 256, Url: "http://localhost/{z}/{x}/{y}.png"}
+    s := NewStitcher(logging.MustGetLogger("test"), newTestFetchPolicy())
+
+    // image is refused before it is allocated
+    for _, ip := range []InputParams{
+        InputParams{Zoom: 1, XMin: 0, YMin: 0, XMax: 1, YMax: 1, Scale: 0, Provider: p},
+        InputParams{Zoom: 1, XMin: 0, YMin: 0, XMax: 1, YMax: 1, Scale: 1025, Provider: p},
+        InputParams{Zoom: 20, XMin: 0, YMin: 0, XMax: 999999, YMax: 999999, Scale: 256, Provider: p},
+    } {
+        _, _, err := s.Stitch(context.Background(), &ip, nil)
+        Equals(t, true, err != nil)
+    }
+}
+
+func TestParseBBox(t *testing.T) {
+    bbox, err := parseBBox("14.2, 49.9,14.7,50.2")
+    Ok(t, err)
+    Equals(t, [4]float64{14.2, 49.9, 14.7, 50.2}, bbox)
+
+    _, err = parseBBox("14.7,49.9,14.2,50.2")
+    Equals(t, true, err != nil)
+}
+
+func TestBBoxToInputParams(t *testing.T) {
+    p := Provider{Name: "osm", MinZoom: 0, MaxZoom: 13, Scale: 256}
+    bbox := [4]float64{14.2, 49.9, 14.7, 50.2}
+
+    // zoom is clamped before bounding box is projected
+    for _, zoom := range []int{14, 2000000000} {
+        ip, err := bboxToInputParams(p, zoom, bbox)
+        Ok(t, err)
+        Equals(t, 13, ip.Zoom)
+        Equals(t, [4]int{4419, 2771, 4430, 2781}, [4]int{ip.XMin, ip.YMin, ip.XMax, ip.YMax})
+    }
+
+    _, err := bboxToInputParams(p, 10, [4]float64{14.2, 49.9, 14.7, 86})
+    Equals(t, true, err != nil)
+    _, err = bboxToInputParams(p, 10, [4]float64{-181, 49.9, 14.7, 50.2})
+    Equals(t, true, err != nil)
+}
+
+func TestDecodeTile(t *testing.T) {
+    s := NewStitcher(logging.MustGetLogger("test"), newTestFetchPolicy())
+
+    encode := func(w, h int, c color.Color) []byte {
+        m := image.NewRGBA(image.Rect(0, 0, w, h))
+        draw.Draw(m, m.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+        var buf bytes.Buffer
+        png.Encode(&buf, m)
+        return buf.Bytes()
+    }
+
+    m, err := s.decodeTile(encode(4, 4, color.RGBA{255, 0, 0, 255}), 4, 4)
+    Ok(t, err)
+    Equals(t, image.Rect(0, 0, 4, 4), m.Bounds())
+
+    // high resolution tile is scaled down
+    m, err = s.decodeTile(encode(8, 8, color.RGBA{0, 0, 255, 255}), 4, 4)
+    Ok(t, err)
+    Equals(t, image.Rect(0, 0, 4, 4), m.Bounds())
+    r, g, b, a := m.At(3, 3).RGBA()
+    Equals(t, []uint32{0, 0, 0xffff, 0xffff}, []uint32{r, g, b, a})
+
+    // huge dimensions are rejected before decoding
+    _, err = s.decodeTile(encode(2048, 2048, color.White), 256, 256)
+    Equals(t, true, err != nil && strings.Contains(err.Error(), "exceeds limit"))
+
+    _, err = s.decodeTile(encode(4, 2, color.White), 4, 4)
+    Equals(t, true, err != nil && strings.Contains(err.Error(), "not square"))
+
+    _, err = s.decodeTile([]byte("<html>not found</html>"), 4, 4)
+    Equals(t, true, err != nil && strings.Contains(err.Error(), "Decoding failed"))
+}
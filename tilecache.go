@@ -0,0 +1,56 @@
+package main
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+)
+
+// TileCache keeps raw data of fetched tiles, so stitching interrupted by
+// crash or restart fetches only missing tiles when it is started again.
+// Tiles are cached as they were received from server, decoding of cached
+// tile gives the same image as decoding of fetched one
+type TileCache interface {
+    Get(x, y int) ([]byte, bool)
+    Put(x, y int, data []byte) error
+}
+
+// DirTileCache stores each tile as file in scratch directory of request
+type DirTileCache struct {
+    dir string
+}
+
+// constructor
+func NewDirTileCache(dir string) (*DirTileCache, error) {
+    if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+        return nil, err
+    }
+    return &DirTileCache{dir: dir}, nil
+}
+
+func (c *DirTileCache) fileName(x, y int) string {
+    return filepath.Join(c.dir, fmt.Sprintf("%d-%d.tile", x, y))
+}
+
+func (c *DirTileCache) Get(x, y int) ([]byte, bool) {
+    data, err := ioutil.ReadFile(c.fileName(x, y))
+    if err != nil {
+        return nil, false
+    }
+    return data, true
+}
+
+// Put stores tile atomically, tile file is either complete or missing
+func (c *DirTileCache) Put(x, y int, data []byte) error {
+    return writeFileAtomic(c.fileName(x, y), data)
+}
+
+// Count returns number of cached tiles
+func (c *DirTileCache) Count() int {
+    files, err := filepath.Glob(filepath.Join(c.dir, "*.tile"))
+    if err != nil {
+        return 0
+    }
+    return len(files)
+}
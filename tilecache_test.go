@@ -0,0 +1,65 @@
+package main
+
+import (
+    "context"
+    "image"
+    "image/color"
+    "image/draw"
+    "image/png"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "sync/atomic"
+    "testing"
+    "github.com/op/go-logging"
+)
+
+func TestStitchResume(t *testing.T) {
+
+    // each tile has different color, server counts fetched tiles
+    var fetched int32
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        atomic.AddInt32(&fetched, 1)
+        m := image.NewRGBA(image.Rect(0, 0, 4, 4))
+        c := color.RGBA{uint8(len(r.URL.Path) * 10), uint8(r.URL.Path[3]), uint8(r.URL.Path[5]), 255}
+        draw.Draw(m, m.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+        png.Encode(w, m)
+    }))
+    defer ts.Close()
+
+    dir, err := ioutil.TempDir("", "scratch")
+    Ok(t, err)
+    defer os.RemoveAll(dir)
+
+    p := Provider{Name: "test", MinZoom: 0, MaxZoom: 5, Scale: 4, Url: ts.URL + "/{z}/{x}/{y}.png"}
+    ip := InputParams{Zoom: 2, XMin: 0, YMin: 0, XMax: 1, YMax: 1, Scale: 4, Provider: p}
+    s := NewStitcher(logging.MustGetLogger("test"), newTestFetchPolicy())
+
+    expected, _, err := s.Stitch(context.Background(), &ip, nil)
+    Ok(t, err)
+    atomic.StoreInt32(&fetched, 0)
+
+    cache, err := NewDirTileCache(dir)
+    Ok(t, err)
+
+    // interrupt stitching after two tiles
+    ctx, cancel := context.WithCancel(context.Background())
+    s.progress = func(done, total int) {
+        if done == 2 {
+            cancel()
+        }
+    }
+    _, _, err = s.Stitch(ctx, &ip, cache)
+    Equals(t, context.Canceled, err)
+    Equals(t, int32(2), atomic.LoadInt32(&fetched))
+    Equals(t, 2, cache.Count())
+
+    // resumed stitching fetches only missing tiles
+    s.progress = nil
+    final, failures, err := s.Stitch(context.Background(), &ip, cache)
+    Ok(t, err)
+    Equals(t, 0, len(failures))
+    Equals(t, int32(4), atomic.LoadInt32(&fetched))
+    Equals(t, expected.Pix, final.Pix)
+}
@@ -1,9 +1,10 @@
 package main
 
 import (
+    "crypto/rand"
+    "encoding/hex"
     "fmt"
-    "math/rand"
-    "time"
+    "math"
 )
 
 func IntMin(a, b int) int {
@@ -31,10 +32,31 @@ func IntPow2(a int) int {
     return result
 }
 
-// yyyy-mm-dd-hh-mm-ss-rrrr, where rrrr is random string
+// UniqueId returns random id (128 bits, hex encoded), ids of requests
+// must not be guessable
 func UniqueId() string {
-    t := time.Now()
-    uuid := fmt.Sprintf("%d-%02d-%02d-%02d-%02d-%02d-%09d-%04d",
-        t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), rand.Intn(9999))
-    return uuid
+    id := make([]byte, 16)
+    if _, err := rand.Read(id); err != nil {
+        panic(fmt.Sprintf("Cannot generate random id: %s", err))
+    }
+    return hex.EncodeToString(id)
+}
+
+// from http://wiki.openstreetmap.org/wiki/Slippy_map_tilenames
+func LonToTileX(lon float64, zoom int) int {
+    return int(math.Floor((lon + 180) / 360 * float64(IntPow2(zoom))))
+}
+
+func LatToTileY(lat float64, zoom int) int {
+    latRad := lat * math.Pi / 180
+    return int(math.Floor((1 - math.Log(math.Tan(latRad) + 1 / math.Cos(latRad)) / math.Pi) / 2 * float64(IntPow2(zoom))))
+}
+
+func containsString(list []string, s string) bool {
+    for _, item := range list {
+        if item == s {
+            return true
+        }
+    }
+    return false
 }
@@ -1,7 +1,6 @@
 package main
 
 import (
-    "fmt"
     "testing"
 )
 
@@ -25,8 +24,17 @@ func TestIntPow2(t *testing.T) {
     Equals(t, 256, IntPow2(8))
 }
 
+func TestLonLatToTile(t *testing.T) {
+    // Prague
+    Equals(t, 8848, LonToTileX(14.42, 14))
+    Equals(t, 5550, LatToTileY(50.08, 14))
+    Equals(t, 0, LonToTileX(-180, 0))
+    Equals(t, 0, LatToTileY(0, 0))
+}
+
 func TestUniqueId(t *testing.T) {
     id := UniqueId()
-    fmt.Printf("id: %s", id)
+    Equals(t, 32, len(id))
+    Equals(t, true, id != UniqueId())
 }
 
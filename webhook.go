@@ -0,0 +1,299 @@
+package main
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "net/url"
+    "os"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+    "github.com/op/go-logging"
+)
+
+// delivery log in queue directory (json line per delivery attempt)
+const WEBHOOK_LOG_FILE = "webhooks.log"
+
+const WEBHOOK_EVENT_FINISHED = "request.finished"
+
+const WEBHOOK_SIGNATURE_HEADER = "X-BSBigMap-Signature"
+
+// failed deliveries are retried with exponential backoff
+const WEBHOOK_MAX_ATTEMPTS = 6
+const WEBHOOK_BACKOFF = time.Second * 10
+
+const WEBHOOK_TIMEOUT = time.Second * 10
+
+// WebhookPayload is json sent to webhooks when request is finished
+type WebhookPayload struct {
+    Event string `json:"event"`
+    Id string `json:"id"`
+    State string `json:"state"`
+    Error string `json:"error,omitempty"`
+    ImageUrl string `json:"image_url,omitempty"`
+    QueueUrl string `json:"queue_url"`
+    Format string `json:"format"`
+    Width int `json:"width"`
+    Height int `json:"height"`
+    FailedTiles int `json:"failed_tiles"`
+    Timestamp int64 `json:"timestamp"`
+}
+
+// WebhookDelivery is record of delivery log
+type WebhookDelivery struct {
+    Time int64 `json:"time"`
+    Request string `json:"request"`
+    Url string `json:"url"`
+    Attempt int `json:"attempt"`
+    Status int `json:"status"`
+    Error string `json:"error,omitempty"`
+}
+
+// validateWebhookUrl checks url of webhook given by user
+func validateWebhookUrl(webhook string) error {
+    u, err := url.Parse(webhook)
+    if err != nil {
+        return fmt.Errorf("Cannot parse webhook url %s: %s", webhook, err)
+    }
+    if (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+        return fmt.Errorf("Webhook url must be absolute http or https url: %s", webhook)
+    }
+    return nil
+}
+
+// Notifier delivers payloads of finished requests to global webhooks and
+// callbacks of requests. Payloads are signed by HMAC-SHA256 of secret
+// (header X-BSBigMap-Signature: sha256=<hex>), unsigned if there is no
+// secret
+type Notifier struct {
+    log *logging.Logger
+    // client of global webhooks (configured by admin)
+    client *http.Client
+    // client of callbacks given by users (restricted by fetch policy)
+    callbackClient *http.Client
+    webhooks []string
+    secret string
+    // base of urls in payload (e.g. https://bigmap.example.com)
+    publicUrl string
+    logFile string
+    backoff time.Duration
+    links *Links
+    // validity of share links in payloads
+    linkValidity time.Duration
+    // creates revocable share of request (set by queue)
+    share func(id string, validity time.Duration) (*Share, error)
+
+    // serializes writes to delivery log
+    mutex sync.Mutex
+    pending sync.WaitGroup
+    // number of deliveries not finished yet
+    inflight int32
+    // closed on shutdown, deliveries waiting for retry are attempted at
+    // once and not retried any more
+    stop chan struct{}
+    stopOnce sync.Once
+}
+
+// constructor
+func NewNotifier(log *logging.Logger, webhooks []string, secret, publicUrl, logFile string, links *Links, linkValidity time.Duration, callbackClient *http.Client) *Notifier {
+    callbackClient.Timeout = WEBHOOK_TIMEOUT
+    return &Notifier{
+        log: log,
+        client: &http.Client{Timeout: WEBHOOK_TIMEOUT},
+        callbackClient: callbackClient,
+        webhooks: webhooks,
+        secret: secret,
+        publicUrl: strings.TrimSuffix(publicUrl, "/"),
+        logFile: logFile,
+        backoff: WEBHOOK_BACKOFF,
+        links: links,
+        linkValidity: linkValidity,
+        stop: make(chan struct{}),
+    }
+}
+
+func (n *Notifier) payload(request *QueueRequest) WebhookPayload {
+    width, height := request.Params.OutputSize()
+    p := WebhookPayload{
+        Event: WEBHOOK_EVENT_FINISHED,
+        Id: request.Id,
+        State: request.State,
+        Error: request.Error,
+        QueueUrl: n.publicUrl + "/queue?request=" + request.Id,
+        Format: request.Params.Format,
+        Width: width,
+        Height: height,
+        FailedTiles: len(request.FailedTiles),
+        Timestamp: time.Now().Unix(),
+    }
+    if request.State == QUEUE_REQUEST_STATE_DONE && n.share != nil {
+        // link is share, so owner can revoke it
+        share, err := n.share(request.Id, n.linkValidity)
+        if err != nil {
+            n.log.Errorf("Cannot create share of request %s for webhook: %s", request.Id, err)
+        } else {
+            p.ImageUrl = n.publicUrl + n.links.Url(request, share.Id, share.Expires)
+        }
+    }
+    return p
+}
+
+// Notify sends payload of finished request to all global webhooks and
+// callbacks of request (or only to given callbacks if there are any)
+func (n *Notifier) Notify(request *QueueRequest, callbacks ...string) {
+
+    targets := callbacks
+    if len(targets) == 0 {
+        targets = append(append(targets, n.webhooks...), request.Callbacks...)
+    }
+    if len(targets) == 0 {
+        return
+    }
+
+    // payload is created in background, share of image cannot be stored
+    // while caller holds lock of queue
+    finished := *request
+    n.pending.Add(1)
+    go func() {
+        defer n.pending.Done()
+
+        body, err := json.Marshal(n.payload(&finished))
+        if err != nil {
+            n.log.Errorf("Cannot create webhook payload of request %s: %s", request.Id, err)
+            return
+        }
+
+        for _, target := range targets {
+            n.pending.Add(1)
+            atomic.AddInt32(&n.inflight, 1)
+            go n.deliver(request.Id, target, body)
+        }
+    }()
+}
+
+// Wait blocks until all deliveries (including retries) are finished
+func (n *Notifier) Wait() {
+    n.pending.Wait()
+}
+
+// Shutdown stops retrying of failed deliveries (each of them is attempted
+// once more) and waits at most timeout for deliveries to finish
+func (n *Notifier) Shutdown(timeout time.Duration) {
+    n.stopOnce.Do(func() { close(n.stop) })
+
+    done := make(chan struct{})
+    go func() {
+        n.pending.Wait()
+        close(done)
+    }()
+
+    select {
+    case <-done:
+    case <-time.After(timeout):
+        n.log.Warningf("%d webhook deliveries not finished before shutdown", atomic.LoadInt32(&n.inflight))
+    }
+}
+
+func (n *Notifier) sign(body []byte) string {
+    h := hmac.New(sha256.New, []byte(n.secret))
+    h.Write(body)
+    return "sha256=" + hex.EncodeToString(h.Sum(nil))
+}
+
+// deliver posts payload to webhook, failed attempts are retried
+func (n *Notifier) deliver(id, target string, body []byte) {
+    defer n.pending.Done()
+    defer atomic.AddInt32(&n.inflight, -1)
+
+    backoff := n.backoff
+    final := false
+    for attempt := 1; attempt <= WEBHOOK_MAX_ATTEMPTS; attempt++ {
+
+        status, err := n.post(target, body)
+        delivery := WebhookDelivery{Time: time.Now().Unix(), Request: id, Url: target, Attempt: attempt, Status: status}
+        if err != nil {
+            delivery.Error = err.Error()
+        }
+        n.record(delivery)
+
+        if err == nil {
+            n.log.Debugf("Webhook %s of request %s delivered", target, id)
+            return
+        }
+
+        n.log.Warningf("Webhook %s of request %s failed (attempt %d): %s", target, id, attempt, err)
+
+        if final {
+            n.log.Errorf("Webhook %s of request %s given up on shutdown", target, id)
+            return
+        }
+
+        if attempt < WEBHOOK_MAX_ATTEMPTS {
+            select {
+            case <-time.After(backoff):
+            case <-n.stop:
+                // retry at once, but for the last time
+                final = true
+            }
+            backoff *= 2
+        }
+    }
+
+    n.log.Errorf("Webhook %s of request %s given up", target, id)
+}
+
+// post sends payload, any status other than 2xx is failure
+func (n *Notifier) post(target string, body []byte) (int, error) {
+    req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+    if err != nil {
+        return 0, err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    if len(n.secret) > 0 {
+        req.Header.Set(WEBHOOK_SIGNATURE_HEADER, n.sign(body))
+    }
+
+    client := n.callbackClient
+    if containsString(n.webhooks, target) {
+        client = n.client
+    }
+
+    resp, err := client.Do(req)
+    if err != nil {
+        return 0, err
+    }
+    io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1 << 16))
+    resp.Body.Close()
+
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        return resp.StatusCode, fmt.Errorf("Unexpected status %s", resp.Status)
+    }
+    return resp.StatusCode, nil
+}
+
+// record appends delivery attempt to delivery log
+func (n *Notifier) record(delivery WebhookDelivery) {
+    n.mutex.Lock()
+    defer n.mutex.Unlock()
+
+    line, err := json.Marshal(delivery)
+    if err != nil {
+        return
+    }
+
+    f, err := os.OpenFile(n.logFile, os.O_APPEND | os.O_CREATE | os.O_WRONLY, 0644)
+    if err != nil {
+        n.log.Warningf("Cannot write webhook delivery log: %s", err)
+        return
+    }
+    defer f.Close()
+    f.Write(append(line, '\n'))
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "sync"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestWebhookDelivery(t *testing.T) {
+    q, cleanup := newTestQueue(t, 0)
+    defer cleanup()
+    q.notifier.secret = "secret"
+    q.notifier.publicUrl = "https://bigmap.example.com"
+    q.notifier.backoff = time.Millisecond
+
+    // receiver fails first two deliveries
+    var mutex sync.Mutex
+    var payloads []WebhookPayload
+    calls := 0
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        mutex.Lock()
+        defer mutex.Unlock()
+        calls++
+        if calls <= 2 {
+            w.WriteHeader(http.StatusServiceUnavailable)
+            return
+        }
+        body, _ := ioutil.ReadAll(r.Body)
+        if r.Header.Get(WEBHOOK_SIGNATURE_HEADER) != q.notifier.sign(body) {
+            w.WriteHeader(http.StatusForbidden)
+            return
+        }
+        p := WebhookPayload{}
+        json.Unmarshal(body, &p)
+        payloads = append(payloads, p)
+    }))
+    defer ts.Close()
+
+    p := Provider{Name: "test", MinZoom: 0, MaxZoom: 5, Scale: 4, Url: "http://localhost/{z}/{x}/{y}.png"}
+    ip := InputParams{Zoom: 1, XMin: 0, YMin: 0, XMax: 1, YMax: 1, Scale: 4, Provider: p}
+    ip.Normalize()
+    r, err := q.Enqueue(&ip, EnqueueOptions{Callback: ts.URL + "/hook"})
+    Ok(t, err)
+
+    _, err = q.Claim("w")
+    Ok(t, err)
+    Ok(t, q.Complete(r.Id, "w", "", []TileFailure{{}}, "failure"))
+    q.notifier.Wait()
+
+    Equals(t, 1, len(payloads))
+    Equals(t, r.Id, payloads[0].Id)
+    Equals(t, QUEUE_REQUEST_STATE_ERROR, payloads[0].State)
+    Equals(t, 8, payloads[0].Width)
+    Equals(t, 1, payloads[0].FailedTiles)
+    Equals(t, "https://bigmap.example.com/queue?request=" + r.Id, payloads[0].QueueUrl)
+
+    // each attempt is logged
+    f, err := os.Open(q.notifier.logFile)
+    Ok(t, err)
+    defer f.Close()
+    var deliveries []WebhookDelivery
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        d := WebhookDelivery{}
+        Ok(t, json.Unmarshal(scanner.Bytes(), &d))
+        deliveries = append(deliveries, d)
+    }
+    Equals(t, 3, len(deliveries))
+    Equals(t, http.StatusServiceUnavailable, deliveries[0].Status)
+    Equals(t, 3, deliveries[2].Attempt)
+    Equals(t, "", deliveries[2].Error)
+
+    // callback of duplicate of finished request is notified immediately
+    Ok(t, q.updateRequest(r.Id, func(r *QueueRequest) error {
+        r.State = QUEUE_REQUEST_STATE_DONE
+        return nil
+    }))
+    _, err = q.Enqueue(&ip, EnqueueOptions{Callback: ts.URL + "/other"})
+    Ok(t, err)
+    q.notifier.Wait()
+    Equals(t, 2, len(payloads))
+    Equals(t, true, strings.HasPrefix(payloads[1].ImageUrl, "https://bigmap.example.com/download/"))
+    token := strings.Split(strings.TrimPrefix(payloads[1].ImageUrl, "https://bigmap.example.com/download/"), "/")[0]
+    downloaded, err := q.Download(token)
+    Ok(t, err)
+    Equals(t, r.Id, downloaded.Id)
+
+    // image url is share valid for configured time, it can be revoked
+    _, share, expires, err := q.links.Parse(token)
+    Ok(t, err)
+    Equals(t, true, expires <= time.Now().Add(LINK_WEBHOOK_DURATION).Unix())
+    Ok(t, q.RevokeShare(r.Id, share))
+    _, err = q.Download(token)
+    Equals(t, true, err != nil)
+
+    Equals(t, true, validateWebhookUrl("ftp://example.com") != nil)
+    Equals(t, true, validateWebhookUrl("/relative") != nil)
+}
+
+func TestWebhookShutdown(t *testing.T) {
+    q, cleanup := newTestQueue(t, 0)
+    defer cleanup()
+    q.notifier.backoff = time.Hour
+
+    // receiver always fails, payloads are not signed without secret
+    var mutex sync.Mutex
+    calls, signed := 0, 0
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        mutex.Lock()
+        defer mutex.Unlock()
+        calls++
+        if len(r.Header.Get(WEBHOOK_SIGNATURE_HEADER)) > 0 {
+            signed++
+        }
+        w.WriteHeader(http.StatusServiceUnavailable)
+    }))
+    defer ts.Close()
+
+    p := Provider{Name: "test", MinZoom: 0, MaxZoom: 5, Scale: 4, Url: "http://localhost/{z}/{x}/{y}.png"}
+    ip := InputParams{Zoom: 1, XMin: 0, YMin: 0, XMax: 1, YMax: 1, Scale: 4, Provider: p}
+    ip.Normalize()
+    r, err := q.Enqueue(&ip, EnqueueOptions{Callback: ts.URL + "/hook"})
+    Ok(t, err)
+    _, err = q.Claim("w")
+    Ok(t, err)
+    Ok(t, q.Complete(r.Id, "w", "", nil, ""))
+
+    // wait for first attempt, delivery then waits for retry
+    for i := 0; i < 100; i++ {
+        mutex.Lock()
+        n := calls
+        mutex.Unlock()
+        if n > 0 {
+            break
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+
+    // shutdown doesn't wait for backoff, delivery is attempted once more
+    start := time.Now()
+    q.notifier.Shutdown(10 * time.Second)
+    Equals(t, true, time.Since(start) < 5 * time.Second)
+    mutex.Lock()
+    defer mutex.Unlock()
+    Equals(t, 2, calls)
+    Equals(t, 0, signed)
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "mime/multipart"
+    "net/http"
+    "net/url"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+    "github.com/op/go-logging"
+)
+
+// RemoteWorker processes requests claimed from server by job api (see
+// HandlerJobs). Tiles and images are kept in local scratch directory,
+// finished images are uploaded to server
+type RemoteWorker struct {
+    log *logging.Logger
+    client *http.Client
+    server string
+    token string
+    name string
+    dir string
+    stitcher *Stitcher
+    pollInterval time.Duration
+    heartbeatInterval time.Duration
+
+    workers sync.WaitGroup
+
+    // cancels requests being processed when shutdown grace period elapses
+    abortCtx context.Context
+    abort context.CancelFunc
+}
+
+// errLeaseLost is returned by api calls rejected because of lost lease
+var errLeaseLost = fmt.Errorf("Lease lost")
+
+// constructor
+func NewRemoteWorker(log *logging.Logger, server, token, name, dir string, policy *FetchPolicy, pollInterval, heartbeatInterval time.Duration) (*RemoteWorker, error) {
+
+    if _, err := url.Parse(server); err != nil || len(server) == 0 {
+        return nil, fmt.Errorf("Invalid server url: %s", server)
+    }
+    if pollInterval <= 0 {
+        return nil, fmt.Errorf("Queue monitor interval must be positive")
+    }
+    if heartbeatInterval <= 0 {
+        return nil, fmt.Errorf("Heartbeat interval must be positive")
+    }
+
+    if err := os.MkdirAll(filepath.Join(dir, QUEUE_SCRATCH_DIR), os.ModePerm); err != nil {
+        return nil, err
+    }
+
+    w := &RemoteWorker{
+        log: log,
+        client: &http.Client{},
+        server: strings.TrimSuffix(server, "/"),
+        token: token,
+        name: name,
+        dir: dir,
+        stitcher: NewStitcher(log, policy),
+        pollInterval: pollInterval,
+        heartbeatInterval: heartbeatInterval,
+    }
+    w.abortCtx, w.abort = context.WithCancel(context.Background())
+
+    return w, nil
+}
+
+// Start runs given number of parallel workers until context is cancelled
+func (w *RemoteWorker) Start(ctx context.Context, workers int) {
+    w.log.Infof("Starting %d workers claiming requests from %s", workers, w.server)
+    for i := 0; i < workers; i++ {
+        w.workers.Add(1)
+        go w.run(ctx, fmt.Sprintf("%s-%d", w.name, i))
+    }
+}
+
+// Shutdown waits for requests being processed, context given to Start must
+// be already cancelled. Requests still running after grace period are
+// interrupted and released back to server
+func (w *RemoteWorker) Shutdown(grace time.Duration) {
+
+    done := make(chan struct{})
+    go func() {
+        w.workers.Wait()
+        close(done)
+    }()
+
+    select {
+    case <-done:
+        return
+    case <-time.After(grace):
+    }
+
+    w.log.Warningf("Shutdown grace period elapsed, interrupting running requests")
+    w.abort()
+    <-done
+}
+
+func (w *RemoteWorker) run(ctx context.Context, name string) {
+    defer w.workers.Done()
+
+    for {
+        request, err := w.claim(name)
+        if err != nil {
+            w.log.Errorf("Cannot claim request: %s", err)
+        }
+
+        if request != nil {
+            w.processRequest(request, name)
+            if ctx.Err() != nil {
+                return
+            }
+            continue
+        }
+
+        select {
+        case <-ctx.Done():
+            w.log.Debugf("Worker %s finished", name)
+            return
+        case <-time.After(w.pollInterval):
+        }
+    }
+}
+
+func (w *RemoteWorker) scratchDir(request *QueueRequest) string {
+    return filepath.Join(w.dir, QUEUE_SCRATCH_DIR, request.Id)
+}
+
+func (w *RemoteWorker) processRequest(request *QueueRequest, name string) {
+    w.log.Infof("Processing request %s", request.Id)
+
+    // processing is interrupted by shutdown or loss of lease
+    ctx, cancel := context.WithCancel(w.abortCtx)
+    defer cancel()
+    go keepLease(ctx, w.heartbeatInterval, func() error {
+        err := w.call("heartbeat", url.Values{"request": {request.Id}, "worker": {name}})
+        if err != nil && err != errLeaseLost {
+            // server could be restarted, lease is kept until it expires
+            w.log.Warningf("Heartbeat of request %s failed: %s", request.Id, err)
+            return nil
+        }
+        return err
+    }, func(err error) {
+        w.log.Errorf("Request %s: %s", request.Id, err)
+        cancel()
+    })
+
+    imageFile, err := generateImage(ctx, w.log, w.stitcher, request, w.scratchDir(request))
+
+    if err != nil && w.abortCtx.Err() != nil {
+        w.log.Warningf("Processing of request %s interrupted, releasing it", request.Id)
+        if err := w.call("release", url.Values{"request": {request.Id}, "worker": {name}}); err != nil {
+            w.log.Errorf("Cannot release request %s: %s", request.Id, err)
+        }
+        return
+    }
+
+    if err != nil && ctx.Err() != nil {
+        w.log.Warningf("Processing of request %s abandoned, lease was lost", request.Id)
+        os.RemoveAll(w.scratchDir(request))
+        return
+    }
+
+    failure := ""
+    if err != nil {
+        w.log.Errorf("%s", err)
+        failure = err.Error()
+        imageFile = ""
+    }
+
+    if err = w.complete(request, name, imageFile, failure); err != nil {
+        w.log.Errorf("Cannot upload result of request %s: %s", request.Id, err)
+        return
+    }
+
+    os.RemoveAll(w.scratchDir(request))
+    w.log.Infof("Request %s finished", request.Id)
+}
+
+func (w *RemoteWorker) newRequest(operation string, body io.Reader) (*http.Request, error) {
+    req, err := http.NewRequest(http.MethodPost, w.server + "/api/jobs/" + operation, body)
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Authorization", "Bearer " + w.token)
+    return req, nil
+}
+
+// send executes api request, conflict is reported as lost lease
+func (w *RemoteWorker) send(req *http.Request) (*http.Response, error) {
+    resp, err := w.client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    if resp.StatusCode == http.StatusConflict {
+        resp.Body.Close()
+        return nil, errLeaseLost
+    }
+    if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+        body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+        resp.Body.Close()
+        return nil, fmt.Errorf("%s %s", resp.Status, body)
+    }
+    return resp, nil
+}
+
+// call executes api operation with form values
+func (w *RemoteWorker) call(operation string, values url.Values) error {
+    req, err := w.newRequest(operation, strings.NewReader(values.Encode()))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+    resp, err := w.send(req)
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    return nil
+}
+
+// claim returns request claimed from server or nil if queue is empty
+func (w *RemoteWorker) claim(name string) (*QueueRequest, error) {
+    req, err := w.newRequest("claim", strings.NewReader(url.Values{"worker": {name}}.Encode()))
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+    resp, err := w.send(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode == http.StatusNoContent {
+        return nil, nil
+    }
+
+    request := QueueRequest{}
+    if err := json.NewDecoder(resp.Body).Decode(&request); err != nil {
+        return nil, err
+    }
+
+    // lease would expire before the first heartbeat, request is given back
+    if lease := time.Until(time.Unix(request.LeaseExpires, 0)); request.LeaseExpires > 0 && w.heartbeatInterval >= lease {
+        if err := w.call("release", url.Values{"request": {request.Id}, "worker": {name}}); err != nil {
+            w.log.Errorf("Cannot release request %s: %s", request.Id, err)
+        }
+        return nil, fmt.Errorf("Heartbeat interval %s is not shorter than lease %s of server", w.heartbeatInterval, lease.Round(time.Second))
+    }
+
+    return &request, nil
+}
+
+// complete uploads result of request, image (if any) is streamed
+func (w *RemoteWorker) complete(request *QueueRequest, name, imageFile, failure string) error {
+
+    failures, err := json.Marshal(request.FailedTiles)
+    if err != nil {
+        return err
+    }
+
+    pr, pw := io.Pipe()
+    mw := multipart.NewWriter(pw)
+
+    go func() {
+        err := func() error {
+            for _, field := range [][]string{{"request", request.Id}, {"worker", name}, {"error", failure}, {"failed_tiles", string(failures)}} {
+                if err := mw.WriteField(field[0], field[1]); err != nil {
+                    return err
+                }
+            }
+            if len(imageFile) > 0 {
+                f, err := os.Open(imageFile)
+                if err != nil {
+                    return err
+                }
+                defer f.Close()
+                part, err := mw.CreateFormFile("image", filepath.Base(imageFile))
+                if err != nil {
+                    return err
+                }
+                if _, err = io.Copy(part, f); err != nil {
+                    return err
+                }
+            }
+            return mw.Close()
+        }()
+        pw.CloseWithError(err)
+    }()
+
+    req, err := w.newRequest("complete", pr)
+    if err != nil {
+        pr.Close()
+        return err
+    }
+    req.Header.Set("Content-Type", mw.FormDataContentType())
+
+    resp, err := w.send(req)
+    if err != nil {
+        pr.Close()
+        return err
+    }
+    resp.Body.Close()
+    return nil
+}
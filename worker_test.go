@@ -0,0 +1,105 @@
+package main
+
+import (
+    "context"
+    "io/ioutil"
+    "net/http/httptest"
+    "os"
+    "testing"
+    "time"
+    "github.com/op/go-logging"
+)
+
+func TestQueueLease(t *testing.T) {
+    q, cleanup := newTestQueue(t, 0)
+    defer cleanup()
+
+    p := Provider{Name: "test", MinZoom: 0, MaxZoom: 5, Scale: 4, Url: "http://localhost/{z}/{x}/{y}.png"}
+    ip := InputParams{Zoom: 1, XMin: 0, YMin: 0, XMax: 1, YMax: 1, Scale: 4, Provider: p}
+    ip.Normalize()
+    r, err := q.Enqueue(&ip, EnqueueOptions{})
+    Ok(t, err)
+
+    claimed, err := q.Claim("a")
+    Ok(t, err)
+    Equals(t, r.Id, claimed.Id)
+
+    // leased request is not claimed again
+    claimed, err = q.Claim("b")
+    Ok(t, err)
+    Equals(t, true, claimed == nil)
+    Ok(t, q.Heartbeat(r.Id, "a"))
+
+    // expired lease is reclaimed by other worker
+    Ok(t, q.updateRequest(r.Id, func(r *QueueRequest) error {
+        r.LeaseExpires = time.Now().Add(-time.Second).Unix()
+        return nil
+    }))
+    claimed, err = q.Claim("b")
+    Ok(t, err)
+    Equals(t, r.Id, claimed.Id)
+
+    // original worker lost its lease
+    Equals(t, true, q.Heartbeat(r.Id, "a") != nil)
+    Equals(t, true, q.Complete(r.Id, "a", "", nil, "failure") != nil)
+
+    Ok(t, q.Release(r.Id, "b"))
+    claimed, err = q.Claim("c")
+    Ok(t, err)
+    Equals(t, r.Id, claimed.Id)
+}
+
+func TestRemoteWorker(t *testing.T) {
+    tiles := newTestTileServer()
+    defer tiles.Close()
+
+    q, cleanup := newTestQueue(t, 0)
+    defer cleanup()
+
+    log := logging.MustGetLogger("test")
+    server := httptest.NewServer(&HandlerJobs{log, q, "secret"})
+    defer server.Close()
+
+    p := Provider{Name: "test", MinZoom: 0, MaxZoom: 5, Scale: 4, Url: tiles.URL + "/{z}/{x}/{y}.png"}
+    // tile 1/1/1 is missing
+    ip := InputParams{Zoom: 1, XMin: 0, YMin: 0, XMax: 1, YMax: 1, Scale: 4, Provider: p}
+    ip.Normalize()
+    r, err := q.Enqueue(&ip, EnqueueOptions{})
+    Ok(t, err)
+
+    dir, err := ioutil.TempDir("", "worker")
+    Ok(t, err)
+    defer os.RemoveAll(dir)
+
+    // wrong token is rejected
+    w, err := NewRemoteWorker(log, server.URL, "wrong", "w", dir, newTestFetchPolicy(), time.Millisecond * 10, time.Second)
+    Ok(t, err)
+    _, err = w.claim("w")
+    Equals(t, true, err != nil)
+
+    // heartbeat interval not shorter than lease of server is refused,
+    // claimed request is given back
+    slow, err := NewRemoteWorker(log, server.URL, "secret", "slow", dir, newTestFetchPolicy(), time.Millisecond * 10, QUEUE_LEASE_DURATION)
+    Ok(t, err)
+    _, err = slow.claim("slow")
+    Equals(t, true, err != nil)
+    released, err := q.GetRequest(r.Id)
+    Ok(t, err)
+    Equals(t, "", released.Worker)
+
+    _, err = NewRemoteWorker(log, server.URL, "secret", "w", dir, newTestFetchPolicy(), time.Millisecond * 10, 0)
+    Equals(t, true, err != nil)
+
+    w.token = "secret"
+    ctx, cancel := context.WithCancel(context.Background())
+    w.Start(ctx, 2)
+
+    r = waitForState(t, q, r.Id, QUEUE_REQUEST_STATE_DONE)
+    Equals(t, "", r.Worker)
+    Equals(t, 1, len(r.FailedTiles))
+    _, err = q.results.Size(q.resultName(r))
+    Ok(t, err)
+
+    cancel()
+    w.Shutdown(time.Second)
+}